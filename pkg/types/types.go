@@ -1,11 +1,38 @@
 package types
 
+import "time"
+
 //Money describes amount of money in minimal values (cents)
 type Money int64
 
 //PaymentCategory describes the category in which the payments are made
 type PaymentCategory string
 
+//Category codes registered in every wallet by default
+const (
+	CategoryMobile    PaymentCategory = "mobile"
+	CategoryFood      PaymentCategory = "food"
+	CategoryAuto      PaymentCategory = "auto"
+	CategoryTransport PaymentCategory = "transport"
+	CategoryBank      PaymentCategory = "bank"
+)
+
+//Categories of the transactions the wallet makes itself, linked to the payment they belong to
+const (
+	CategoryFee    PaymentCategory = "fee"    //fees paid by the payer
+	CategoryReward PaymentCategory = "reward" //cashback credited to the payer, the transaction adds its amount to the balance
+)
+
+//Category describes an entry of the payment categories registry
+type Category struct {
+	Code   PaymentCategory
+	Name   string
+	Parent PaymentCategory
+	Active bool
+	Fee    Money
+	Limit  Money
+}
+
 //PaymentStatus describes the status of payment
 type PaymentStatus string
 
@@ -18,11 +45,14 @@ const (
 
 //Payment describes the payment information
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Status    PaymentStatus   `json:"status"`
+	LinkedID  string          `json:"linked_id,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
 }
 
 //Phone describes the phone number
@@ -30,16 +60,51 @@ type Phone string
 
 //Account describes the user account
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID        int64     `json:"id"`
+	Phone     Phone     `json:"phone"`
+	Balance   Money     `json:"balance"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 //Favorite holds the info abouth favorite payments
 type Favorite struct {
-	ID        string
-	AccountID int64
-	Name      string
-	Amount    Money
-	Category  PaymentCategory
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Name      string          `json:"name"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Position  int             `json:"position"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+//RewardStatus describes the status of reward
+type RewardStatus string
+
+//Reward status codes
+const (
+	RewardStatusPending    RewardStatus = "PENDING"
+	RewardStatusCredited   RewardStatus = "CREDITED"
+	RewardStatusClawedBack RewardStatus = "CLAWEDBACK"
+)
+
+//Reward describes the cashback granted for a payment. Once credited it's recorded as the reward transaction
+//with the same ID, linked to the payment
+type Reward struct {
+	ID          string
+	RuleID      string
+	AccountID   int64
+	PaymentID   string
+	Amount      Money
+	Status      RewardStatus
+	CreatedAt   time.Time
+	AvailableAt time.Time
+}
+
+//Voucher describes the promo code credited into the balance of accounts that redeem it
+type Voucher struct {
+	Code       string
+	Amount     Money
+	ExpiresAt  time.Time
+	MaxUses    int
+	RedeemedBy []int64
 }
@@ -0,0 +1,170 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidBatchSize error for negative batch size or number of workers
+var ErrInvalidBatchSize = errors.New("invalid batch size")
+
+//cancelCheckInterval is the number of payments a worker handles between the checks of its context
+const cancelCheckInterval = 1024
+
+//progressBatchSize is the default number of payments summed for a Progress
+const progressBatchSize = 100_000
+
+//progressBuffer is the number of progresses waiting for the reader, the workers wait when it's full
+const progressBuffer = 16
+
+//workerCount returns the number of goroutines to split the payments between, at least one
+func workerCount(goroutines int) int {
+	if goroutines < 1 {
+		return 1
+	}
+	return goroutines
+}
+
+//SumPaymentsContext sums up the payments like SumPayments, the workers stop when the context is done and ctx.Err() is returned
+func (s *Service) SumPaymentsContext(ctx context.Context, goroutines int) (types.Money, error) {
+	return s.Query().Context(ctx).Workers(goroutines).Sum()
+}
+
+//FilterPaymentsContext returns the payments of the account like FilterPayments,
+//the workers stop when the context is done and ctx.Err() is returned
+func (s *Service) FilterPaymentsContext(ctx context.Context, accountID int64, goroutines int) ([]types.Payment, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.FilterPaymentsByFnContext(ctx, func(payment types.Payment) bool {
+		return payment.AccountID == accountID
+	}, goroutines)
+}
+
+//FilterPaymentsByFnContext filters the payments like FilterPaymentsByFn, keeping their order,
+//the workers stop when the context is done and ctx.Err() is returned
+func (s *Service) FilterPaymentsByFnContext(ctx context.Context, filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	return s.Query().Context(ctx).Workers(goroutines).Filter(filter).Collect()
+}
+
+//ProgressOptions holds the settings of SumPaymentsWithProgressOptions
+type ProgressOptions struct {
+	BatchSize int //payments summed for a Progress, 100 000 if 0
+	Workers   int //goroutines summing the batches, the number of CPUs if 0
+}
+
+//normalize returns the batch size and the number of workers with the defaults applied
+func (o ProgressOptions) normalize() (int, int, error) {
+	if o.BatchSize < 0 || o.Workers < 0 {
+		return 0, 0, ErrInvalidBatchSize
+	}
+
+	batchSize, workers := o.BatchSize, o.Workers
+	if batchSize == 0 {
+		batchSize = progressBatchSize
+	}
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	return batchSize, workers, nil
+}
+
+//SumPaymentsWithProgressContext sums up the payments in batches like SumPaymentsWithProgress, see SumPaymentsWithProgressOptions
+func (s *Service) SumPaymentsWithProgressContext(ctx context.Context) <-chan Progress {
+	progress, _ := s.SumPaymentsWithProgressOptions(ctx, ProgressOptions{})
+	return progress
+}
+
+//SumPaymentsWithProgressOptions returns at once the channel of the progress of summing up the payments, split into batches
+//of {options.BatchSize} summed by a pool of {options.Workers} goroutines, the linked transactions are counted but not
+//summed, see SumPayments. A Progress is sent as soon as a batch is summed, in the order the workers finish, with the sum
+//of the batch and the totals of all the batches summed so far, the last one has 100 percent. The channel is closed when
+//every batch is sent. When the context is done first, the workers stop, the last Progress has Part -1 and holds
+//ctx.Err() with the totals of the batches sent before, and the channel is closed after it. The workers wait for
+//the reader when a few progresses are unread, and so does the last Progress, so the channel must be read until
+//it's closed, even after the context is cancelled
+func (s *Service) SumPaymentsWithProgressOptions(ctx context.Context, options ProgressOptions) (<-chan Progress, error) {
+	batchSize, workers, err := options.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	payments := s.payments
+	batches := (len(payments) + batchSize - 1) / batchSize
+	if batches == 0 {
+		batches = 1 //an empty batch, so even a wallet without payments gets to 100 percent
+	}
+	if workers > batches {
+		workers = batches
+	}
+
+	sums := make(chan Progress, workers)
+	progress := make(chan Progress, progressBuffer)
+	next := int64(-1)
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				part := int(atomic.AddInt64(&next, 1))
+				if part >= batches || ctx.Err() != nil {
+					return
+				}
+
+				start, end := part*batchSize, (part+1)*batchSize
+				if end > len(payments) {
+					end = len(payments)
+				}
+
+				sum := types.Money(0)
+				for i, payment := range payments[start:end] {
+					if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+						return
+					}
+					if payment.LinkedID == "" {
+						sum += payment.Amount
+					}
+				}
+				sums <- Progress{Part: part, Result: sum, Count: end - start}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(sums)
+	}()
+
+	go func() {
+		defer close(progress)
+		processed, total := 0, types.Money(0)
+		for batch := range sums {
+			if ctx.Err() != nil {
+				continue //the batches left are only drained from the workers
+			}
+
+			batch.Processed, batch.Total, batch.Percent = processed+batch.Count, total+batch.Result, 100
+			if len(payments) != 0 {
+				batch.Percent = float64(batch.Processed) * 100 / float64(len(payments))
+			}
+			select {
+			case progress <- batch:
+				processed, total = batch.Processed, batch.Total
+			case <-ctx.Done():
+			}
+		}
+
+		if processed < len(payments) {
+			progress <- Progress{Part: -1, Processed: processed, Total: total, Err: ctx.Err()} //after the unread ones
+		}
+	}()
+	return progress, nil
+}
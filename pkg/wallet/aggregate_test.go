@@ -0,0 +1,210 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//amountService returns the service with {count} payments of amounts from 0 to {count}-1 split between 10 accounts
+func amountService(count int) *testService {
+	s := newTestService()
+	for i := 0; i < 10; i++ {
+		_, _ = s.RegisterAccount(types.Phone(fmt.Sprintf("+9920000000%02d", i)))
+	}
+	for i := 0; i < count; i++ {
+		s.payments = append(s.payments, &types.Payment{
+			ID:        "payment-" + strconv.Itoa(i),
+			AccountID: int64(i%10 + 1),
+			Amount:    types.Money(i),
+			Category:  "test",
+			Status:    types.PaymentStatusInProgress,
+		})
+	}
+	return s
+}
+
+func TestService_SumPaymentsContext(t *testing.T) {
+	s := amountService(10_000)
+	for _, goroutines := range []int{0, 1, 3, 64, 20_000} {
+		sum, err := s.SumPaymentsContext(context.Background(), goroutines)
+		if err != nil || sum != 49_995_000 {
+			t.Errorf("SumPaymentsContext(%d) = %v, error = %v", goroutines, sum, err)
+		}
+
+		payments, err := s.FilterPaymentsContext(context.Background(), 3, goroutines)
+		if err != nil || len(payments) != 1000 {
+			t.Errorf("FilterPaymentsContext(%d): %d payments, error = %v", goroutines, len(payments), err)
+			continue
+		}
+		for i, payment := range payments {
+			if payment.Amount != types.Money(i*10+2) {
+				t.Errorf("FilterPaymentsContext(%d): payment %d out of order = %v", goroutines, i, payment)
+				break
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.SumPaymentsContext(ctx, 4)
+	if err != context.Canceled {
+		t.Errorf("SumPaymentsContext(): must return context.Canceled, returned = %v", err)
+	}
+}
+
+func TestService_FilterPaymentsByFnContext_cancel(t *testing.T) {
+	s := amountService(100_000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	visited := make(chan struct{}, 100_000)
+	payments, err := s.FilterPaymentsByFnContext(ctx, func(payment types.Payment) bool {
+		cancel()
+		visited <- struct{}{}
+		return true
+	}, 4)
+	if err != context.Canceled || payments != nil {
+		t.Errorf("FilterPaymentsByFnContext(): must return context.Canceled, returned = %v", err)
+	}
+	if len(visited) > 4*cancelCheckInterval {
+		t.Errorf("FilterPaymentsByFnContext(): workers didn't stop, %d payments visited", len(visited))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = s.FilterPaymentsByFnContext(ctx, func(payment types.Payment) bool {
+		time.Sleep(time.Microsecond)
+		return false
+	}, 2)
+	if err != context.DeadlineExceeded {
+		t.Errorf("FilterPaymentsByFnContext(): must return context.DeadlineExceeded, returned = %v", err)
+	}
+}
+
+func TestService_SumPaymentsWithProgressContext(t *testing.T) {
+	s := amountService(1_000_000)
+
+	sum := types.Money(0)
+	for progress := range s.SumPaymentsWithProgressContext(context.Background()) {
+		if progress.Err != nil {
+			t.Error(progress.Err)
+		}
+		sum += progress.Result
+	}
+	if sum != 499_999_500_000 {
+		t.Errorf("SumPaymentsWithProgressContext(): sum = %v", sum)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var last Progress
+	for progress := range s.SumPaymentsWithProgressContext(ctx) {
+		last = progress
+	}
+	if last.Err != context.Canceled || last.Part != -1 {
+		t.Errorf("SumPaymentsWithProgressContext(): last progress must hold context.Canceled, got = %v", last)
+	}
+}
+
+func TestService_aggregateContext_goroutineLeak(t *testing.T) {
+	s := amountService(300_000)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i)*50*time.Microsecond)
+		_, _ = s.SumPaymentsContext(ctx, 8)
+		_, _ = s.FilterPaymentsContext(ctx, 1, 8)
+		_, _ = s.FilterPaymentsByFnContext(ctx, FilterMobile, 8)
+		for range s.SumPaymentsWithProgressContext(ctx) { //read until closed, even when the context is done
+		}
+		cancel()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: %d before, %d after", before, after)
+	}
+}
+
+func TestService_SumPaymentsWithProgressOptions(t *testing.T) {
+	s := amountService(1_000_000)
+
+	progress, err := s.SumPaymentsWithProgressOptions(context.Background(), ProgressOptions{BatchSize: 1000, Workers: 1})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cap(progress) != progressBuffer {
+		t.Errorf("SumPaymentsWithProgressOptions(): the channel must not be buffered for every batch, capacity = %d", cap(progress))
+	}
+
+	parts := make(map[int]bool)
+	last := Progress{}
+	for batch := range progress {
+		if batch.Err != nil || batch.Count != 1000 || batch.Processed != last.Processed+1000 || batch.Total != last.Total+batch.Result || batch.Percent <= last.Percent {
+			t.Errorf("SumPaymentsWithProgressOptions(): wrong progress = %v after %v", batch, last)
+			return
+		}
+		parts[batch.Part] = true
+		last = batch
+	}
+	if len(parts) != 1000 || last.Total != 499_999_500_000 || last.Percent != 100 {
+		t.Errorf("SumPaymentsWithProgressOptions(): %d batches, last progress = %v", len(parts), last)
+	}
+
+	for _, options := range []ProgressOptions{{BatchSize: -1}, {Workers: -1}} {
+		_, err = s.SumPaymentsWithProgressOptions(context.Background(), options)
+		if err != ErrInvalidBatchSize {
+			t.Errorf("SumPaymentsWithProgressOptions(%v): must return ErrInvalidBatchSize, returned = %v", options, err)
+		}
+	}
+
+	empty := newTestService()
+	count := 0
+	for batch := range empty.SumPaymentsWithProgress() {
+		if batch.Percent != 100 || batch.Total != 0 {
+			t.Errorf("SumPaymentsWithProgress(): wrong progress of an empty wallet = %v", batch)
+		}
+		count++
+	}
+	if count != 1 {
+		t.Errorf("SumPaymentsWithProgress(): %d progresses of an empty wallet", count)
+	}
+}
+
+func TestService_SumPaymentsWithProgressOptions_cancelled(t *testing.T) {
+	s := amountService(1_000_000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progress, err := s.SumPaymentsWithProgressOptions(ctx, ProgressOptions{BatchSize: 1000, Workers: 1})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for len(progress) < progressBuffer { //the reader lags behind
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	batches, sum, last := 0, types.Money(0), Progress{}
+	for batch := range progress {
+		if batch.Err == nil {
+			batches++
+			sum += batch.Result
+		}
+		last = batch
+	}
+	if batches < progressBuffer || last.Part != -1 || last.Err != context.Canceled || last.Total != sum || last.Processed != batches*1000 {
+		t.Errorf("SumPaymentsWithProgressOptions(): unread progresses must be kept, %d batches summing %v, last progress = %v", batches, sum, last)
+	}
+}
@@ -0,0 +1,595 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//binaryMagic starts the binary snapshot, followed by the version byte. Then go the sections of tables: the tag
+//of the table, the number of records and the records, each prefixed by its length. The end tag closes the snapshot,
+//followed by the SHA-256 of everything before it. Integers are varints, UUIDs are stored as 16 bytes
+const binaryMagic = "WLTB"
+
+//binaryVersion is the version of the binary snapshot written by ExportBinary. Records of newer versions
+//may only have more fields at their end, which older versions skip
+const binaryVersion = 1
+
+//binaryMaxRecord limits the length of a record, so a broken length doesn't make Import allocate gigabytes
+const binaryMaxRecord = 1 << 20
+
+//binaryFile names the snapshot in the errors of ImportBinary
+const binaryFile = "wallet.bin"
+
+//Tags of the binary snapshot sections, sections of unknown tags are skipped
+const (
+	binaryEnd byte = iota
+	binaryAccounts
+	binaryPayments
+	binaryFavorites
+	binaryVouchers
+	binaryRewards
+)
+
+//Kinds of identifiers, the ones of uuid.New are stored as 16 bytes
+const (
+	binaryText byte = iota
+	binaryUUID
+)
+
+//Payment statuses are stored as a single byte
+var binaryStatuses = []types.PaymentStatus{"", types.PaymentStatusOk, types.PaymentStatusFail, types.PaymentStatusInProgress}
+
+//binaryWriter streams the binary snapshot, records are built in a reused buffer
+type binaryWriter struct {
+	writer  *bufio.Writer
+	hash    hash.Hash
+	record  []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (b *binaryWriter) uvarint(value uint64) {
+	b.record = append(b.record, b.scratch[:binary.PutUvarint(b.scratch[:], value)]...)
+}
+
+func (b *binaryWriter) varint(value int64) {
+	b.record = append(b.record, b.scratch[:binary.PutVarint(b.scratch[:], value)]...)
+}
+
+func (b *binaryWriter) text(value string) {
+	b.uvarint(uint64(len(value)))
+	b.record = append(b.record, value...)
+}
+
+//id adds the identifier, as 16 bytes if it is a UUID in the canonical form
+func (b *binaryWriter) id(value string) {
+	if !canonicalUUID(value) {
+		b.record = append(b.record, binaryText)
+		b.text(value)
+		return
+	}
+	parsed := uuid.MustParse(value)
+	b.record = append(b.record, binaryUUID)
+	b.record = append(b.record, parsed[:]...)
+}
+
+//canonicalUUID reports whether the identifier is a UUID in the lower case form of uuid.UUID.String,
+//so it is written back the same after being stored as 16 bytes
+func canonicalUUID(value string) bool {
+	if len(value) != 36 {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//timestamp adds the time in nanoseconds since the epoch, shifted by one so 0 stands for the zero time
+func (b *binaryWriter) timestamp(value time.Time) {
+	if value.IsZero() {
+		b.uvarint(0)
+		return
+	}
+	nanoseconds := value.UnixNano()
+	b.uvarint((uint64(nanoseconds)<<1 ^ uint64(nanoseconds>>63)) + 1)
+}
+
+//raw writes the built bytes as they are
+func (b *binaryWriter) raw() error {
+	_, err := b.writer.Write(b.record)
+	b.record = b.record[:0]
+	return err
+}
+
+//end writes the built record prefixed by its length
+func (b *binaryWriter) end() error {
+	_, err := b.writer.Write(b.scratch[:binary.PutUvarint(b.scratch[:], uint64(len(b.record)))])
+	if err == nil {
+		_, err = b.writer.Write(b.record)
+	}
+	b.record = b.record[:0]
+	return err
+}
+
+//section writes the header of the table section
+func (b *binaryWriter) section(tag byte, count int) error {
+	b.record = append(b.record, tag)
+	b.uvarint(uint64(count))
+	return b.raw()
+}
+
+//ExportBinary streams all the data into {w} in the compact binary snapshot format, an alternative to the text
+//dumps of Export that is faster to read and smaller
+func (s *Service) ExportBinary(w io.Writer) error {
+	hash := sha256.New()
+	b := &binaryWriter{
+		writer: bufio.NewWriterSize(io.MultiWriter(w, hash), dumpBufferSize),
+		hash:   hash,
+		record: make([]byte, 0, 256),
+	}
+
+	b.record = append(b.record, binaryMagic...)
+	b.record = append(b.record, binaryVersion)
+	err := b.raw()
+
+	if err == nil {
+		err = b.section(binaryAccounts, len(s.accounts))
+	}
+	for i := 0; err == nil && i < len(s.accounts); i++ {
+		account := s.accounts[i]
+		b.varint(account.ID)
+		b.text(string(account.Phone))
+		b.varint(int64(account.Balance))
+		b.timestamp(account.UpdatedAt)
+		err = b.end()
+	}
+
+	if err == nil {
+		err = b.section(binaryPayments, len(s.payments))
+	}
+	for i := 0; err == nil && i < len(s.payments); i++ {
+		payment := s.payments[i]
+		b.id(payment.ID)
+		b.varint(payment.AccountID)
+		b.varint(int64(payment.Amount))
+		b.text(string(payment.Category))
+		b.record = append(b.record, binaryStatus(payment.Status))
+		b.id(payment.LinkedID)
+		b.timestamp(payment.UpdatedAt)
+		b.timestamp(payment.CreatedAt)
+		err = b.end()
+	}
+
+	if err == nil {
+		err = b.section(binaryFavorites, len(s.favorites))
+	}
+	for i := 0; err == nil && i < len(s.favorites); i++ {
+		favorite := s.favorites[i]
+		b.id(favorite.ID)
+		b.varint(favorite.AccountID)
+		b.text(favorite.Name)
+		b.varint(int64(favorite.Amount))
+		b.text(string(favorite.Category))
+		b.varint(int64(favorite.Position))
+		b.timestamp(favorite.UpdatedAt)
+		err = b.end()
+	}
+
+	if err == nil {
+		err = b.section(binaryVouchers, len(s.vouchers))
+	}
+	for i := 0; err == nil && i < len(s.vouchers); i++ {
+		voucher := s.vouchers[i]
+		b.text(voucher.Code)
+		b.varint(int64(voucher.Amount))
+		b.varint(voucher.ExpiresAt.Unix())
+		b.varint(int64(voucher.MaxUses))
+		b.uvarint(uint64(len(voucher.RedeemedBy)))
+		for _, accountID := range voucher.RedeemedBy {
+			b.varint(accountID)
+		}
+		b.varint(int64(voucher.ExpiresAt.Nanosecond())) //added after the seconds of the expiry, at the end of the record
+		err = b.end()
+	}
+
+	if err == nil {
+		err = b.section(binaryRewards, len(s.rewards))
+	}
+	for i := 0; err == nil && i < len(s.rewards); i++ {
+		reward := s.rewards[i]
+		b.id(reward.ID)
+		b.text(reward.RuleID)
+		b.varint(reward.AccountID)
+		b.id(reward.PaymentID)
+		b.varint(int64(reward.Amount))
+		b.text(string(reward.Status))
+		b.timestamp(reward.CreatedAt)
+		b.timestamp(reward.AvailableAt)
+		err = b.end()
+	}
+
+	if err == nil {
+		b.record = append(b.record, binaryEnd)
+		err = b.raw()
+	}
+	if err == nil {
+		err = b.writer.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(hash.Sum(nil))
+	return err
+}
+
+//binaryStatus returns the byte of the payment status, 0 for statuses unknown to the binary format
+func binaryStatus(status types.PaymentStatus) byte {
+	for i, known := range binaryStatuses {
+		if known == status {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+//binaryReader reads the binary snapshot, computing the checksum of the bytes read
+type binaryReader struct {
+	reader *bufio.Reader
+	hash   hash.Hash
+	buffer []byte
+	single [1]byte
+}
+
+//ReadByte makes the reader usable with binary.ReadUvarint
+func (b *binaryReader) ReadByte() (byte, error) {
+	c, err := b.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	b.single[0] = c
+	b.hash.Write(b.single[:])
+	return c, nil
+}
+
+//read returns the next {n} bytes, valid until the next call
+func (b *binaryReader) read(n int) ([]byte, error) {
+	if cap(b.buffer) < n {
+		b.buffer = make([]byte, n)
+	}
+	b.buffer = b.buffer[:n]
+	_, err := io.ReadFull(b.reader, b.buffer)
+	if err != nil {
+		return nil, err
+	}
+	b.hash.Write(b.buffer)
+	return b.buffer, nil
+}
+
+//record returns the next length-prefixed record, valid until the next call
+func (b *binaryReader) record() ([]byte, error) {
+	length, err := binary.ReadUvarint(b)
+	if err != nil {
+		return nil, err
+	}
+	if length > binaryMaxRecord {
+		return nil, &DumpError{File: binaryFile, Reason: fmt.Sprintf("record of %d bytes is too long", length)}
+	}
+	return b.read(int(length))
+}
+
+//binaryRecord decodes the fields of a record, the first malformed field stops the decoding
+type binaryRecord struct {
+	data    []byte
+	invalid *recordError
+}
+
+//fail remembers the first malformed field
+func (r *binaryRecord) fail(field string) {
+	if r.invalid == nil {
+		r.invalid = &recordError{field: field, reason: "malformed"}
+	}
+	r.data = nil
+}
+
+func (r *binaryRecord) uvarint(field string) uint64 {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(field)
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryRecord) varint(field string) int64 {
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(field)
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryRecord) take(field string, n uint64) []byte {
+	if uint64(len(r.data)) < n {
+		r.fail(field)
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryRecord) text(field string) string {
+	return string(r.take(field, r.uvarint(field)))
+}
+
+func (r *binaryRecord) flag(field string) byte {
+	value := r.take(field, 1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (r *binaryRecord) id(field string) string {
+	switch r.flag(field) {
+	case binaryText:
+		return r.text(field)
+	case binaryUUID:
+		var id uuid.UUID
+		copy(id[:], r.take(field, uint64(len(id))))
+		return id.String()
+	}
+	r.fail(field)
+	return ""
+}
+
+func (r *binaryRecord) timestamp(field string) time.Time {
+	value := r.uvarint(field)
+	if value == 0 {
+		return time.Time{}
+	}
+	value--
+	return time.Unix(0, int64(value>>1)^-int64(value&1))
+}
+
+func (r *binaryRecord) status(field string) types.PaymentStatus {
+	value := r.flag(field)
+	if value == 0 || int(value) >= len(binaryStatuses) {
+		r.fail(field)
+		return ""
+	}
+	return binaryStatuses[value]
+}
+
+//stageBinary adds the decoded record of the table section to the batch
+func (b *importBatch) stageBinary(tag byte, data []byte) *recordError {
+	r := &binaryRecord{data: data}
+	switch tag {
+	case binaryAccounts:
+		account := &types.Account{
+			ID:        r.varint("id"),
+			Phone:     types.Phone(r.text("phone")),
+			Balance:   types.Money(r.varint("balance")),
+			UpdatedAt: r.timestamp("updated_at"),
+		}
+		if r.invalid == nil {
+			r.invalid = validateAccount(account)
+		}
+		if r.invalid == nil {
+			b.accounts = append(b.accounts, account)
+		}
+	case binaryPayments:
+		payment := &types.Payment{
+			ID:        r.id("id"),
+			AccountID: r.varint("account_id"),
+			Amount:    types.Money(r.varint("amount")),
+			Category:  types.PaymentCategory(r.text("category")),
+			Status:    r.status("status"),
+			LinkedID:  r.id("linked_id"),
+			UpdatedAt: r.timestamp("updated_at"),
+			CreatedAt: r.timestamp("created_at"),
+		}
+		if r.invalid == nil {
+			r.invalid = validatePayment(payment)
+		}
+		if r.invalid == nil {
+			b.payments = append(b.payments, payment)
+		}
+	case binaryFavorites:
+		favorite := &types.Favorite{
+			ID:        r.id("id"),
+			AccountID: r.varint("account_id"),
+			Name:      r.text("name"),
+			Amount:    types.Money(r.varint("amount")),
+			Category:  types.PaymentCategory(r.text("category")),
+			Position:  int(r.varint("position")),
+			UpdatedAt: r.timestamp("updated_at"),
+		}
+		if r.invalid == nil && favorite.Position < 0 {
+			r.invalid = &recordError{field: "position", reason: "must not be negative"}
+		}
+		if r.invalid == nil {
+			r.invalid = validateFavorite(favorite)
+		}
+		if r.invalid == nil {
+			b.favorites = append(b.favorites, favorite)
+		}
+	case binaryVouchers:
+		voucher := &types.Voucher{
+			Code:      r.text("code"),
+			Amount:    types.Money(r.varint("amount")),
+			ExpiresAt: time.Unix(r.varint("expires_at"), 0),
+			MaxUses:   int(r.varint("max_uses")),
+		}
+		count := r.uvarint("redeemed_by")
+		if count > uint64(len(r.data)) {
+			r.fail("redeemed_by") //every account ID takes at least a byte
+		}
+		for i := uint64(0); r.invalid == nil && i < count; i++ {
+			voucher.RedeemedBy = append(voucher.RedeemedBy, r.varint("redeemed_by"))
+		}
+		if r.invalid == nil && len(r.data) != 0 {
+			voucher.ExpiresAt = voucher.ExpiresAt.Add(time.Duration(r.varint("expires_at")))
+		}
+		if r.invalid == nil {
+			r.invalid = validateVoucher(voucher)
+		}
+		if r.invalid == nil {
+			b.vouchers = append(b.vouchers, voucher)
+		}
+	case binaryRewards:
+		reward := &types.Reward{
+			ID:          r.id("id"),
+			RuleID:      r.text("rule_id"),
+			AccountID:   r.varint("account_id"),
+			PaymentID:   r.id("payment_id"),
+			Amount:      types.Money(r.varint("amount")),
+			Status:      types.RewardStatus(r.text("status")),
+			CreatedAt:   r.timestamp("created_at"),
+			AvailableAt: r.timestamp("available_at"),
+		}
+		if r.invalid == nil {
+			r.invalid = validateReward(reward)
+		}
+		if r.invalid == nil {
+			b.rewards = append(b.rewards, reward)
+		}
+	}
+	return r.invalid
+}
+
+//ImportBinary imports the snapshot written by ExportBinary like ImportWithOptions. The snapshot is read
+//and its checksum verified before the first record is applied, malformed records are treated by {options.Mode}
+func (s *Service) ImportBinary(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	b := &binaryReader{reader: bufio.NewReaderSize(r, dumpBufferSize), hash: sha256.New()}
+	report := &ImportReport{}
+	batch := &importBatch{}
+
+	errs, err := batch.stageBinarySnapshot(b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = &DumpError{File: binaryFile, Reason: "truncated"}
+	}
+	if err == nil {
+		err = options.check(report, errs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(batch, options, report)
+}
+
+//stageBinarySnapshot reads the sections of the snapshot into the batch and verifies the checksum
+func (b *importBatch) stageBinarySnapshot(r *binaryReader) ([]*DumpError, error) {
+	header, err := r.read(len(binaryMagic) + 1)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(binaryMagic)]) != binaryMagic {
+		return nil, &DumpError{File: binaryFile, Reason: "not a binary snapshot"}
+	}
+	if header[len(binaryMagic)] > binaryVersion {
+		return nil, fmt.Errorf("%w: %s: v%d", ErrUnsupportedDumpVersion, binaryFile, header[len(binaryMagic)])
+	}
+
+	names := map[byte]string{
+		binaryAccounts:  accountsTable.name,
+		binaryPayments:  paymentsTable.name,
+		binaryFavorites: favoritesTable.name,
+		binaryVouchers:  vouchersTable.name,
+		binaryRewards:   rewardsTable.name,
+	}
+
+	errs := make([]*DumpError, 0)
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if tag == binaryEnd {
+			break
+		}
+
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := uint64(1); i <= count; i++ {
+			data, err := r.record()
+			if err != nil {
+				return nil, err
+			}
+
+			name, ok := names[tag]
+			if !ok {
+				continue //a section of a newer version
+			}
+
+			invalid := b.stageBinary(tag, data)
+			if invalid != nil {
+				errs = append(errs, &DumpError{File: binaryFile + ":" + name, Line: int(i), Field: invalid.field, Reason: invalid.reason})
+			}
+		}
+	}
+
+	checksum := r.hash.Sum(nil)
+	saved := make([]byte, len(checksum))
+	_, err = io.ReadFull(r.reader, saved)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(saved, checksum) {
+		return nil, &DumpError{File: binaryFile, Reason: "checksum mismatch"}
+	}
+
+	_, err = r.reader.ReadByte()
+	if err != io.EOF {
+		return nil, &DumpError{File: binaryFile, Reason: "data after the end of the snapshot"}
+	}
+	return errs, nil
+}
+
+//ExportBinaryToFile writes the binary snapshot into the file atomically, encrypted if the service has a key provider
+func (s *Service) ExportBinaryToFile(path string) error {
+	return createFileAtomic(path, s.sealFile(s.ExportBinary))
+}
+
+//ImportBinaryFromFile imports the binary snapshot written by ExportBinaryToFile
+func (s *Service) ImportBinaryFromFile(path string, options ImportOptions) (*ImportReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := s.openFile(file, path)
+	if err != nil {
+		return nil, err
+	}
+	return s.ImportBinary(reader, options)
+}
@@ -0,0 +1,227 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func TestService_ExportBinary(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	_, err := s.FavoritePayment(s.payments[0].ID, "lunch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s.GenerateVouchers(1, 100, time.Date(2030, time.January, 1, 0, 0, 0, 123_456_789, time.UTC), 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s.Redeem(1, s.vouchers[0].Code)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s.payments = append(s.payments, &types.Payment{ID: "legacy-id", AccountID: 2, Amount: 1, Category: "food", Status: types.PaymentStatusFail})
+
+	var buffer bytes.Buffer
+	err = s.ExportBinary(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	report, err := imported.ImportBinary(bytes.NewReader(buffer.Bytes()), ImportOptions{})
+	if err != nil || report.Payments.Added != len(s.payments) || report.Vouchers.Added != 1 {
+		t.Errorf("ImportBinary(): report = %v, error = %v", report, err)
+		return
+	}
+
+	for i, account := range imported.accounts {
+		if !sameAccount(account, s.accounts[i]) || !account.UpdatedAt.Equal(s.accounts[i].UpdatedAt) {
+			t.Errorf("ImportBinary(): wrong account = %v, expected %v", account, s.accounts[i])
+		}
+	}
+	for i, payment := range imported.payments {
+		if !samePayment(payment, s.payments[i]) || !payment.UpdatedAt.Equal(s.payments[i].UpdatedAt) {
+			t.Errorf("ImportBinary(): wrong payment = %v, expected %v", payment, s.payments[i])
+		}
+	}
+	if !sameFavorite(imported.favorites[0], s.favorites[0]) {
+		t.Errorf("ImportBinary(): wrong favorite = %v, expected %v", imported.favorites[0], s.favorites[0])
+	}
+	if voucher := imported.vouchers[0]; voucher.Code != s.vouchers[0].Code || len(voucher.RedeemedBy) != 1 || !voucher.ExpiresAt.Equal(s.vouchers[0].ExpiresAt) {
+		t.Errorf("ImportBinary(): wrong voucher = %v, expected %v", voucher, s.vouchers[0])
+	}
+}
+
+func TestService_ImportBinary_invalid(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	var buffer bytes.Buffer
+	err := s.ExportBinary(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	content := buffer.Bytes()
+
+	tests := map[string][]byte{
+		"truncated": content[:len(content)/2],
+		"flipped":   append(append([]byte(nil), content[:40]...), append([]byte{content[40] ^ 1}, content[41:]...)...),
+		"appended":  append(append([]byte(nil), content...), 0),
+		"text":      encodeDump(accountsTable, nil),
+	}
+	for name, broken := range tests {
+		t.Run(name, func(t *testing.T) {
+			imported := newTestService()
+			_, err := imported.ImportBinary(bytes.NewReader(broken), ImportOptions{Mode: ImportLenient})
+			if !errors.Is(err, ErrInvalidDump) || len(imported.accounts) != 0 {
+				t.Errorf("ImportBinary(): must return ErrInvalidDump, returned = %v", err)
+			}
+		})
+	}
+
+	newer := append([]byte(nil), content...)
+	newer[len(binaryMagic)] = binaryVersion + 1
+	_, err = newTestService().ImportBinary(bytes.NewReader(newer), ImportOptions{})
+	if !errors.Is(err, ErrUnsupportedDumpVersion) {
+		t.Errorf("ImportBinary(): must return ErrUnsupportedDumpVersion, returned = %v", err)
+	}
+}
+
+func TestService_ExportBinaryToFile(t *testing.T) {
+	s := generatedService(1000)
+	s.SetKeyProvider(testKeyRing(t, "key"))
+
+	path := filepath.Join(t.TempDir(), "wallet.bin")
+	err := s.ExportBinaryToFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != dumpFileMode {
+		t.Errorf("ExportBinaryToFile(): wrong file = %v, error = %v", info, err)
+		return
+	}
+
+	imported := newTestService()
+	imported.SetKeyProvider(s.keys)
+	report, err := imported.ImportBinaryFromFile(path, ImportOptions{})
+	if err != nil || report.Payments.Added != len(s.payments) {
+		t.Errorf("ImportBinaryFromFile(): report = %v, error = %v", report, err)
+	}
+}
+
+//BenchmarkSnapshotFormats compares the text dumps of Export with the binary snapshot: writing them, reporting
+//their size as bytes/snapshot, and decoding them into the import batch. Applying the batch is the same for both
+func BenchmarkSnapshotFormats(b *testing.B) {
+	formats := []struct {
+		name   string
+		export func(s *testService, dir string) error
+		decode func(dir string) error
+	}{
+		{
+			name:   "text",
+			export: func(s *testService, dir string) error { return s.Export(dir) },
+			decode: func(dir string) error {
+				batch := &importBatch{}
+				stages := map[string]func(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error){
+					accountsTable.file():  batch.stageAccounts,
+					paymentsTable.file():  batch.stagePayments,
+					favoritesTable.file(): batch.stageFavorites,
+					vouchersTable.file():  batch.stageVouchers,
+				}
+				for name, stage := range stages {
+					file, err := os.Open(filepath.Join(dir, name))
+					if err != nil {
+						return err
+					}
+					_, err = stage(file, name, nil)
+					file.Close()
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:   "binary",
+			export: func(s *testService, dir string) error { return s.ExportBinaryToFile(filepath.Join(dir, binaryFile)) },
+			decode: func(dir string) error {
+				file, err := os.Open(filepath.Join(dir, binaryFile))
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+
+				_, err = (&importBatch{}).stageBinarySnapshot(&binaryReader{reader: bufio.NewReaderSize(file, dumpBufferSize), hash: sha256.New()})
+				return err
+			},
+		},
+	}
+
+	for _, format := range formats {
+		format := format
+		b.Run("export/"+format.name, func(b *testing.B) {
+			benchmarkSizes(b, func(b *testing.B, s *testService) {
+				dir := b.TempDir()
+				for i := 0; i < b.N; i++ {
+					err := format.export(s, dir)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(dirSize(dir)), "bytes/snapshot")
+			})
+		})
+
+		b.Run("decode/"+format.name, func(b *testing.B) {
+			benchmarkSizes(b, func(b *testing.B, s *testService) {
+				dir := b.TempDir()
+				err := format.export(s, dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := format.decode(dir)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+//dirSize returns the total size of the files in the directory
+func dirSize(dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size()
+	}
+	return size
+}
@@ -0,0 +1,204 @@
+package wallet
+
+import (
+	"errors"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrCategoryNotFound error for category missing in the registry
+var ErrCategoryNotFound = errors.New("category not found")
+
+//ErrCategoryRegistered error for category code already in the registry
+var ErrCategoryRegistered = errors.New("category already registered")
+
+//ErrCategoryDisabled error for payments into a disabled category
+var ErrCategoryDisabled = errors.New("category is disabled")
+
+//ErrCategoryLimitExceeded error for payment amount over the category limit
+var ErrCategoryLimitExceeded = errors.New("category limit exceeded")
+
+//ErrInvalidCategory error for category with empty code, negative fee or limit, or parent making a cycle
+var ErrInvalidCategory = errors.New("invalid category")
+
+//DefaultCategories returns the categories every new wallet starts with
+func DefaultCategories() []types.Category {
+	return []types.Category{
+		{Code: types.CategoryMobile, Name: "Mobile", Active: true},
+		{Code: types.CategoryFood, Name: "Food", Active: true},
+		{Code: types.CategoryAuto, Name: "Auto", Active: true},
+		{Code: types.CategoryTransport, Name: "Transport", Active: true},
+		{Code: types.CategoryBank, Name: "Bank", Active: true},
+	}
+}
+
+//categoryRegistry returns the registered categories, seeding the defaults on first use
+func (s *Service) categoryRegistry() []*types.Category {
+	if s.categories == nil {
+		for _, category := range DefaultCategories() {
+			category := category
+			s.categories = append(s.categories, &category)
+		}
+	}
+	return s.categories
+}
+
+//FindCategoryByCode returns the pointer to a registered category and an error
+func (s *Service) FindCategoryByCode(code types.PaymentCategory) (*types.Category, error) {
+	for _, category := range s.categoryRegistry() {
+		if category.Code == code {
+			return category, nil
+		}
+	}
+	return nil, ErrCategoryNotFound
+}
+
+//Categories returns the copies of all registered categories
+func (s *Service) Categories() []types.Category {
+	categories := make([]types.Category, 0)
+	for _, category := range s.categoryRegistry() {
+		categories = append(categories, *category)
+	}
+	return categories
+}
+
+//RegisterCategory adds a new category to the registry, its parent must be registered already
+func (s *Service) RegisterCategory(category types.Category) (*types.Category, error) {
+	if category.Code == "" || category.Code == category.Parent || category.Fee < 0 || category.Limit < 0 {
+		return nil, ErrInvalidCategory
+	}
+
+	_, err := s.FindCategoryByCode(category.Code)
+	if err == nil {
+		return nil, ErrCategoryRegistered
+	}
+
+	if category.Parent != "" {
+		_, err = s.FindCategoryByCode(category.Parent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.categories = append(s.categoryRegistry(), &category)
+	return &category, nil
+}
+
+//UpdateCategory replaces name, parent, active flag, fee and limit of a registered category
+func (s *Service) UpdateCategory(category types.Category) (*types.Category, error) {
+	if category.Fee < 0 || category.Limit < 0 {
+		return nil, ErrInvalidCategory
+	}
+
+	saved, err := s.FindCategoryByCode(category.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	if category.Parent != "" {
+		_, err = s.FindCategoryByCode(category.Parent)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.isSubcategory(category.Parent, category.Code) {
+			return nil, ErrInvalidCategory
+		}
+	}
+
+	*saved = category
+	return saved, nil
+}
+
+//EnableCategory allows payments into the category again
+func (s *Service) EnableCategory(code types.PaymentCategory) error {
+	category, err := s.FindCategoryByCode(code)
+	if err != nil {
+		return err
+	}
+
+	category.Active = true
+	return nil
+}
+
+//DisableCategory forbids payments into the category and all of its subcategories
+func (s *Service) DisableCategory(code types.PaymentCategory) error {
+	category, err := s.FindCategoryByCode(code)
+	if err != nil {
+		return err
+	}
+
+	category.Active = false
+	return nil
+}
+
+//isSubcategory reports whether {code} is {ancestor} itself or lies anywhere below it
+func (s *Service) isSubcategory(code types.PaymentCategory, ancestor types.PaymentCategory) bool {
+	for i := 0; i <= len(s.categoryRegistry()); i++ { //a chain can't be longer than the registry
+		if code == ancestor {
+			return true
+		}
+
+		category, err := s.FindCategoryByCode(code)
+		if err != nil || category.Parent == "" {
+			return false
+		}
+		code = category.Parent
+	}
+	return false
+}
+
+//checkCategory validates that a payment of {amount} is allowed in the category and each of its parents
+func (s *Service) checkCategory(code types.PaymentCategory, amount types.Money) error {
+	category, err := s.FindCategoryByCode(code)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if !category.Active {
+			return ErrCategoryDisabled
+		}
+
+		if category.Limit > 0 && amount > category.Limit {
+			return ErrCategoryLimitExceeded
+		}
+
+		if category.Parent == "" {
+			return nil
+		}
+
+		category, err = s.FindCategoryByCode(category.Parent)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//CategoryFilter returns the filter for FilterPaymentsByFn matching payments in the category and its subcategories
+func (s *Service) CategoryFilter(code types.PaymentCategory) (func(payment types.Payment) bool, error) {
+	_, err := s.FindCategoryByCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make(map[types.PaymentCategory]bool)
+	for _, category := range s.categoryRegistry() {
+		if s.isSubcategory(category.Code, code) {
+			codes[category.Code] = true
+		}
+	}
+
+	return func(payment types.Payment) bool {
+		return codes[payment.Category]
+	}, nil
+}
+
+//CategoryFilters returns the filters generated by CategoryFilter for every registered category
+func (s *Service) CategoryFilters() map[types.PaymentCategory]func(payment types.Payment) bool {
+	filters := make(map[types.PaymentCategory]func(payment types.Payment) bool)
+	for _, category := range s.categoryRegistry() {
+		filters[category.Code], _ = s.CategoryFilter(category.Code)
+	}
+	return filters
+}
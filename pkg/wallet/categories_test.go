@@ -0,0 +1,154 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func TestService_RegisterCategory_success(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterCategory(types.Category{Code: "internet", Name: "Internet", Parent: types.CategoryMobile, Active: true})
+	if err != nil {
+		t.Errorf("RegisterCategory(): error = %v", err)
+		return
+	}
+
+	category, err := s.FindCategoryByCode("internet")
+	if err != nil {
+		t.Errorf("RegisterCategory(): can't find category, error = %v", err)
+		return
+	}
+
+	if category.Parent != types.CategoryMobile {
+		t.Errorf("RegisterCategory(): wrong category saved = %v", category)
+	}
+}
+
+func TestService_RegisterCategory_fail(t *testing.T) {
+	s := newTestService()
+	tests := []struct {
+		category types.Category
+		err      error
+	}{
+		{category: types.Category{Code: ""}, err: ErrInvalidCategory},
+		{category: types.Category{Code: "self", Parent: "self"}, err: ErrInvalidCategory},
+		{category: types.Category{Code: "negative", Limit: -1}, err: ErrInvalidCategory},
+		{category: types.Category{Code: types.CategoryFood}, err: ErrCategoryRegistered},
+		{category: types.Category{Code: "orphan", Parent: "unknown"}, err: ErrCategoryNotFound},
+	}
+
+	for _, test := range tests {
+		_, err := s.RegisterCategory(test.category)
+		if err != test.err {
+			t.Errorf("RegisterCategory(%v): must return %v, returned = %v", test.category, test.err, err)
+		}
+	}
+}
+
+func TestService_UpdateCategory_cycle(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterCategory(types.Category{Code: "internet", Parent: types.CategoryMobile, Active: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.UpdateCategory(types.Category{Code: types.CategoryMobile, Parent: "internet", Active: true})
+	if err != ErrInvalidCategory {
+		t.Errorf("UpdateCategory(): must return ErrInvalidCategory, returned = %v", err)
+	}
+}
+
+func TestService_Pay_categories(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 10_000_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.RegisterCategory(types.Category{Code: "internet", Parent: types.CategoryMobile, Active: true, Limit: 100_00})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 1_00, "unknown")
+	if err != ErrCategoryNotFound {
+		t.Errorf("Pay(): must return ErrCategoryNotFound, returned = %v", err)
+	}
+
+	_, err = s.Pay(account.ID, 200_00, "internet")
+	if err != ErrCategoryLimitExceeded {
+		t.Errorf("Pay(): must return ErrCategoryLimitExceeded, returned = %v", err)
+	}
+
+	err = s.DisableCategory(types.CategoryMobile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 1_00, "internet")
+	if err != ErrCategoryDisabled {
+		t.Errorf("Pay(): must return ErrCategoryDisabled for disabled parent, returned = %v", err)
+	}
+
+	err = s.EnableCategory(types.CategoryMobile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 1_00, "internet")
+	if err != nil {
+		t.Errorf("Pay(): error = %v", err)
+	}
+
+	if account.Balance != 9_999_00 {
+		t.Errorf("Pay(): rejected payments changed the balance, account = %v", account)
+	}
+}
+
+func TestService_CategoryFilter(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterCategory(types.Category{Code: "internet", Parent: types.CategoryMobile, Active: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fillData(s)
+	_, err = s.Pay(1, 12, "internet")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	filter, err := s.CategoryFilter(types.CategoryMobile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payments, err := s.FilterPaymentsByFn(filter, 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sum := types.Money(0)
+	for _, payment := range payments {
+		sum += payment.Amount
+	}
+
+	if len(payments) != 5 || sum != 2+4+8+11+12 {
+		t.Errorf("CategoryFilter(): wrong payments matched = %v", payments)
+	}
+
+	_, ok := s.CategoryFilters()["internet"]
+	if !ok {
+		t.Error("CategoryFilters(): no filter generated for registered category")
+	}
+}
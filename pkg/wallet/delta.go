@@ -0,0 +1,406 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+//ErrInvalidCheckpoint error for checkpoint the wallet hasn't reached or of another run of the service
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint")
+
+//ErrBrokenDeltaChain error for deltas that don't continue the base or the previous delta
+var ErrBrokenDeltaChain = errors.New("broken delta chain")
+
+//deltaTable describes the checkpoints of a delta export: it holds the changes after {since} up to {until}
+//made in the {epoch}
+var deltaTable = dumpTable{
+	name:     "delta",
+	columns:  []string{"since", "until", "epoch"},
+	required: 3,
+}
+
+//removedTable lists the records removed after the checkpoint of a delta export
+var removedTable = dumpTable{
+	name:     "removed",
+	columns:  []string{"table", "id"},
+	required: 2,
+}
+
+//changeKey identifies a record for change tracking, {id} is the account ID in decimal,
+//the ID of the payment, favorite or reward, or the code of the voucher
+type changeKey struct {
+	table string
+	id    string
+}
+
+//Checkpoint identifies a state of the wallet for delta exports: the sequence number of the last change of
+//a record, counted by the run of the service named by Epoch. Changes aren't dumped, so after a restart the
+//records are numbered anew and the checkpoints of the earlier run are refused. The zero Checkpoint precedes
+//every change of every run
+type Checkpoint struct {
+	Epoch    string
+	Sequence int64
+}
+
+//changeLog holds the sequence number of the last change of every record and of every removal
+type changeLog struct {
+	epoch    string //ID of the run of the service, set on the first use
+	sequence int64
+	changed  map[changeKey]int64
+	removed  map[changeKey]int64
+}
+
+//accountKey returns the change key of the account
+func accountKey(id int64) changeKey {
+	return changeKey{table: accountsTable.name, id: strconv.FormatInt(id, 10)}
+}
+
+//paymentKey returns the change key of the payment
+func paymentKey(id string) changeKey {
+	return changeKey{table: paymentsTable.name, id: id}
+}
+
+//favoriteKey returns the change key of the favorite
+func favoriteKey(id string) changeKey {
+	return changeKey{table: favoritesTable.name, id: id}
+}
+
+//voucherKey returns the change key of the voucher
+func voucherKey(code string) changeKey {
+	return changeKey{table: vouchersTable.name, id: code}
+}
+
+//rewardKey returns the change key of the reward
+func rewardKey(id string) changeKey {
+	return changeKey{table: rewardsTable.name, id: id}
+}
+
+//track records a change of the record under the next sequence number
+func (s *Service) track(key changeKey) {
+	if s.changes.changed == nil {
+		s.changes.changed = make(map[changeKey]int64)
+	}
+	s.changes.sequence++
+	s.changes.changed[key] = s.changes.sequence
+	delete(s.changes.removed, key)
+}
+
+//trackRemoval records the removal of the record under the next sequence number
+func (s *Service) trackRemoval(key changeKey) {
+	if s.changes.removed == nil {
+		s.changes.removed = make(map[changeKey]int64)
+	}
+	s.changes.sequence++
+	s.changes.removed[key] = s.changes.sequence
+	delete(s.changes.changed, key)
+}
+
+//changedSince reports whether the record changed after the checkpoint, every record belongs to the checkpoint 0
+func (s *Service) changedSince(key changeKey, since int64) bool {
+	return since == 0 || s.changes.changed[key] > since
+}
+
+//Checkpoint returns the checkpoint of the current state
+func (s *Service) Checkpoint() Checkpoint {
+	if s.changes.epoch == "" {
+		s.changes.epoch = uuid.New().String()
+	}
+	return Checkpoint{Epoch: s.changes.epoch, Sequence: s.changes.sequence}
+}
+
+//ExportDelta writes into the directory the records changed after the checkpoint {since} and returns the
+//checkpoint of the written state, to be passed as {since} to the next delta. See ExportDeltaTo
+func (s *Service) ExportDelta(dir string, since Checkpoint) (Checkpoint, error) {
+	err := makeDumpDir(dir)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	return s.ExportDeltaTo(s.dumpFS(dir), since)
+}
+
+//ExportDeltaTo writes into {fs} the dumps of the records changed after the checkpoint {since}, the dump of
+//the records removed since then and the checkpoints of the delta, and then their manifest. The delta
+//since the zero Checkpoint holds every record and is the base the later deltas are chained to by ImportChain.
+//A checkpoint of another run of the service is refused, the chain has to start over from a new base then.
+//Records added to the wallet without going through the service, like the ones of tests, only take
+//part in the base, as they have no change sequence number
+func (s *Service) ExportDeltaTo(fs DumpFS, since Checkpoint) (Checkpoint, error) {
+	until := s.Checkpoint()
+	if since != (Checkpoint{}) && since.Epoch != until.Epoch {
+		return Checkpoint{}, fmt.Errorf("%w: %d of the run %s, the wallet is at %d of the run %s",
+			ErrInvalidCheckpoint, since.Sequence, since.Epoch, until.Sequence, until.Epoch)
+	}
+	if since.Sequence < 0 || since.Sequence > until.Sequence {
+		return Checkpoint{}, fmt.Errorf("%w: %d, the wallet is at %d", ErrInvalidCheckpoint, since.Sequence, until.Sequence)
+	}
+
+	manifest := make([]manifestEntry, 0, len(dumpTables)+2)
+	for _, table := range dumpTables {
+		var entry manifestEntry
+		err := fs.WriteFile(table.file(), func(w io.Writer) error {
+			var err error
+			entry, err = s.exportTableSince(w, table, since.Sequence)
+			return err
+		})
+		if err != nil {
+			return Checkpoint{}, err
+		}
+		manifest = append(manifest, entry)
+	}
+
+	removed := make([][]string, 0)
+	for key, sequence := range s.changes.removed {
+		if sequence > since.Sequence {
+			removed = append(removed, []string{key.table, key.id})
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { //in a stable order, so equal deltas have equal checksums
+		if removed[i][0] != removed[j][0] {
+			return removed[i][0] < removed[j][0]
+		}
+		return removed[i][1] < removed[j][1]
+	})
+
+	deltas := [][]string{{strconv.FormatInt(since.Sequence, 10), strconv.FormatInt(until.Sequence, 10), until.Epoch}}
+	for _, dump := range []struct {
+		table   dumpTable
+		records [][]string
+	}{
+		{table: removedTable, records: removed},
+		{table: deltaTable, records: deltas},
+	} {
+		var entry manifestEntry
+		err := fs.WriteFile(dump.table.file(), func(w io.Writer) error {
+			d, err := newDumpWriter(w, dump.table)
+			for i := 0; err == nil && i < len(dump.records); i++ {
+				err = d.record(dump.records[i])
+			}
+			if err == nil {
+				err = d.flush()
+			}
+			entry = d.entry(dump.table.file())
+			return err
+		})
+		if err != nil {
+			return Checkpoint{}, err
+		}
+		manifest = append(manifest, entry)
+	}
+
+	return until, writeManifest(fs, manifest)
+}
+
+//ImportChain imports the base export of ExportDelta from the first directory and the deltas that follow it
+//from the rest, see ImportChainFrom
+func (s *Service) ImportChain(dirs []string, options ImportOptions) (*ImportReport, error) {
+	links := make([]DumpFS, len(dirs))
+	for i, dir := range dirs {
+		links[i] = s.dumpFS(dir)
+	}
+	return s.ImportChainFrom(links, options)
+}
+
+//ImportChainFrom imports the base export of ExportDeltaTo from the first link and the deltas that follow it
+//from the rest, like ImportFrom. Every delta must start at the checkpoint the previous link ends at, in the same run.
+//All links are read and checked before anything is applied, and the records of the later links replace
+//or remove the ones of the earlier, so the wallet gets the state of the last link or stays as it was
+func (s *Service) ImportChainFrom(links []DumpFS, options ImportOptions) (*ImportReport, error) {
+	if len(links) == 0 {
+		return nil, fmt.Errorf("%w: no base", ErrBrokenDeltaChain)
+	}
+
+	var chain *importBatch
+	errs := make([]*DumpError, 0)
+	until := Checkpoint{}
+	for i, fs := range links {
+		link := &importBatch{}
+		since, end, stageErrs, err := link.stageDelta(fs)
+		if err != nil {
+			return nil, err
+		}
+
+		if (i == 0 && since.Sequence != 0) || (i != 0 && since != until) {
+			return nil, fmt.Errorf("%w: %s starts at %d of the run %q, expected %d of the run %q",
+				ErrBrokenDeltaChain, dumpPath(fs, deltaTable.file()), since.Sequence, since.Epoch, until.Sequence, until.Epoch)
+		}
+		if i == 0 {
+			chain = link
+		} else {
+			chain.chain(link)
+		}
+		errs = append(errs, stageErrs...)
+		until = end
+	}
+
+	report := &ImportReport{}
+	err := options.check(report, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(chain, options, report)
+}
+
+//stageDelta reads the delta export of {fs} into the batch and returns its checkpoints
+func (b *importBatch) stageDelta(fs DumpFS) (since Checkpoint, until Checkpoint, errs []*DumpError, err error) {
+	manifest, err := readManifest(fs)
+	if err != nil {
+		return since, until, nil, err
+	}
+
+	entry, ok := manifest[deltaTable.file()]
+	if !ok {
+		return since, until, nil, fmt.Errorf("%w: %s isn't a delta export", ErrBrokenDeltaChain, dumpPath(fs, manifestFile))
+	}
+
+	errs, err = b.stage(fs, manifest)
+	if err != nil {
+		return since, until, nil, err
+	}
+
+	checkpoints := 0
+	found, err := stageFile(fs, entry, deltaTable, func(row dumpRow) error {
+		var err error
+		since.Sequence, err = row.int("since")
+		if err != nil {
+			return err
+		}
+		until.Sequence, err = row.int("until")
+		if err != nil {
+			return err
+		}
+		if since.Sequence < 0 || until.Sequence < since.Sequence {
+			return row.invalid("until", "must not be before since")
+		}
+		until.Epoch = row.text("epoch")
+		if until.Epoch == "" {
+			return row.invalid("epoch", "must not be empty")
+		}
+		since.Epoch = until.Epoch
+		checkpoints++
+		return nil
+	})
+	if err != nil {
+		return since, until, nil, err
+	}
+	if len(found) != 0 || checkpoints != 1 {
+		return since, until, nil, fmt.Errorf("%w: %s has no valid checkpoints", ErrInvalidDump, dumpPath(fs, deltaTable.file()))
+	}
+
+	entry, ok = manifest[removedTable.file()]
+	if !ok {
+		return since, until, errs, nil
+	}
+
+	found, err = stageFile(fs, entry, removedTable, func(row dumpRow) error {
+		key := changeKey{table: row.text("table"), id: row.text("id")}
+		if !dumpTableNamed(key.table) {
+			return row.invalid("table", "unknown table")
+		}
+		b.removed = append(b.removed, key)
+		return nil
+	})
+	if err != nil {
+		return since, until, nil, err
+	}
+	return since, until, append(errs, found...), nil
+}
+
+//stageFile streams the dump of {fs} described by the manifest {entry}
+func stageFile(fs DumpFS, entry manifestEntry, table dumpTable, parse func(row dumpRow) error) ([]*DumpError, error) {
+	reader, err := fs.Open(entry.file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return streamDump(reader, dumpPath(fs, entry.file), table, &entry, parse)
+}
+
+//dumpTableNamed reports whether {name} is the name of a table of the wallet
+func dumpTableNamed(name string) bool {
+	for _, table := range dumpTables {
+		if table.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//chain puts the records of the {next} batch over the ones of the batch: they replace the staged records
+//with the same keys, and the removals of {next} drop the staged records and cancel earlier removals
+func (b *importBatch) chain(next *importBatch) {
+	replaced := make(map[changeKey]bool)
+	for _, account := range next.accounts {
+		replaced[accountKey(account.ID)] = true
+	}
+	for _, payment := range next.payments {
+		replaced[paymentKey(payment.ID)] = true
+	}
+	for _, favorite := range next.favorites {
+		replaced[favoriteKey(favorite.ID)] = true
+	}
+	for _, voucher := range next.vouchers {
+		replaced[voucherKey(voucher.Code)] = true
+	}
+	for _, reward := range next.rewards {
+		replaced[rewardKey(reward.ID)] = true
+	}
+	for _, key := range next.removed {
+		replaced[key] = true
+	}
+
+	accounts := b.accounts[:0]
+	for _, account := range b.accounts {
+		if !replaced[accountKey(account.ID)] {
+			accounts = append(accounts, account)
+		}
+	}
+	b.accounts = append(accounts, next.accounts...)
+
+	payments := b.payments[:0]
+	for _, payment := range b.payments {
+		if !replaced[paymentKey(payment.ID)] {
+			payments = append(payments, payment)
+		}
+	}
+	b.payments = append(payments, next.payments...)
+
+	favorites := b.favorites[:0]
+	for _, favorite := range b.favorites {
+		if !replaced[favoriteKey(favorite.ID)] {
+			favorites = append(favorites, favorite)
+		}
+	}
+	b.favorites = append(favorites, next.favorites...)
+
+	vouchers := b.vouchers[:0]
+	for _, voucher := range b.vouchers {
+		if !replaced[voucherKey(voucher.Code)] {
+			vouchers = append(vouchers, voucher)
+		}
+	}
+	b.vouchers = append(vouchers, next.vouchers...)
+
+	rewards := b.rewards[:0]
+	for _, reward := range b.rewards {
+		if !replaced[rewardKey(reward.ID)] {
+			rewards = append(rewards, reward)
+		}
+	}
+	b.rewards = append(rewards, next.rewards...)
+
+	removed := b.removed[:0]
+	for _, key := range b.removed {
+		if !replaced[key] {
+			removed = append(removed, key)
+		}
+	}
+	b.removed = append(removed, next.removed...)
+}
@@ -0,0 +1,212 @@
+package wallet
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportDelta(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	removed, err := s.FavoritePayment(s.payments[0].ID, "lunch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	base, err := s.ExportDelta(dirs[0], Checkpoint{})
+	if err != nil || base != s.Checkpoint() {
+		t.Errorf("ExportDelta(): checkpoint = %v, error = %v", base, err)
+		return
+	}
+
+	err = s.Reject(s.payments[1].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.DeleteFavorite(1, removed.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s.RegisterAccount("+992000000004")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	until, err := s.ExportDelta(dirs[1], base)
+	if err != nil || until != s.Checkpoint() {
+		t.Errorf("ExportDelta(): checkpoint = %v, error = %v", until, err)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dirs[1], paymentsTable.file()))
+	if err != nil || strings.Count(string(content), "\n") != 3 || !strings.Contains(string(content), s.payments[1].ID) {
+		t.Errorf("ExportDelta(): wrong payments = %s, error = %v", content, err)
+		return
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dirs[1], removedTable.file()))
+	if err != nil || !strings.HasSuffix(string(content), "favorites;"+removed.ID+"\n") {
+		t.Errorf("ExportDelta(): wrong removals = %s, error = %v", content, err)
+		return
+	}
+
+	last, err := s.ExportDelta(dirs[2], until)
+	if err != nil || last != until {
+		t.Errorf("ExportDelta(): checkpoint = %v, error = %v", last, err)
+		return
+	}
+
+	imported := newTestService()
+	report, err := imported.ImportChain(dirs[:1], ImportOptions{})
+	if err != nil || report.Favorites.Added != 1 {
+		t.Errorf("ImportChain(): report = %v, error = %v", report, err)
+		return
+	}
+
+	report, err = imported.ImportChain(dirs, ImportOptions{})
+	if err != nil || report.Removed != 1 || report.Accounts.Added != 1 || report.Payments.Updated != 1 {
+		t.Errorf("ImportChain(): report = %v, error = %v", report, err)
+		return
+	}
+
+	if len(imported.accounts) != len(s.accounts) || len(imported.payments) != len(s.payments) || len(imported.favorites) != 0 {
+		t.Errorf("ImportChain(): wrong wallet, accounts = %v, payments = %v, favorites = %v", imported.accounts, imported.payments, imported.favorites)
+		return
+	}
+	for i, account := range imported.accounts {
+		if !sameAccount(account, s.accounts[i]) {
+			t.Errorf("ImportChain(): wrong account = %v, expected %v", account, s.accounts[i])
+		}
+	}
+	for i, payment := range imported.payments {
+		if !samePayment(payment, s.payments[i]) {
+			t.Errorf("ImportChain(): wrong payment = %v, expected %v", payment, s.payments[i])
+		}
+	}
+
+	ahead := s.Checkpoint()
+	ahead.Sequence++
+	_, err = s.ExportDelta(t.TempDir(), ahead)
+	if !errors.Is(err, ErrInvalidCheckpoint) {
+		t.Errorf("ExportDelta(): must return ErrInvalidCheckpoint, returned = %v", err)
+	}
+}
+
+func TestService_ImportChain_broken(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()}
+	base, err := s.ExportDelta(dirs[0], Checkpoint{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = s.Deposit(1, 100)
+	until, err := s.ExportDelta(dirs[1], base)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = s.Deposit(2, 100)
+	_, err = s.ExportDelta(dirs[2], until)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Export(dirs[3])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := map[string][]string{
+		"empty":      nil,
+		"no base":    dirs[1:2],
+		"gap":        {dirs[0], dirs[2]},
+		"reordered":  {dirs[0], dirs[2], dirs[1]},
+		"full dumps": {dirs[3], dirs[1]},
+	}
+	for name, chain := range tests {
+		t.Run(name, func(t *testing.T) {
+			imported := newTestService()
+			_, err := imported.ImportChain(chain, ImportOptions{})
+			if !errors.Is(err, ErrBrokenDeltaChain) || len(imported.accounts) != 0 {
+				t.Errorf("ImportChain(): must return ErrBrokenDeltaChain, returned = %v", err)
+			}
+		})
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dirs[2], accountsTable.file()), encodeDump(accountsTable, nil), dumpFileMode)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	_, err = imported.ImportChain(dirs[:3], ImportOptions{})
+	if !errors.Is(err, ErrManifestMismatch) || len(imported.accounts) != 0 {
+		t.Errorf("ImportChain(): must return ErrManifestMismatch and import nothing, returned = %v", err)
+	}
+}
+
+func TestService_ExportDelta_restart(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	base, err := s.ExportDelta(dirs[0], Checkpoint{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = s.Deposit(1, 5)
+	checkpoint, err := s.ExportDelta(dirs[1], base)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	full := t.TempDir()
+	err = s.Export(full)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	restarted := newTestService()
+	err = restarted.Import(full)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for restarted.Checkpoint().Sequence < checkpoint.Sequence { //the same number means another state in another run
+		_ = restarted.Deposit(1, 5)
+	}
+	restart := restarted.Checkpoint()
+	_ = restarted.Deposit(2, 5)
+
+	_, err = restarted.ExportDelta(t.TempDir(), checkpoint)
+	if !errors.Is(err, ErrInvalidCheckpoint) {
+		t.Errorf("ExportDelta(): must return ErrInvalidCheckpoint for the checkpoint of the earlier run, returned = %v", err)
+	}
+
+	_, err = restarted.ExportDelta(dirs[2], restart)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = newTestService().ImportChain(dirs, ImportOptions{})
+	if !errors.Is(err, ErrBrokenDeltaChain) {
+		t.Errorf("ImportChain(): must return ErrBrokenDeltaChain for a delta of another run, returned = %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidDump error for dump with broken header, missing columns or malformed fields
+var ErrInvalidDump = errors.New("invalid dump")
+
+//ErrUnsupportedDumpVersion error for dump written by a newer version of the wallet
+var ErrUnsupportedDumpVersion = errors.New("unsupported dump version")
+
+//dumpVersion is the version of the format written by Export and ExportToFile.
+//Version 1 dumps have no header and positional columns, version 2 dumps start with
+//the "#wallet-dump v2 <table>" line followed by the line of column names,
+//version 3 escapes "\\", ";", "\n" and "\r" inside the fields with a backslash,
+//version 4 stores the expiry of vouchers in nanoseconds like the other timestamps instead of seconds
+const dumpVersion = 4
+
+//dumpMagic starts the header line of versioned dumps
+const dumpMagic = "#wallet-dump"
+
+//dumpTable describes the columns of a dump file
+type dumpTable struct {
+	name     string
+	columns  []string //columns in the order they are written, headerless dumps use the same order
+	required int      //number of leading columns every record must have, the rest were added later
+}
+
+var accountsTable = dumpTable{
+	name:     "accounts",
+	columns:  []string{"id", "phone", "balance", "updated_at"},
+	required: 3,
+}
+
+var paymentsTable = dumpTable{
+	name:     "payments",
+	columns:  []string{"id", "account_id", "amount", "category", "status", "linked_id", "updated_at", "created_at"},
+	required: 5,
+}
+
+var favoritesTable = dumpTable{
+	name:     "favorites",
+	columns:  []string{"id", "account_id", "name", "amount", "category", "position", "updated_at"},
+	required: 5,
+}
+
+var vouchersTable = dumpTable{
+	name:     "vouchers",
+	columns:  []string{"code", "amount", "expires_at", "max_uses", "redeemed_by"},
+	required: 5,
+}
+
+var rewardsTable = dumpTable{
+	name:     "rewards",
+	columns:  []string{"id", "rule_id", "account_id", "payment_id", "amount", "status", "created_at", "available_at"},
+	required: 8,
+}
+
+//dumpTables lists the tables in the order Export writes and Import reads them
+var dumpTables = []dumpTable{accountsTable, paymentsTable, favoritesTable, vouchersTable, rewardsTable}
+
+//file returns the name of the file the table is exported to
+func (t dumpTable) file() string {
+	return t.name + ".dump"
+}
+
+//DumpError describes a malformed record or header of a dump file
+type DumpError struct {
+	File   string
+	Line   int    //line of the record, for "|" separated accounts and JSON arrays - number of the record
+	Field  string //empty if the whole record is malformed
+	Reason string
+}
+
+func (e *DumpError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Reason)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Field, e.Reason)
+}
+
+//Unwrap makes every DumpError match ErrInvalidDump
+func (e *DumpError) Unwrap() error {
+	return ErrInvalidDump
+}
+
+//dumpRow is a record read from a dump, its fields are addressed by column names
+type dumpRow struct {
+	file    string
+	line    int
+	version int //1 for headerless dumps
+	columns map[string]int
+	fields  []string
+}
+
+//has reports whether the record has a value for the column
+func (r dumpRow) has(column string) bool {
+	i, ok := r.columns[column]
+	return ok && i < len(r.fields)
+}
+
+//text returns the value of the column or an empty string if the record has none
+func (r dumpRow) text(column string) string {
+	if !r.has(column) {
+		return ""
+	}
+	return r.fields[r.columns[column]]
+}
+
+//int parses the value of the column as an integer
+func (r dumpRow) int(column string) (int64, error) {
+	value, err := strconv.ParseInt(r.text(column), 10, 64)
+	if err != nil {
+		return 0, r.invalid(column, fmt.Sprintf("%q is not an integer", r.text(column)))
+	}
+	return value, nil
+}
+
+//timestamp parses the value of the column in nanoseconds since the epoch, records without it have the zero time
+func (r dumpRow) timestamp(column string) (time.Time, error) {
+	if r.text(column) == "" {
+		return time.Time{}, nil
+	}
+
+	nanoseconds, err := r.int(column)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanoseconds), nil
+}
+
+//invalid returns the error describing the malformed field of the record
+func (r dumpRow) invalid(column string, reason string) *DumpError {
+	return &DumpError{File: r.file, Line: r.line, Field: column, Reason: reason}
+}
+
+//appendDumpRecord appends the escaped fields of a record as a single line
+func appendDumpRecord(buffer []byte, fields []string) []byte {
+	for i, field := range fields {
+		if i > 0 {
+			buffer = append(buffer, ';')
+		}
+		buffer = appendDumpField(buffer, field)
+	}
+	return append(buffer, '\n')
+}
+
+//appendDumpField appends the field escaping "\\", ";", "\n" and "\r" with a backslash
+func appendDumpField(buffer []byte, field string) []byte {
+	for j := 0; j < len(field); j++ {
+		switch field[j] {
+		case '\\', ';':
+			buffer = append(buffer, '\\', field[j])
+		case '\n':
+			buffer = append(buffer, '\\', 'n')
+		case '\r':
+			buffer = append(buffer, '\\', 'r')
+		default:
+			buffer = append(buffer, field[j])
+		}
+	}
+	return buffer
+}
+
+//splitDumpRecord splits the line written by appendDumpRecord back into the unescaped fields,
+//lines of dumps written before version 3 have no escaping
+func splitDumpRecord(line string, escaped bool) ([]string, error) {
+	if !escaped {
+		return strings.Split(line, ";"), nil
+	}
+
+	fields := make([]string, 0)
+	field := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ';':
+			fields = append(fields, string(field))
+			field = field[:0]
+		case '\\':
+			i++
+			if i == len(line) {
+				return nil, errors.New("unfinished escape sequence")
+			}
+
+			switch line[i] {
+			case '\\', ';':
+				field = append(field, line[i])
+			case 'n':
+				field = append(field, '\n')
+			case 'r':
+				field = append(field, '\r')
+			default:
+				return nil, fmt.Errorf("unknown escape sequence \\%c", line[i])
+			}
+		default:
+			field = append(field, line[i])
+		}
+	}
+	return append(fields, string(field)), nil
+}
+
+//encodeDump returns the table records in the current dump version
+func encodeDump(table dumpTable, records [][]string) []byte {
+	var buffer bytes.Buffer
+	d, _ := newDumpWriter(&buffer, table) //writing into bytes.Buffer doesn't fail
+	for _, record := range records {
+		_ = d.record(record)
+	}
+	_ = d.flush()
+	return buffer.Bytes()
+}
+
+//decodeDump reads all the table records from the dump {content}, see dumpReader.
+//Records that don't fit the columns are returned as errors, while a broken header fails the whole dump
+func decodeDump(table dumpTable, file string, content []byte) ([]dumpRow, []*DumpError, error) {
+	d, err := newDumpReader(bytes.NewReader(content), table, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows := make([]dumpRow, 0)
+	errs := make([]*DumpError, 0)
+	for {
+		row, rowErr, err := d.next()
+		if err == io.EOF {
+			return rows, errs, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rowErr != nil {
+			errs = append(errs, rowErr)
+			continue
+		}
+		rows = append(rows, row)
+	}
+}
+
+//accountFromRow parses the account from a record of accountsTable
+func accountFromRow(row dumpRow) (*types.Account, error) {
+	id, err := row.int("id")
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := row.int("balance")
+	if err != nil {
+		return nil, err
+	}
+
+	updatedAt, err := row.timestamp("updated_at")
+	if err != nil {
+		return nil, err
+	}
+
+	account := &types.Account{
+		ID:        id,
+		Phone:     types.Phone(row.text("phone")),
+		Balance:   types.Money(balance),
+		UpdatedAt: updatedAt,
+	}
+	if invalid := validateAccount(account); invalid != nil {
+		return nil, row.invalid(invalid.field, invalid.reason)
+	}
+	return account, nil
+}
+
+//paymentFromRow parses the payment from a record of paymentsTable
+func paymentFromRow(row dumpRow) (*types.Payment, error) {
+	accountID, err := row.int("account_id")
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := row.int("amount")
+	if err != nil {
+		return nil, err
+	}
+
+	updatedAt, err := row.timestamp("updated_at")
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, err := row.timestamp("created_at")
+	if err != nil {
+		return nil, err
+	}
+
+	payment := &types.Payment{
+		ID:        row.text("id"),
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(row.text("category")),
+		Status:    types.PaymentStatus(row.text("status")),
+		LinkedID:  row.text("linked_id"),
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+	}
+	if invalid := validatePayment(payment); invalid != nil {
+		return nil, row.invalid(invalid.field, invalid.reason)
+	}
+	return payment, nil
+}
+
+//favoriteFromRow parses the favorite from a record of favoritesTable,
+//the position is -1 for dumps written before favorites could be reordered
+func favoriteFromRow(row dumpRow) (*types.Favorite, error) {
+	accountID, err := row.int("account_id")
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := row.int("amount")
+	if err != nil {
+		return nil, err
+	}
+
+	position := int64(-1)
+	if row.has("position") {
+		position, err = row.int("position")
+		if err != nil {
+			return nil, err
+		}
+
+		if position < 0 {
+			return nil, row.invalid("position", "must not be negative")
+		}
+	}
+
+	updatedAt, err := row.timestamp("updated_at")
+	if err != nil {
+		return nil, err
+	}
+
+	favorite := &types.Favorite{
+		ID:        row.text("id"),
+		AccountID: accountID,
+		Name:      row.text("name"),
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(row.text("category")),
+		Position:  int(position),
+		UpdatedAt: updatedAt,
+	}
+	if invalid := validateFavorite(favorite); invalid != nil {
+		return nil, row.invalid(invalid.field, invalid.reason)
+	}
+	return favorite, nil
+}
+
+//voucherFromRow parses the voucher from a record of vouchersTable
+func voucherFromRow(row dumpRow) (*types.Voucher, error) {
+	amount, err := row.int("amount")
+	if err != nil {
+		return nil, err
+	}
+
+	var expiresAt time.Time
+	if row.version >= 4 {
+		expiresAt, err = row.timestamp("expires_at")
+	} else {
+		var seconds int64
+		seconds, err = row.int("expires_at") //older dumps store seconds
+		expiresAt = time.Unix(seconds, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	maxUses, err := row.int("max_uses")
+	if err != nil {
+		return nil, err
+	}
+
+	var redeemedBy []int64 //nil like the vouchers nobody redeemed yet
+	if row.text("redeemed_by") != "" {
+		for _, field := range strings.Split(row.text("redeemed_by"), ",") {
+			accountID, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, row.invalid("redeemed_by", fmt.Sprintf("%q is not an account ID", field))
+			}
+			redeemedBy = append(redeemedBy, accountID)
+		}
+	}
+
+	voucher := &types.Voucher{
+		Code:       row.text("code"),
+		Amount:     types.Money(amount),
+		ExpiresAt:  expiresAt,
+		MaxUses:    int(maxUses),
+		RedeemedBy: redeemedBy,
+	}
+	if invalid := validateVoucher(voucher); invalid != nil {
+		return nil, row.invalid(invalid.field, invalid.reason)
+	}
+	return voucher, nil
+}
+
+//rewardFromRow parses the reward from a record of rewardsTable
+func rewardFromRow(row dumpRow) (*types.Reward, error) {
+	accountID, err := row.int("account_id")
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := row.int("amount")
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, err := row.timestamp("created_at")
+	if err != nil {
+		return nil, err
+	}
+
+	availableAt, err := row.timestamp("available_at")
+	if err != nil {
+		return nil, err
+	}
+
+	reward := &types.Reward{
+		ID:          row.text("id"),
+		RuleID:      row.text("rule_id"),
+		AccountID:   accountID,
+		PaymentID:   row.text("payment_id"),
+		Amount:      types.Money(amount),
+		Status:      types.RewardStatus(row.text("status")),
+		CreatedAt:   createdAt,
+		AvailableAt: availableAt,
+	}
+	if invalid := validateReward(reward); invalid != nil {
+		return nil, row.invalid(invalid.field, invalid.reason)
+	}
+	return reward, nil
+}
@@ -0,0 +1,261 @@
+package wallet
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func writeDumps(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestService_Import_legacyVersion(t *testing.T) {
+	dir := writeDumps(t, map[string]string{
+		"accounts.dump":  "1;+992000000001;100\n2;+992000000002;200\n",
+		"payments.dump":  "p1;1;10;mobile;INPROGRESS\n",
+		"favorites.dump": "f1;1;first;10;mobile\nf2;1;second;20;food\n",
+	})
+
+	s := newTestService()
+	err := s.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): error = %v", err)
+		return
+	}
+
+	account, err := s.FindAccountByID(2)
+	if err != nil || account.Balance != 200 {
+		t.Errorf("Import(): wrong account = %v, error = %v", account, err)
+		return
+	}
+
+	payment, err := s.FindPaymentByID("p1")
+	if err != nil || payment.Amount != 10 || payment.Category != types.CategoryMobile || payment.LinkedID != "" {
+		t.Errorf("Import(): wrong payment = %v, error = %v", payment, err)
+		return
+	}
+
+	favorites, err := s.ListFavorites(1)
+	if err != nil || len(favorites) != 2 || favorites[1].Name != "second" || favorites[1].Position != 1 {
+		t.Errorf("Import(): wrong favorites = %v, error = %v", favorites, err)
+		return
+	}
+
+	next, err := s.RegisterAccount("+992000000003")
+	if err != nil || next.ID != 3 {
+		t.Errorf("Import(): next account ID wasn't updated, account = %v, error = %v", next, err)
+	}
+}
+
+func TestService_Import_voucherExpiryInSeconds(t *testing.T) {
+	dir := writeDumps(t, map[string]string{
+		"accounts.dump": "1;+992000000001;100\n",
+		"vouchers.dump": "#wallet-dump v3 vouchers\ncode;amount;expires_at;max_uses;redeemed_by\nOLD;100;1893456000;1;\n",
+	})
+
+	s := newTestService()
+	err := s.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): error = %v", err)
+		return
+	}
+
+	voucher, err := s.FindVoucherByCode("OLD")
+	if err != nil || !voucher.ExpiresAt.Equal(time.Unix(1893456000, 0)) || voucher.RedeemedBy != nil {
+		t.Errorf("Import(): wrong voucher = %v, error = %v", voucher, err)
+	}
+}
+
+func TestService_Import_pipeSeparatedAccounts(t *testing.T) {
+	dir := writeDumps(t, map[string]string{
+		"accounts.dump": "1;+992000000001;100|2;+992000000002;200|",
+	})
+
+	s := newTestService()
+	err := s.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): error = %v", err)
+		return
+	}
+
+	account, err := s.FindAccountByID(2)
+	if err != nil || account.Phone != "+992000000002" {
+		t.Errorf("Import(): wrong account = %v, error = %v", account, err)
+	}
+
+	err = s.ImportFromFile(filepath.Join(dir, "accounts.dump"))
+	if err != nil || len(s.accounts) != 2 {
+		t.Errorf("ImportFromFile(): accounts = %v, error = %v", len(s.accounts), err)
+	}
+}
+
+func TestService_Import_namedColumns(t *testing.T) {
+	dir := writeDumps(t, map[string]string{
+		"accounts.dump": "#wallet-dump v2 accounts\nbalance;id;phone;nickname\n100;1;+992000000001;neo\n",
+	})
+
+	s := newTestService()
+	err := s.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): error = %v", err)
+		return
+	}
+
+	account, err := s.FindAccountByID(1)
+	if err != nil || account.Balance != 100 || account.Phone != "+992000000001" {
+		t.Errorf("Import(): wrong account = %v, error = %v", account, err)
+	}
+}
+
+func TestService_Import_invalidHeader(t *testing.T) {
+	tests := []struct {
+		content string
+		err     error
+	}{
+		{content: "#wallet-dump v99 accounts\nid;phone;balance\n", err: ErrUnsupportedDumpVersion},
+		{content: "#wallet-dump v2 payments\nid;phone;balance\n", err: ErrInvalidDump},
+		{content: "#wallet-dump v2 accounts\nid;phone\n", err: ErrInvalidDump},
+		{content: "#wallet-dump accounts\nid;phone;balance\n", err: ErrInvalidDump},
+		{content: "1;+992000000001\n", err: ErrInvalidDump},
+		{content: "one;+992000000001;100\n", err: ErrInvalidDump},
+	}
+
+	for _, test := range tests {
+		dir := writeDumps(t, map[string]string{"accounts.dump": test.content})
+		err := newTestService().Import(dir)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Import(%q): must return %v, returned = %v", test.content, test.err, err)
+		}
+	}
+}
+
+func TestService_Export_header(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "payments.dump"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasPrefix(string(content), "#wallet-dump v4 payments\nid;account_id;amount;category;status;linked_id;updated_at;created_at\n") {
+		t.Errorf("Export(): wrong header = %q", strings.SplitN(string(content), "\n", 3)[:2])
+	}
+}
+
+func TestDumpRecord_roundTrip(t *testing.T) {
+	roundTrip := func(fields []string) bool {
+		if len(fields) == 0 {
+			return true
+		}
+
+		line := appendDumpRecord(nil, fields)
+		got, err := splitDumpRecord(string(line[:len(line)-1]), true)
+		return err == nil && strings.Count(string(line), "\n") == 1 && reflect.DeepEqual(fields, got)
+	}
+
+	err := quick.Check(roundTrip, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func exportImportText(t *testing.T, phone string, name string, category string) bool {
+	s := newTestService()
+	account, err := s.addAccountWithBalance(types.Phone(phone), 100)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+
+	payment := &types.Payment{
+		ID:        "p1",
+		AccountID: account.ID,
+		Amount:    10,
+		Category:  types.PaymentCategory(category),
+		Status:    types.PaymentStatusOk,
+	}
+	s.payments = append(s.payments, payment)
+
+	favorite, err := s.FavoritePayment(payment.ID, name)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+
+	dir := filepath.Join(t.TempDir(), "dump")
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): phone = %q, name = %q, category = %q, error = %v", phone, name, category, err)
+		return false
+	}
+
+	gotAccount, err := imported.FindAccountByID(account.ID)
+	if err != nil || !reflect.DeepEqual(account, gotAccount) {
+		return false
+	}
+
+	gotPayment, err := imported.FindPaymentByID(payment.ID)
+	if err != nil || !reflect.DeepEqual(payment, gotPayment) {
+		return false
+	}
+
+	gotFavorite, err := imported.FindFavoriteByID(favorite.ID)
+	return err == nil && reflect.DeepEqual(favorite, gotFavorite)
+}
+
+func TestService_ExportImport_escaping(t *testing.T) {
+	texts := []string{
+		"Mom; phone",
+		"first line\nsecond line",
+		"windows\r\nline",
+		"back\\slash\\n;\\",
+		"Закинуть на баланс",
+		"\xff\xfe invalid utf-8",
+		";",
+		"",
+	}
+
+	for _, text := range texts {
+		if !exportImportText(t, "+992"+text, text, "mobile"+text) {
+			t.Errorf("Export() then Import(): %q didn't survive", text)
+		}
+	}
+
+	err := quick.Check(func(phone string, name string, category string) bool {
+		return exportImportText(t, phone, name, category)
+	}, &quick.Config{MaxCount: 50})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,499 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ErrInvalidKey error for key that isn't an AES key or has an invalid identifier
+var ErrInvalidKey = errors.New("invalid encryption key")
+
+//ErrKeyNotFound error for key identifier unknown to the key provider
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+//ErrDumpTampered error for encrypted file that fails authentication, is truncated or isn't encrypted at all
+var ErrDumpTampered = errors.New("dump is tampered")
+
+//KeyProvider supplies the AES keys files are encrypted with, the identifier of the key is stored in every file
+type KeyProvider interface {
+	//CurrentKey returns the key new files are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	//Key returns the key by its identifier, keys replaced by rotation must stay available until RotateKeys
+	//re-encrypts the files written with them
+	Key(id string) ([]byte, error)
+}
+
+//KeyRing is the KeyProvider holding the keys in memory, the last added key is the current one
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+//NewKeyRing returns the key ring with no keys
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string][]byte)}
+}
+
+//Add adds the AES-128, AES-192 or AES-256 key and makes it the current one
+func (k *KeyRing) Add(id string, key []byte) error {
+	if !validKeyID(id) {
+		return fmt.Errorf("%w: identifier %q", ErrInvalidKey, id)
+	}
+
+	_, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+	return nil
+}
+
+//Remove forgets the key, files encrypted with it can't be read anymore
+func (k *KeyRing) Remove(id string) {
+	delete(k.keys, id)
+	if k.current == id {
+		k.current = ""
+	}
+}
+
+//CurrentKey returns the last added key
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	if k.current == "" {
+		return "", nil, ErrKeyNotFound
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+//Key returns the key by its identifier
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+//validKeyID reports whether the identifier fits the header of encrypted files
+func validKeyID(id string) bool {
+	return id != "" && len(id) <= 255 && !strings.ContainsAny(id, " \t\r\n")
+}
+
+//sealMagic starts the header of an encrypted file, followed by the key identifier, a line break and the nonce prefix.
+//The content follows in chunks of up to sealChunkSize bytes, each sealed with AES-GCM and prefixed by its length
+const sealMagic = "#wallet-sealed v1 "
+
+//sealChunkSize is the size of plaintext chunks, memory used for encryption doesn't grow with the size of files
+const sealChunkSize = dumpBufferSize
+
+//sealPrefixSize is the size of the random nonce prefix of a file. The rest of the nonce is the chunk counter
+//and the flag of the last chunk, so chunks can't be reordered, dropped or appended without failing authentication
+const sealPrefixSize = 7
+
+//newAEAD returns AES-GCM for the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+//sealer encrypts the content in chunks
+type sealer struct {
+	writer  io.Writer
+	aead    cipher.AEAD
+	header  []byte //authenticated with every chunk, binds the chunks to the key and the file
+	nonce   []byte
+	counter uint32
+	chunk   []byte
+	sealed  []byte
+}
+
+//newSealer writes the header of the file encrypted with the current key of {keys}
+func newSealer(w io.Writer, keys KeyProvider) (*sealer, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if !validKeyID(id) {
+		return nil, fmt.Errorf("%w: identifier %q", ErrInvalidKey, id)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce[:sealPrefixSize])
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(sealMagic+id+"\n"), nonce[:sealPrefixSize]...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{
+		writer: w,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		chunk:  make([]byte, 0, sealChunkSize),
+		sealed: make([]byte, 0, 4+sealChunkSize+aead.Overhead()),
+	}, nil
+}
+
+//Write encrypts the full chunks, the last one is sealed by close
+func (s *sealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.chunk) == sealChunkSize {
+			err := s.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.chunk[len(s.chunk):cap(s.chunk)], p)
+		s.chunk = s.chunk[:len(s.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+//close seals the last chunk, an empty content is sealed as an empty last chunk
+func (s *sealer) close() error {
+	return s.seal(true)
+}
+
+//seal writes the encrypted chunk
+func (s *sealer) seal(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("file too large to encrypt")
+	}
+	setChunkNonce(s.nonce, s.counter, last)
+
+	s.sealed = s.aead.Seal(s.sealed[:4], s.nonce, s.chunk, s.header)
+	binary.BigEndian.PutUint32(s.sealed[:4], uint32(len(s.sealed)-4))
+	_, err := s.writer.Write(s.sealed)
+
+	s.chunk = s.chunk[:0]
+	s.counter++
+	return err
+}
+
+//setChunkNonce sets the counter and the last chunk flag after the nonce prefix
+func setChunkNonce(nonce []byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[sealPrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+//opener decrypts the content sealed by sealer
+type opener struct {
+	file    string
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint32
+	chunk   []byte //decrypted content not read yet
+	buffer  []byte
+	plain   []byte //separate from buffer, a failed attempt to open the chunk clears the destination
+	done    bool
+}
+
+//readSealHeader returns the key identifier and the header of the encrypted file
+func readSealHeader(r *bufio.Reader, file string) (string, []byte, error) {
+	magic := make([]byte, len(sealMagic))
+	_, err := io.ReadFull(r, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && string(magic) != sealMagic {
+		return "", nil, fmt.Errorf("%w: %s: not encrypted", ErrDumpTampered, file)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := r.ReadString('\n')
+	if err == io.EOF || err == nil && !validKeyID(strings.TrimSuffix(id, "\n")) {
+		return "", nil, fmt.Errorf("%w: %s: malformed header", ErrDumpTampered, file)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	prefix := make([]byte, sealPrefixSize)
+	_, err = io.ReadFull(r, prefix)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", nil, fmt.Errorf("%w: %s: malformed header", ErrDumpTampered, file)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	header := append(append(magic, id...), prefix...)
+	return strings.TrimSuffix(id, "\n"), header, nil
+}
+
+//newOpener reads the header of the file encrypted with one of the keys of {keys}
+func newOpener(r io.Reader, keys KeyProvider, file string) (*opener, error) {
+	reader := bufio.NewReaderSize(r, dumpBufferSize)
+	id, header, err := readSealHeader(reader, file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(header)-sealPrefixSize:])
+	return &opener{
+		file:   file,
+		reader: reader,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		buffer: make([]byte, 0, sealChunkSize+aead.Overhead()),
+		plain:  make([]byte, 0, sealChunkSize),
+	}, nil
+}
+
+//Read returns the decrypted content, failing with ErrDumpTampered once a chunk fails authentication
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.chunk) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+
+		err := o.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.chunk)
+	o.chunk = o.chunk[n:]
+	return n, nil
+}
+
+//open decrypts the next chunk
+func (o *opener) open() error {
+	var length [4]byte
+	_, err := io.ReadFull(o.reader, length[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s: truncated", ErrDumpTampered, o.file)
+	}
+	if err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > uint32(cap(o.buffer)) {
+		return fmt.Errorf("%w: %s: chunk %d is too large", ErrDumpTampered, o.file, o.counter)
+	}
+
+	sealed := o.buffer[:size]
+	_, err = io.ReadFull(o.reader, sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s: truncated", ErrDumpTampered, o.file)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, last := range []bool{false, true} {
+		setChunkNonce(o.nonce, o.counter, last)
+		chunk, err := o.aead.Open(o.plain[:0], o.nonce, sealed, o.header)
+		if err != nil {
+			continue
+		}
+
+		o.chunk = chunk
+		o.counter++
+		if last {
+			o.done = true
+			_, err = o.reader.ReadByte()
+			if err != io.EOF {
+				return fmt.Errorf("%w: %s: data after the last chunk", ErrDumpTampered, o.file)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s: chunk %d fails authentication", ErrDumpTampered, o.file, o.counter)
+}
+
+//sealWith returns the function that streams the content written by {write} encrypted with the current key
+func sealWith(keys KeyProvider, write func(w io.Writer) error) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		s, err := newSealer(w, keys)
+		if err != nil {
+			return err
+		}
+
+		err = write(s)
+		if err != nil {
+			return err
+		}
+		return s.close()
+	}
+}
+
+//encryptedFS encrypts the files of the underlying storage
+type encryptedFS struct {
+	fs   DumpFS
+	keys KeyProvider
+}
+
+//EncryptedFS returns the storage that encrypts the files written into {fs} with the current key of {keys}
+//and decrypts the files read from it, refusing the tampered and not encrypted ones with ErrDumpTampered
+func EncryptedFS(fs DumpFS, keys KeyProvider) DumpFS {
+	return &encryptedFS{fs: fs, keys: keys}
+}
+
+func (e *encryptedFS) WriteFile(name string, write func(w io.Writer) error) error {
+	return e.fs.WriteFile(name, sealWith(e.keys, write))
+}
+
+func (e *encryptedFS) Open(name string) (io.ReadCloser, error) {
+	file, err := e.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := newOpener(file, e.keys, dumpPath(e.fs, name))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{o, file}, nil
+}
+
+//SetKeyProvider makes Export, ExportToFile and HistoryToFiles encrypt every file they write with the current key
+//of {keys}, and Import, ImportFromFile and RestoreSnapshot decrypt them. Nil turns the encryption off
+func (s *Service) SetKeyProvider(keys KeyProvider) {
+	s.keys = keys
+}
+
+//dumpFS returns the storage of the dumps in the directory, encrypted if the service has a key provider
+func (s *Service) dumpFS(dir string) DumpFS {
+	if s.keys == nil {
+		return DirFS(dir)
+	}
+	return EncryptedFS(DirFS(dir), s.keys)
+}
+
+//sealFile returns the function that streams the content of a single file, encrypted if the service has a key provider
+func (s *Service) sealFile(write func(w io.Writer) error) func(w io.Writer) error {
+	if s.keys == nil {
+		return write
+	}
+	return sealWith(s.keys, write)
+}
+
+//openFile returns the content of a single file, decrypted if the service has a key provider
+func (s *Service) openFile(r io.Reader, file string) (io.Reader, error) {
+	if s.keys == nil {
+		return r, nil
+	}
+	return newOpener(r, s.keys, file)
+}
+
+//RotateKeys re-encrypts with the current key every file in {dir} encrypted with another key and returns
+//the number of rewritten files. Manifests stay valid, as they describe the decrypted content
+func (s *Service) RotateKeys(dir string) (int, error) {
+	if s.keys == nil {
+		return 0, ErrKeyNotFound
+	}
+
+	current, _, err := s.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	fs := EncryptedFS(DirFS(dir), s.keys)
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		id, err := sealKeyID(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return rotated, err
+		}
+		if id == "" || id == current {
+			continue
+		}
+
+		err = reencrypt(fs, file.Name())
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+//sealKeyID returns the identifier of the key the file is encrypted with, or empty string for not encrypted file
+func sealKeyID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	id, _, err := readSealHeader(bufio.NewReader(file), path)
+	if errors.Is(err, ErrDumpTampered) {
+		return "", nil
+	}
+	return id, err
+}
+
+//reencrypt rewrites the file of the encrypted storage, so it is encrypted with the current key
+func reencrypt(fs DumpFS, name string) error {
+	reader, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return fs.WriteFile(name, func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+}
+
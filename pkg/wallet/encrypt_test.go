@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//testKeyRing returns the key ring with an AES-256 key for every identifier, the last one is current
+func testKeyRing(t *testing.T, ids ...string) *KeyRing {
+	keys := NewKeyRing()
+	for i, id := range ids {
+		err := keys.Add(id, bytes.Repeat([]byte{byte(i + 1)}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestService_Export_encrypted(t *testing.T) {
+	s := generatedService(10_000)
+	s.SetKeyProvider(testKeyRing(t, "2020-03"))
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "accounts.dump"))
+	if err != nil || bytes.Contains(content, []byte(s.accounts[0].Phone)) {
+		t.Errorf("Export(): accounts.dump isn't encrypted, error = %v", err)
+		return
+	}
+
+	imported := newTestService()
+	imported.SetKeyProvider(testKeyRing(t, "2020-03"))
+	report, err := imported.ImportWithOptions(dir, ImportOptions{})
+	if err != nil || report.Payments.Added != len(s.payments) {
+		t.Errorf("ImportWithOptions(): report = %v, error = %v", report, err)
+		return
+	}
+
+	_, err = newTestService().ImportWithOptions(dir, ImportOptions{})
+	if err == nil {
+		t.Error("ImportWithOptions(): encrypted dumps were imported without the key")
+	}
+
+	other := newTestService()
+	other.SetKeyProvider(testKeyRing(t, "2020-04"))
+	_, err = other.ImportWithOptions(dir, ImportOptions{})
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("ImportWithOptions(): must return ErrKeyNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Import_tampered(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	s.SetKeyProvider(testKeyRing(t, "key"))
+
+	exported := MemoryFS{}
+	err := s.ExportTo(EncryptedFS(exported, s.keys))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := map[string]func(content []byte) []byte{
+		"flipped":   func(content []byte) []byte { content[len(content)-20] ^= 1; return content },
+		"truncated": func(content []byte) []byte { return content[:len(content)-1] },
+		"appended":  func(content []byte) []byte { return append(content, content[len(content)-40:]...) },
+		"plaintext": func(content []byte) []byte { return encodeDump(paymentsTable, nil) },
+	}
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			fs := MemoryFS{}
+			for file, content := range exported {
+				fs[file] = append([]byte(nil), content...)
+			}
+			fs["payments.dump"] = tamper(fs["payments.dump"])
+
+			imported := newTestService()
+			imported.SetKeyProvider(s.keys)
+			_, err := imported.ImportFrom(EncryptedFS(fs, s.keys), ImportOptions{})
+			if !errors.Is(err, ErrDumpTampered) || len(imported.accounts) != 0 {
+				t.Errorf("ImportFrom(): must return ErrDumpTampered, returned = %v", err)
+			}
+		})
+	}
+}
+
+func TestService_ExportToFile_encrypted(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	s.SetKeyProvider(testKeyRing(t, "key"))
+
+	path := filepath.Join(t.TempDir(), "accounts.txt")
+	err := s.ExportToFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	imported.SetKeyProvider(s.keys)
+	report, err := imported.ImportFromFileWithOptions(path, ImportOptions{})
+	if err != nil || report.Accounts.Added != len(s.accounts) {
+		t.Errorf("ImportFromFileWithOptions(): report = %v, error = %v", report, err)
+	}
+
+	dir := t.TempDir()
+	payments, _ := s.ExportAccountHistory(1)
+	err = s.HistoryToFiles(payments, dir, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "payments1.dump"))
+	if err != nil || !bytes.HasPrefix(content, []byte(sealMagic+"key\n")) {
+		t.Errorf("HistoryToFiles(): payments1.dump isn't encrypted, error = %v", err)
+	}
+
+	read, err := imported.HistoryFromFiles(dir, "")
+	if err != nil || len(read) != len(payments) {
+		t.Errorf("HistoryFromFiles(): payments = %v, error = %v", read, err)
+	}
+}
+
+func TestService_RotateKeys(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	keys := testKeyRing(t, "old")
+	s.SetKeyProvider(keys)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = writeFileAtomic(filepath.Join(dir, "notes.txt"), []byte("not encrypted"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = keys.Add("new", bytes.Repeat([]byte{7}, 16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rotated, err := s.RotateKeys(dir)
+	if err != nil || rotated != len(dumpTables)+1 {
+		t.Errorf("RotateKeys(): rotated = %v, error = %v", rotated, err)
+		return
+	}
+
+	keys.Remove("old")
+	imported := newTestService()
+	imported.SetKeyProvider(keys)
+	report, err := imported.ImportWithOptions(dir, ImportOptions{})
+	if err != nil || report.Accounts.Added != len(s.accounts) {
+		t.Errorf("ImportWithOptions(): report = %v, error = %v", report, err)
+	}
+
+	rotated, err = s.RotateKeys(dir)
+	if err != nil || rotated != 0 {
+		t.Errorf("RotateKeys(): rotated = %v, error = %v", rotated, err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "accounts.dump"))
+	if err != nil || info.Mode().Perm() != dumpFileMode {
+		t.Errorf("RotateKeys(): wrong file = %v, error = %v", info, err)
+	}
+}
+
+func TestKeyRing_Add_invalid(t *testing.T) {
+	keys := NewKeyRing()
+	if err := keys.Add("key", []byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Add(): must return ErrInvalidKey, returned = %v", err)
+	}
+	if err := keys.Add("two words", make([]byte, 16)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Add(): must return ErrInvalidKey, returned = %v", err)
+	}
+	if _, _, err := keys.CurrentKey(); err != ErrKeyNotFound {
+		t.Errorf("CurrentKey(): must return ErrKeyNotFound, returned = %v", err)
+	}
+}
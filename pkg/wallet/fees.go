@@ -0,0 +1,208 @@
+package wallet
+
+import (
+	"errors"
+	"math"
+
+	"github.com/google/uuid"
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidFeeRule error for fee rule with negative values, percent over 100% or empty band
+var ErrInvalidFeeRule = errors.New("invalid fee rule")
+
+//ErrRevenueAccountNotSet error for charging a fee while no revenue account is configured
+var ErrRevenueAccountNotSet = errors.New("revenue account not set")
+
+//ErrNotEnoughRevenue error for refunding fees the revenue account no longer holds
+var ErrNotEnoughRevenue = errors.New("not enough revenue to refund the fees")
+
+//ErrLinkedPayment error for operations on a transaction that belongs to another payment
+var ErrLinkedPayment = errors.New("payment is linked to another payment")
+
+//FeeRule describes the commission for payments of a category within an amount band.
+//Several rules for one category with adjacent bands make a tiered schedule
+type FeeRule struct {
+	Category types.PaymentCategory //empty category matches every payment
+	From     types.Money           //band start, inclusive
+	To       types.Money           //band end, exclusive, zero for unbounded band
+	Flat     types.Money
+	Percent  int64 //basis points from 0 to 10 000, 100 is 1%
+	Min      types.Money
+	Max      types.Money //zero for no cap
+}
+
+//matches reports whether the rule is applied to {amount} paid into {category}
+func (r FeeRule) matches(category types.PaymentCategory, amount types.Money) bool {
+	return r.Category == category && amount >= r.From && (r.To == 0 || amount < r.To)
+}
+
+//fee computes the commission for {amount} and clamps it into the rule caps.
+//The amount is split into whole 10 000s and the rest, so multiplying by the percent can't overflow
+func (r FeeRule) fee(amount types.Money) types.Money {
+	percent := types.Money(r.Percent)
+	share := amount/10_000*percent + (amount%10_000*percent+5_000)/10_000
+	fee := types.Money(math.MaxInt64)
+	if share <= fee-r.Flat {
+		fee = r.Flat + share
+	}
+	if fee < r.Min {
+		fee = r.Min
+	}
+	if r.Max > 0 && fee > r.Max {
+		fee = r.Max
+	}
+	return fee
+}
+
+//SetFeeRules replaces the rules of the fee engine
+func (s *Service) SetFeeRules(rules []FeeRule) error {
+	for _, rule := range rules {
+		if rule.From < 0 || rule.To < 0 || (rule.To != 0 && rule.To <= rule.From) ||
+			rule.Flat < 0 || rule.Percent < 0 || rule.Percent > 10_000 || rule.Min < 0 || rule.Max < 0 || (rule.Max != 0 && rule.Max < rule.Min) {
+			return ErrInvalidFeeRule
+		}
+
+		if rule.Category != "" {
+			_, err := s.FindCategoryByCode(rule.Category)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	s.feeRules = append([]FeeRule(nil), rules...)
+	return nil
+}
+
+//FeeRules returns the copy of the fee engine rules
+func (s *Service) FeeRules() []FeeRule {
+	return append([]FeeRule(nil), s.feeRules...)
+}
+
+//SetRevenueAccount sets the account credited with all charged fees
+func (s *Service) SetRevenueAccount(accountID int64) error {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return err
+	}
+
+	s.revenueAccountID = accountID
+	return nil
+}
+
+//CalculateFee returns the commission for paying {amount} into {category}.
+//The first rule of the category is used, then of its parents, then the ones matching every category,
+//and if none of them matches the amount - the flat fee from the categories registry
+func (s *Service) CalculateFee(amount types.Money, category types.PaymentCategory) types.Money {
+	code := category
+	for i := 0; i <= len(s.categoryRegistry()); i++ { //a chain can't be longer than the registry
+		for _, rule := range s.feeRules {
+			if rule.matches(code, amount) {
+				return rule.fee(amount)
+			}
+		}
+
+		registered, err := s.FindCategoryByCode(code)
+		if err != nil || registered.Parent == "" {
+			break
+		}
+		code = registered.Parent
+	}
+
+	for _, rule := range s.feeRules {
+		if rule.matches("", amount) {
+			return rule.fee(amount)
+		}
+	}
+
+	registered, err := s.FindCategoryByCode(category)
+	if err != nil {
+		return 0
+	}
+	return registered.Fee
+}
+
+//revenueAccount returns the account credited with fees
+func (s *Service) revenueAccount() (*types.Account, error) {
+	if s.revenueAccountID == 0 {
+		return nil, ErrRevenueAccountNotSet
+	}
+	return s.FindAccountByID(s.revenueAccountID)
+}
+
+//chargeFee records the fee of the payment as a linked transaction and credits the revenue account,
+//the payer's balance must be already decreased by the caller
+func (s *Service) chargeFee(payment *types.Payment, fee types.Money, revenue *types.Account) {
+	revenue.Balance += fee
+	revenue.UpdatedAt = s.stamp()
+	s.track(accountKey(revenue.ID))
+	charged := &types.Payment{
+		ID:        uuid.New().String(),
+		AccountID: payment.AccountID,
+		Amount:    fee,
+		Category:  types.CategoryFee,
+		Status:    payment.Status,
+		LinkedID:  payment.ID,
+		CreatedAt: payment.CreatedAt,
+		UpdatedAt: payment.UpdatedAt,
+	}
+	s.payments = append(s.payments, charged)
+	s.track(paymentKey(charged.ID))
+	s.logBalance(balanceEntry{kind: StatementFee, accountID: revenue.ID, amount: fee, paymentID: charged.ID, at: revenue.UpdatedAt})
+}
+
+//paidFees sums the fees of the payment that weren't refunded
+func (s *Service) paidFees(payment *types.Payment) types.Money {
+	sum := types.Money(0)
+	for _, fee := range s.payments {
+		if fee.LinkedID == payment.ID && fee.Category == types.CategoryFee && fee.Status != types.PaymentStatusFail {
+			sum += fee.Amount
+		}
+	}
+	return sum
+}
+
+//refundFees returns to the payer the share of the payment fees proportional to the {refunded} part of the payment.
+//It fails with ErrNotEnoughRevenue before refunding anything if the revenue account doesn't hold all the refunds,
+//so its balance never goes negative
+func (s *Service) refundFees(payment *types.Payment, refunded types.Money, account *types.Account) error {
+	fees := make([]*types.Payment, 0)
+	total := types.Money(0)
+	for _, fee := range s.payments {
+		if fee.LinkedID == payment.ID && fee.Category == types.CategoryFee && fee.Status != types.PaymentStatusFail {
+			fees = append(fees, fee)
+			total += fee.Amount * refunded / payment.Amount
+		}
+	}
+	if len(fees) == 0 {
+		return nil
+	}
+
+	revenue, err := s.revenueAccount()
+	if err != nil {
+		return err
+	}
+
+	if revenue.Balance < total {
+		return ErrNotEnoughRevenue
+	}
+
+	for _, fee := range fees {
+		refund := fee.Amount * refunded / payment.Amount
+		revenue.Balance -= refund
+		account.Balance += refund
+		revenue.UpdatedAt = s.stamp()
+		account.UpdatedAt = revenue.UpdatedAt
+		fee.UpdatedAt = revenue.UpdatedAt
+		if refund == fee.Amount {
+			fee.Status = types.PaymentStatusFail
+		} else {
+			fee.Amount -= refund
+		}
+		s.track(accountKey(revenue.ID))
+		s.track(accountKey(account.ID))
+		s.track(paymentKey(fee.ID))
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func (s *testService) addRevenueAccount() (*types.Account, error) {
+	revenue, err := s.RegisterAccount("+992000000000")
+	if err != nil {
+		return nil, err
+	}
+	return revenue, s.SetRevenueAccount(revenue.ID)
+}
+
+func TestService_CalculateFee(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterCategory(types.Category{Code: "internet", Parent: types.CategoryMobile, Active: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.UpdateCategory(types.Category{Code: types.CategoryBank, Active: true, Fee: 3_00})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetFeeRules([]FeeRule{
+		{Category: types.CategoryMobile, To: 100_00, Flat: 1_00},
+		{Category: types.CategoryMobile, From: 100_00, Percent: 150, Max: 5_00},
+		{Category: types.CategoryFood, Percent: 100, Min: 50},
+		{From: 1_000_00, Flat: 10_00},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		amount   types.Money
+		category types.PaymentCategory
+		fee      types.Money
+	}{
+		{amount: 50_00, category: types.CategoryMobile, fee: 1_00},
+		{amount: 200_00, category: types.CategoryMobile, fee: 3_00},
+		{amount: 1_000_00, category: types.CategoryMobile, fee: 5_00},
+		{amount: 50_00, category: "internet", fee: 1_00},
+		{amount: 10_00, category: types.CategoryFood, fee: 50},
+		{amount: 9_000_000_000_000_000_000, category: types.CategoryFood, fee: 90_000_000_000_000_000},
+		{amount: 1_000_00, category: types.CategoryAuto, fee: 10_00},
+		{amount: 10_00, category: types.CategoryAuto, fee: 0},
+		{amount: 10_00, category: types.CategoryBank, fee: 3_00},
+	}
+
+	for _, test := range tests {
+		fee := s.CalculateFee(test.amount, test.category)
+		if fee != test.fee {
+			t.Errorf("CalculateFee(%v, %v): expected: %v, got: %v", test.amount, test.category, test.fee, fee)
+		}
+	}
+}
+
+func TestService_SetFeeRules_fail(t *testing.T) {
+	s := newTestService()
+	rules := []FeeRule{
+		{Percent: -1},
+		{Percent: 10_001},
+		{From: 100, To: 100},
+		{Min: 10, Max: 5},
+	}
+
+	for _, rule := range rules {
+		err := s.SetFeeRules([]FeeRule{rule})
+		if err != ErrInvalidFeeRule {
+			t.Errorf("SetFeeRules(%v): must return ErrInvalidFeeRule, returned = %v", rule, err)
+		}
+	}
+
+	err := s.SetFeeRules([]FeeRule{{Category: "unknown"}})
+	if err != ErrCategoryNotFound {
+		t.Errorf("SetFeeRules(): must return ErrCategoryNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Pay_fee(t *testing.T) {
+	s := newTestService()
+	revenue, err := s.addRevenueAccount()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetFeeRules([]FeeRule{{Category: types.CategoryMobile, Percent: 100}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 100_00, types.CategoryMobile)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Pay(): must return ErrNotEnoughBalance when the fee doesn't fit, returned = %v", err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 50_00, types.CategoryMobile)
+	if err != nil {
+		t.Errorf("Pay(): error = %v", err)
+		return
+	}
+
+	if account.Balance != 49_50 || revenue.Balance != 50 {
+		t.Errorf("Pay(): wrong balances after fee, account = %v, revenue = %v", account, revenue)
+		return
+	}
+
+	history, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(history) != 2 || history[1].Category != types.CategoryFee || history[1].LinkedID != payment.ID || history[1].Amount != 50 {
+		t.Errorf("Pay(): fee transaction wasn't recorded, history = %v", history)
+		return
+	}
+
+	_, err = s.Repeat(history[1].ID)
+	if err != ErrLinkedPayment {
+		t.Errorf("Repeat(): must return ErrLinkedPayment for fee transaction, returned = %v", err)
+	}
+
+	if sum := s.SumPayments(2); sum != 50_00 {
+		t.Errorf("SumPayments(): the fee transaction must not be summed, sum = %v", sum)
+	}
+	if sum, err := s.Query().Linked().Sum(); err != nil || sum != 50_50 {
+		t.Errorf("Query().Linked().Sum(): the fee transaction must be summed, sum = %v, error = %v", sum, err)
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Errorf("Reject(): error = %v", err)
+		return
+	}
+
+	if account.Balance != 100_00 || revenue.Balance != 0 {
+		t.Errorf("Reject(): fee wasn't refunded, account = %v, revenue = %v", account, revenue)
+	}
+}
+
+func TestService_Reject_feeSpent(t *testing.T) {
+	s := newTestService()
+	revenue, err := s.addRevenueAccount()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetFeeRules([]FeeRule{{Category: types.CategoryMobile, Flat: 1_00}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 10_00, types.CategoryMobile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(revenue.ID, 1_00, types.CategoryAuto) //the fee is spent
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != ErrNotEnoughRevenue {
+		t.Errorf("Reject(): must return ErrNotEnoughRevenue, returned = %v", err)
+		return
+	}
+
+	if revenue.Balance != 0 || account.Balance != 89_00 || payment.Status == types.PaymentStatusFail {
+		t.Errorf("Reject(): nothing must change, account = %v, revenue = %v, payment = %v", account, revenue, payment)
+	}
+}
+
+func TestService_Pay_feeWithoutRevenueAccount(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetFeeRules([]FeeRule{{Flat: 1_00}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 10_00, types.CategoryAuto)
+	if err != ErrRevenueAccountNotSet {
+		t.Errorf("Pay(): must return ErrRevenueAccountNotSet, returned = %v", err)
+	}
+}
+
+func TestService_PayFromFavorite_fee(t *testing.T) {
+	s := newTestService()
+	revenue, err := s.addRevenueAccount()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, favorites, err := s.addFavorites("first")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetFeeRules([]FeeRule{{Flat: 2_00}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayFromFavorite(favorites[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if revenue.Balance != 2_00 {
+		t.Errorf("PayFromFavorite(): fee wasn't charged, revenue = %v", revenue)
+	}
+}
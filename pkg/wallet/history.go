@@ -0,0 +1,256 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidPageSize error for history page that can't hold a payment
+var ErrInvalidPageSize = errors.New("page size must be greater than zero")
+
+//ErrInvalidHistoryName error for history name that isn't a plain file name
+var ErrInvalidHistoryName = errors.New("invalid history name")
+
+//ErrHistoryPageNotFound error for page the history index doesn't list
+var ErrHistoryPageNotFound = errors.New("history page not found")
+
+//defaultHistoryName names the pages written by HistoryTo and HistoryToFiles
+const defaultHistoryName = "payments"
+
+//historyIndexTable lists the pages of a history, {first} and {last} are the positions of
+//the first and the last payment of the page in the history, counting from 0
+var historyIndexTable = dumpTable{
+	name:     "history",
+	columns:  []string{"page", "file", "first", "last", "records", "sha256"},
+	required: 6,
+}
+
+//HistoryOptions holds the settings of WriteHistory
+type HistoryOptions struct {
+	Name     string //pages are {Name}1.dump, {Name}2.dump and so on, "payments" if empty
+	PageSize int    //maximum number of payments in a page
+}
+
+//HistoryPage describes a page of a history
+type HistoryPage struct {
+	Number   int //from 1
+	File     string
+	First    int //position of the first payment of the page in the history
+	Last     int //position of the last payment of the page in the history
+	Records  int
+	checksum string
+}
+
+//HistoryIndex lists the pages of a history written by WriteHistory
+type HistoryIndex struct {
+	Name     string
+	Payments int
+	Pages    []HistoryPage
+}
+
+//name returns the history name, checking that the files named after it stay in the storage
+func (o HistoryOptions) name() (string, error) {
+	if o.Name == "" {
+		return defaultHistoryName, nil
+	}
+
+	if strings.ContainsAny(o.Name, `/\`) || o.Name == "." || o.Name == ".." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidHistoryName, o.Name)
+	}
+	return o.Name, nil
+}
+
+//historyPageFile returns the name of the page file of the history
+func historyPageFile(name string, page int) string {
+	return name + strconv.Itoa(page) + ".dump"
+}
+
+//historyIndexFile returns the name of the index file of the history
+func historyIndexFile(name string) string {
+	return name + "-index.dump"
+}
+
+//WriteHistory writes the payments into {fs} in pages of at most {options.PageSize} payments and then the index
+//of the pages. Every page is numbered, a history of no payments has an index without pages. Pages left by an
+//earlier, longer history under the same name aren't removed, but they aren't listed in the index either
+func (s *Service) WriteHistory(fs DumpFS, payments []types.Payment, options HistoryOptions) (*HistoryIndex, error) {
+	if options.PageSize <= 0 {
+		return nil, ErrInvalidPageSize
+	}
+
+	name, err := options.name()
+	if err != nil {
+		return nil, err
+	}
+
+	index := &HistoryIndex{Name: name, Payments: len(payments)}
+	for first := 0; first < len(payments); first += options.PageSize {
+		last := first + options.PageSize - 1
+		if last >= len(payments) {
+			last = len(payments) - 1
+		}
+
+		page := HistoryPage{Number: len(index.Pages) + 1, First: first, Last: last}
+		page.File = historyPageFile(name, page.Number)
+		err := fs.WriteFile(page.File, func(w io.Writer) error {
+			d, err := newDumpWriter(w, paymentsTable)
+			for i := first; err == nil && i <= last; i++ {
+				err = d.payment(&payments[i])
+			}
+			if err == nil {
+				err = d.flush()
+			}
+
+			entry := d.entry(page.File)
+			page.Records, page.checksum = entry.records, entry.checksum
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		index.Pages = append(index.Pages, page)
+	}
+
+	records := make([][]string, 0, len(index.Pages))
+	for _, page := range index.Pages {
+		records = append(records, []string{
+			strconv.Itoa(page.Number),
+			page.File,
+			strconv.Itoa(page.First),
+			strconv.Itoa(page.Last),
+			strconv.Itoa(page.Records),
+			page.checksum,
+		})
+	}
+
+	err = fs.WriteFile(historyIndexFile(name), writeBytes(encodeDump(historyIndexTable, records)))
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+//ReadHistoryIndex reads the index of the history named {name} written by WriteHistory into {fs}
+func ReadHistoryIndex(fs DumpFS, name string) (*HistoryIndex, error) {
+	name, err := HistoryOptions{Name: name}.name()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := fs.Open(historyIndexFile(name))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	index := &HistoryIndex{Name: name}
+	errs, err := streamDump(reader, dumpPath(fs, historyIndexFile(name)), historyIndexTable, nil, func(row dumpRow) error {
+		page := HistoryPage{File: row.text("file"), checksum: row.text("sha256")}
+		fields := []struct {
+			column string
+			value  *int
+		}{
+			{column: "page", value: &page.Number},
+			{column: "first", value: &page.First},
+			{column: "last", value: &page.Last},
+			{column: "records", value: &page.Records},
+		}
+		for _, field := range fields {
+			value, err := row.int(field.column)
+			if err != nil {
+				return err
+			}
+			*field.value = int(value)
+		}
+
+		if page.Number != len(index.Pages)+1 {
+			return row.invalid("page", "pages must be numbered in order from 1")
+		}
+		if page.File != historyPageFile(name, page.Number) {
+			return row.invalid("file", "must be named after the history and the page")
+		}
+		if page.First != index.Payments || page.Last-page.First+1 != page.Records {
+			return row.invalid("first", "the range must continue the previous page and hold the records of the page")
+		}
+
+		index.Pages = append(index.Pages, page)
+		index.Payments += page.Records
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, ImportErrors(errs)
+	}
+	return index, nil
+}
+
+//ReadHistory reads the pages of the history named {name} written by WriteHistory into {fs}
+//and returns their payments in the order they were written
+func ReadHistory(fs DumpFS, name string) ([]types.Payment, error) {
+	index, err := ReadHistoryIndex(fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	payments := make([]types.Payment, 0, index.Payments)
+	for _, page := range index.Pages {
+		payments, err = readHistoryPage(fs, page, payments)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payments, nil
+}
+
+//ReadHistoryPage reads the page of the history named {name} written by WriteHistory into {fs}, pages are numbered from 1
+func ReadHistoryPage(fs DumpFS, name string, number int) ([]types.Payment, error) {
+	index, err := ReadHistoryIndex(fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if number < 1 || number > len(index.Pages) {
+		return nil, fmt.Errorf("%w: page %d of %d", ErrHistoryPageNotFound, number, len(index.Pages))
+	}
+
+	page := index.Pages[number-1]
+	return readHistoryPage(fs, page, make([]types.Payment, 0, page.Records))
+}
+
+//readHistoryPage appends the payments of the page to {payments}, checking the page against the index
+func readHistoryPage(fs DumpFS, page HistoryPage, payments []types.Payment) ([]types.Payment, error) {
+	reader, err := fs.Open(page.File)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	expected := manifestEntry{file: page.File, records: page.Records, checksum: page.checksum}
+	errs, err := streamDump(reader, dumpPath(fs, page.File), paymentsTable, &expected, func(row dumpRow) error {
+		payment, err := paymentFromRow(row)
+		if err != nil {
+			return err
+		}
+		payments = append(payments, *payment)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, ImportErrors(errs)
+	}
+	return payments, nil
+}
+
+//HistoryFromFiles reads the history named {name} written by WriteHistory or HistoryToFiles into {dir}, see ReadHistory
+func (s *Service) HistoryFromFiles(dir string, name string) ([]types.Payment, error) {
+	return ReadHistory(s.dumpFS(dir), name)
+}
@@ -0,0 +1,104 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func TestService_WriteHistory(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	payments := make([]types.Payment, len(s.payments))
+	for i, payment := range s.payments {
+		payments[i] = *payment
+	}
+
+	tests := []struct {
+		pageSize int
+		pages    int
+	}{
+		{pageSize: 1, pages: 11},
+		{pageSize: 4, pages: 3},
+		{pageSize: 11, pages: 1},
+		{pageSize: 100, pages: 1},
+	}
+	for _, test := range tests {
+		fs := MemoryFS{}
+		index, err := s.WriteHistory(fs, payments, HistoryOptions{Name: "history", PageSize: test.pageSize})
+		if err != nil || len(index.Pages) != test.pages || len(fs) != test.pages+1 || fs["history1.dump"] == nil {
+			t.Errorf("WriteHistory(%d): index = %v, error = %v", test.pageSize, index, err)
+			continue
+		}
+
+		read, err := ReadHistoryIndex(fs, "history")
+		if err != nil || len(read.Pages) != test.pages || read.Payments != len(payments) {
+			t.Errorf("ReadHistoryIndex(%d): index = %v, error = %v", test.pageSize, read, err)
+			continue
+		}
+
+		history, err := ReadHistory(fs, "history")
+		if err != nil || len(history) != len(payments) {
+			t.Errorf("ReadHistory(%d): payments = %v, error = %v", test.pageSize, history, err)
+			continue
+		}
+		for i := range history {
+			if !samePayment(&history[i], &payments[i]) {
+				t.Errorf("ReadHistory(%d): wrong payment = %v, expected %v", test.pageSize, history[i], payments[i])
+			}
+		}
+
+		last := read.Pages[test.pages-1]
+		page, err := ReadHistoryPage(fs, "history", test.pages)
+		if err != nil || len(page) != last.Records || page[0].ID != payments[last.First].ID {
+			t.Errorf("ReadHistoryPage(%d): payments = %v, error = %v", test.pageSize, page, err)
+		}
+	}
+}
+
+func TestService_WriteHistory_invalid(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	payments, _ := s.ExportAccountHistory(1)
+
+	fs := MemoryFS{}
+	for _, pageSize := range []int{0, -1} {
+		_, err := s.WriteHistory(fs, payments, HistoryOptions{PageSize: pageSize})
+		if err != ErrInvalidPageSize || len(fs) != 0 {
+			t.Errorf("WriteHistory(%d): must return ErrInvalidPageSize, returned = %v", pageSize, err)
+		}
+	}
+
+	_, err := s.WriteHistory(fs, payments, HistoryOptions{Name: "../payments", PageSize: 2})
+	if !errors.Is(err, ErrInvalidHistoryName) {
+		t.Errorf("WriteHistory(): must return ErrInvalidHistoryName, returned = %v", err)
+	}
+
+	index, err := s.WriteHistory(fs, nil, HistoryOptions{PageSize: 2})
+	if err != nil || len(index.Pages) != 0 {
+		t.Errorf("WriteHistory(): index = %v, error = %v", index, err)
+		return
+	}
+	history, err := ReadHistory(fs, "")
+	if err != nil || len(history) != 0 {
+		t.Errorf("ReadHistory(): payments = %v, error = %v", history, err)
+	}
+
+	err = s.HistoryTo(fs, payments, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ReadHistoryPage(fs, "", 4)
+	if !errors.Is(err, ErrHistoryPageNotFound) {
+		t.Errorf("ReadHistoryPage(): must return ErrHistoryPageNotFound, returned = %v", err)
+	}
+
+	fs["payments2.dump"] = fs["payments1.dump"]
+	_, err = ReadHistory(fs, "")
+	if !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("ReadHistory(): must return ErrManifestMismatch, returned = %v", err)
+	}
+}
@@ -0,0 +1,864 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrImportConflict error for import with records that conflict with the wallet data
+var ErrImportConflict = errors.New("import conflict")
+
+//ImportMode selects how malformed records of the dumps are treated
+type ImportMode int
+
+//Import modes
+const (
+	//ImportStrict fails the import listing every malformed record
+	ImportStrict ImportMode = iota
+	//ImportLenient skips malformed records and lists them in the report
+	ImportLenient
+)
+
+//ImportOptions holds the settings of ImportWithOptions
+type ImportOptions struct {
+	Mode      ImportMode
+	DryRun    bool //only report what would be imported
+	Integrity IntegrityMode
+	Merge     MergeStrategy
+}
+
+//ImportCounts holds the number of records of a dump by the way they are imported
+type ImportCounts struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Kept      int //records of the dump that lost to the saved ones
+}
+
+//ImportConflict describes a record that can't be imported without breaking the wallet
+type ImportConflict struct {
+	Table  string
+	ID     string
+	Reason string
+}
+
+func (c ImportConflict) String() string {
+	return fmt.Sprintf("%s %s: %s", c.Table, c.ID, c.Reason)
+}
+
+//ImportReport describes the result of ImportWithOptions
+type ImportReport struct {
+	Skipped        []*DumpError
+	Accounts       ImportCounts
+	Payments       ImportCounts
+	Favorites      ImportCounts
+	Vouchers       ImportCounts
+	Rewards        ImportCounts
+	Removed        int //saved records removed by the deltas of ImportChain
+	Conflicts      []ImportConflict
+	Integrity      []IntegrityIssue
+	MergeConflicts []MergeConflict
+}
+
+//ImportErrors lists every malformed record found by a strict import
+type ImportErrors []*DumpError
+
+func (e ImportErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("%d malformed records:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+//Is makes ImportErrors match ErrInvalidDump
+func (e ImportErrors) Is(target error) bool {
+	return target == ErrInvalidDump
+}
+
+//ImportConflicts fails the import that has conflicting records
+type ImportConflicts []ImportConflict
+
+func (e ImportConflicts) Error() string {
+	lines := make([]string, len(e))
+	for i, conflict := range e {
+		lines[i] = conflict.String()
+	}
+	return fmt.Sprintf("%d conflicting records:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+//Is makes ImportConflicts match ErrImportConflict
+func (e ImportConflicts) Is(target error) bool {
+	return target == ErrImportConflict
+}
+
+//streamDump calls {parse} for every record of the table dump read from {reader} named {file}, one record at a time.
+//Records rejected by {parse} are returned together with the ones that couldn't be split into fields
+func streamDump(reader io.Reader, file string, table dumpTable, expected *manifestEntry, parse func(row dumpRow) error) ([]*DumpError, error) {
+	d, err := newDumpReader(reader, table, file)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]*DumpError, 0)
+	for {
+		row, rowErr, err := d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if rowErr != nil {
+			errs = append(errs, rowErr)
+			continue
+		}
+
+		err = parse(row)
+		if err != nil {
+			var dumpErr *DumpError
+			if !errors.As(err, &dumpErr) {
+				dumpErr = &DumpError{File: file, Line: row.line, Reason: err.Error()}
+			}
+			errs = append(errs, dumpErr)
+		}
+	}
+
+	if expected != nil {
+		err = expected.verify(d.entry())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+//check fails a strict import with the malformed records or adds them to the report of a lenient one
+func (o ImportOptions) check(report *ImportReport, errs []*DumpError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if o.Mode == ImportStrict {
+		return ImportErrors(errs)
+	}
+	report.Skipped = append(report.Skipped, errs...)
+	return nil
+}
+
+//recordError describes the invalid field of a staged record, the format it is read from adds the location
+type recordError struct {
+	field  string
+	reason string
+}
+
+//validateAccount checks the account staged for import from any format
+func validateAccount(account *types.Account) *recordError {
+	if account.ID <= 0 {
+		return &recordError{field: "id", reason: "must be positive"}
+	}
+	return nil
+}
+
+//validatePayment checks the payment staged for import from any format
+func validatePayment(payment *types.Payment) *recordError {
+	if payment.ID == "" {
+		return &recordError{field: "id", reason: "must not be empty"}
+	}
+
+	if payment.Amount <= 0 {
+		return &recordError{field: "amount", reason: "must be positive"}
+	}
+
+	status := payment.Status
+	if status != types.PaymentStatusOk && status != types.PaymentStatusFail && status != types.PaymentStatusInProgress {
+		return &recordError{field: "status", reason: fmt.Sprintf("unknown status %q", status)}
+	}
+	return nil
+}
+
+//validateFavorite checks the favorite staged for import from any format
+func validateFavorite(favorite *types.Favorite) *recordError {
+	if favorite.ID == "" {
+		return &recordError{field: "id", reason: "must not be empty"}
+	}
+
+	if favorite.Amount <= 0 {
+		return &recordError{field: "amount", reason: "must be positive"}
+	}
+	return nil
+}
+
+//validateVoucher checks the voucher staged for import from any format
+func validateVoucher(voucher *types.Voucher) *recordError {
+	if voucher.Code == "" {
+		return &recordError{field: "code", reason: "must not be empty"}
+	}
+
+	if voucher.Amount <= 0 {
+		return &recordError{field: "amount", reason: "must be positive"}
+	}
+
+	if voucher.MaxUses <= 0 {
+		return &recordError{field: "max_uses", reason: "must be positive"}
+	}
+	return nil
+}
+
+//validateReward checks the reward staged for import from any format
+func validateReward(reward *types.Reward) *recordError {
+	if reward.ID == "" {
+		return &recordError{field: "id", reason: "must not be empty"}
+	}
+
+	if reward.Amount <= 0 {
+		return &recordError{field: "amount", reason: "must be positive"}
+	}
+
+	status := reward.Status
+	if status != types.RewardStatusPending && status != types.RewardStatusCredited && status != types.RewardStatusClawedBack {
+		return &recordError{field: "status", reason: fmt.Sprintf("unknown status %q", status)}
+	}
+	return nil
+}
+
+//importBatch holds the records staged from the dumps, nothing is applied until every dump is read and checked
+type importBatch struct {
+	accounts  []*types.Account
+	payments  []*types.Payment
+	favorites []*types.Favorite
+	vouchers  []*types.Voucher
+	rewards   []*types.Reward
+	removed   []changeKey //records removed by a delta export
+}
+
+//stageAccounts reads the accounts dump named {file} from {r} into the batch
+func (b *importBatch) stageAccounts(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error) {
+	return streamDump(r, file, accountsTable, expected, func(row dumpRow) error {
+		account, err := accountFromRow(row)
+		if err != nil {
+			return err
+		}
+		b.accounts = append(b.accounts, account)
+		return nil
+	})
+}
+
+//stagePayments reads the payments dump named {file} from {r} into the batch
+func (b *importBatch) stagePayments(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error) {
+	return streamDump(r, file, paymentsTable, expected, func(row dumpRow) error {
+		payment, err := paymentFromRow(row)
+		if err != nil {
+			return err
+		}
+		b.payments = append(b.payments, payment)
+		return nil
+	})
+}
+
+//stageFavorites reads the favorites dump named {file} from {r} into the batch
+func (b *importBatch) stageFavorites(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error) {
+	return streamDump(r, file, favoritesTable, expected, func(row dumpRow) error {
+		favorite, err := favoriteFromRow(row)
+		if err != nil {
+			return err
+		}
+		b.favorites = append(b.favorites, favorite)
+		return nil
+	})
+}
+
+//stageVouchers reads the vouchers dump named {file} from {r} into the batch
+func (b *importBatch) stageVouchers(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error) {
+	return streamDump(r, file, vouchersTable, expected, func(row dumpRow) error {
+		voucher, err := voucherFromRow(row)
+		if err != nil {
+			return err
+		}
+		b.vouchers = append(b.vouchers, voucher)
+		return nil
+	})
+}
+
+//stageRewards reads the rewards dump named {file} from {r} into the batch
+func (b *importBatch) stageRewards(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error) {
+	return streamDump(r, file, rewardsTable, expected, func(row dumpRow) error {
+		reward, err := rewardFromRow(row)
+		if err != nil {
+			return err
+		}
+		b.rewards = append(b.rewards, reward)
+		return nil
+	})
+}
+
+//count adds the record with {key} to the counts, {equal} reports whether it matches the saved one
+func (c *ImportCounts) count(staged map[string]bool, key string, exists bool, equal bool) {
+	switch {
+	case staged[key] || (exists && !equal):
+		c.Updated++
+	case exists:
+		c.Unchanged++
+	default:
+		c.Added++
+	}
+	staged[key] = true
+}
+
+//recordIndex maps the key of every record to the position of the first record with the key in its table,
+//the one the service finds. An import builds it once, so no staged record is looked up by scanning the wallet
+type recordIndex map[changeKey]int
+
+//indexRecords indexes the records of the wallet
+func (s *Service) indexRecords() recordIndex {
+	index := make(recordIndex, len(s.accounts)+len(s.payments)+len(s.favorites)+len(s.vouchers)+len(s.rewards))
+	for i := len(s.accounts) - 1; i >= 0; i-- {
+		index[accountKey(s.accounts[i].ID)] = i
+	}
+	for i := len(s.payments) - 1; i >= 0; i-- {
+		index[paymentKey(s.payments[i].ID)] = i
+	}
+	for i := len(s.favorites) - 1; i >= 0; i-- {
+		index[favoriteKey(s.favorites[i].ID)] = i
+	}
+	for i := len(s.vouchers) - 1; i >= 0; i-- {
+		index[voucherKey(s.vouchers[i].Code)] = i
+	}
+	for i := len(s.rewards) - 1; i >= 0; i-- {
+		index[rewardKey(s.rewards[i].ID)] = i
+	}
+	return index
+}
+
+//account returns the account of the wallet with the ID
+func (x recordIndex) account(s *Service, id int64) (*types.Account, bool) {
+	i, ok := x[accountKey(id)]
+	if !ok {
+		return nil, false
+	}
+	return s.accounts[i], true
+}
+
+//payment returns the payment of the wallet with the ID
+func (x recordIndex) payment(s *Service, id string) (*types.Payment, bool) {
+	i, ok := x[paymentKey(id)]
+	if !ok {
+		return nil, false
+	}
+	return s.payments[i], true
+}
+
+//favorite returns the favorite of the wallet with the ID
+func (x recordIndex) favorite(s *Service, id string) (*types.Favorite, bool) {
+	i, ok := x[favoriteKey(id)]
+	if !ok {
+		return nil, false
+	}
+	return s.favorites[i], true
+}
+
+//voucher returns the voucher of the wallet with the code
+func (x recordIndex) voucher(s *Service, code string) (*types.Voucher, bool) {
+	i, ok := x[voucherKey(code)]
+	if !ok {
+		return nil, false
+	}
+	return s.vouchers[i], true
+}
+
+//reward returns the reward of the wallet with the ID
+func (x recordIndex) reward(s *Service, id string) (*types.Reward, bool) {
+	i, ok := x[rewardKey(id)]
+	if !ok {
+		return nil, false
+	}
+	return s.rewards[i], true
+}
+
+//planImport counts what applying the batch would change and finds the records that can't be applied
+func (s *Service) planImport(batch *importBatch, index recordIndex, report *ImportReport) {
+	staged := make(map[string]bool)
+	phones := make(map[types.Phone]int64)
+	for _, account := range s.accounts {
+		phones[account.Phone] = account.ID
+	}
+
+	for _, account := range batch.accounts {
+		saved, ok := index.account(s, account.ID)
+		if ok && phones[saved.Phone] == saved.ID {
+			delete(phones, saved.Phone) //the phone is free unless the dump gives it back
+		}
+		report.Accounts.count(staged, "account "+strconv.FormatInt(account.ID, 10), ok, ok && sameAccount(saved, account))
+	}
+
+	for _, account := range batch.accounts {
+		owner, ok := phones[account.Phone]
+		if ok && owner != account.ID {
+			report.Conflicts = append(report.Conflicts, ImportConflict{
+				Table:  accountsTable.name,
+				ID:     strconv.FormatInt(account.ID, 10),
+				Reason: fmt.Sprintf("phone %s belongs to account %d", account.Phone, owner),
+			})
+			continue
+		}
+		phones[account.Phone] = account.ID
+	}
+
+	for _, payment := range batch.payments {
+		saved, ok := index.payment(s, payment.ID)
+		report.Payments.count(staged, "payment "+payment.ID, ok, ok && samePayment(saved, payment))
+	}
+
+	for _, favorite := range batch.favorites {
+		saved, ok := index.favorite(s, favorite.ID)
+		report.Favorites.count(staged, "favorite "+favorite.ID, ok, ok && sameFavorite(saved, favorite))
+	}
+
+	for _, voucher := range batch.vouchers {
+		saved, ok := index.voucher(s, voucher.Code)
+		report.Vouchers.count(staged, "voucher "+voucher.Code, ok, ok && sameVoucher(saved, voucher))
+	}
+
+	for _, reward := range batch.rewards {
+		saved, ok := index.reward(s, reward.ID)
+		report.Rewards.count(staged, "reward "+reward.ID, ok, ok && sameReward(saved, reward))
+	}
+
+	removed := make(map[changeKey]bool, len(batch.removed))
+	for _, key := range batch.removed {
+		if _, ok := index[key]; ok && !removed[key] {
+			removed[key] = true
+			report.Removed++
+		}
+	}
+}
+
+//importPlacement tells where applying the batch puts every staged record: at the position of the record it
+//overwrites, or past the end of the table for a new one, in the order the new ones are appended. The records
+//of the keys the batch removes are dropped, except the one a staged record overwrites, which keeps its position
+type importPlacement struct {
+	accounts  []int
+	payments  []int
+	favorites []int
+	vouchers  []int
+	rewards   []int
+	removed   []changeKey             //keys of the removed records found in the wallet
+	dropped   map[string]map[int]bool //positions of the dropped records by table
+}
+
+//placeImport places the records of the batch in the wallet indexed by {index}
+func (s *Service) placeImport(batch *importBatch, index recordIndex) *importPlacement {
+	p := &importPlacement{
+		accounts:  make([]int, len(batch.accounts)),
+		payments:  make([]int, len(batch.payments)),
+		favorites: make([]int, len(batch.favorites)),
+		vouchers:  make([]int, len(batch.vouchers)),
+		rewards:   make([]int, len(batch.rewards)),
+		dropped:   make(map[string]map[int]bool),
+	}
+	placed := make(map[changeKey]int, len(batch.accounts)+len(batch.payments)+len(batch.favorites)+len(batch.vouchers)+len(batch.rewards))
+	size := len(s.accounts)
+	for i, account := range batch.accounts {
+		p.accounts[i] = place(placed, index, accountKey(account.ID), &size)
+	}
+	size = len(s.payments)
+	for i, payment := range batch.payments {
+		p.payments[i] = place(placed, index, paymentKey(payment.ID), &size)
+	}
+	size = len(s.favorites)
+	for i, favorite := range batch.favorites {
+		p.favorites[i] = place(placed, index, favoriteKey(favorite.ID), &size)
+	}
+	size = len(s.vouchers)
+	for i, voucher := range batch.vouchers {
+		p.vouchers[i] = place(placed, index, voucherKey(voucher.Code), &size)
+	}
+	size = len(s.rewards)
+	for i, reward := range batch.rewards {
+		p.rewards[i] = place(placed, index, rewardKey(reward.ID), &size)
+	}
+
+	if len(batch.removed) == 0 {
+		return p
+	}
+
+	removed := make(map[changeKey]bool, len(batch.removed))
+	for _, key := range batch.removed {
+		if _, ok := index[key]; ok && !removed[key] {
+			removed[key] = true
+			p.removed = append(p.removed, key)
+		}
+	}
+	for i, account := range s.accounts {
+		p.drop(removed, placed, accountKey(account.ID), i)
+	}
+	for i, payment := range s.payments {
+		p.drop(removed, placed, paymentKey(payment.ID), i)
+	}
+	for i, favorite := range s.favorites {
+		p.drop(removed, placed, favoriteKey(favorite.ID), i)
+	}
+	for i, voucher := range s.vouchers {
+		p.drop(removed, placed, voucherKey(voucher.Code), i)
+	}
+	for i, reward := range s.rewards {
+		p.drop(removed, placed, rewardKey(reward.ID), i)
+	}
+	return p
+}
+
+//place returns the position of the staged record with the key, {size} counts the records of its table with
+//the new ones appended. A record staged again goes where the earlier one went
+func place(placed map[changeKey]int, index recordIndex, key changeKey, size *int) int {
+	i, ok := placed[key]
+	if !ok {
+		i, ok = index[key]
+	}
+	if !ok {
+		i = *size
+		*size++
+	}
+	placed[key] = i
+	return i
+}
+
+//drop drops the record at the position of its table if the batch removes its key and doesn't overwrite it
+func (p *importPlacement) drop(removed map[changeKey]bool, placed map[changeKey]int, key changeKey, i int) {
+	if j, ok := placed[key]; !removed[key] || (ok && j == i) {
+		return
+	}
+
+	if p.dropped[key.table] == nil {
+		p.dropped[key.table] = make(map[int]bool)
+	}
+	p.dropped[key.table][i] = true
+}
+
+//kept reports whether the record at the position of the table is kept
+func (p *importPlacement) kept(table string, i int) bool {
+	return !p.dropped[table][i]
+}
+
+//applyImport removes the records removed by the batch and merges the staged records into the service where
+//the placement puts them, it can't fail so the batch is applied entirely. The balance log doesn't explain
+//the imported balances, see Statement
+func (s *Service) applyImport(batch *importBatch, p *importPlacement) {
+	if len(batch.accounts) != 0 {
+		s.balanceLogSince = s.stamp()
+	}
+	for _, key := range p.removed {
+		s.trackRemoval(key)
+	}
+
+	for i, account := range batch.accounts {
+		s.importAccount(account, p.accounts[i])
+	}
+	for i, payment := range batch.payments {
+		s.importPayment(payment, p.payments[i])
+	}
+
+	positions := make(map[int64]int) //number of favorites of the accounts, for the favorites without position
+	if len(batch.favorites) != 0 {
+		for i, favorite := range s.favorites {
+			if p.kept(favoritesTable.name, i) {
+				positions[favorite.AccountID]++
+			}
+		}
+	}
+	for i, favorite := range batch.favorites {
+		s.importFavorite(favorite, p.favorites[i], positions)
+	}
+	for i, voucher := range batch.vouchers {
+		s.importVoucher(voucher, p.vouchers[i])
+	}
+	for i, reward := range batch.rewards {
+		s.importReward(reward, p.rewards[i])
+	}
+
+	if len(p.dropped) == 0 {
+		return
+	}
+
+	accounts := s.accounts[:0]
+	for i, account := range s.accounts {
+		if p.kept(accountsTable.name, i) {
+			accounts = append(accounts, account)
+		}
+	}
+	s.accounts = accounts
+
+	payments := s.payments[:0]
+	for i, payment := range s.payments {
+		if p.kept(paymentsTable.name, i) {
+			payments = append(payments, payment)
+		}
+	}
+	s.payments = payments
+
+	favorites := s.favorites[:0]
+	for i, favorite := range s.favorites {
+		if p.kept(favoritesTable.name, i) {
+			favorites = append(favorites, favorite)
+		}
+	}
+	s.favorites = favorites
+
+	vouchers := s.vouchers[:0]
+	for i, voucher := range s.vouchers {
+		if p.kept(vouchersTable.name, i) {
+			vouchers = append(vouchers, voucher)
+		}
+	}
+	s.vouchers = vouchers
+
+	rewards := s.rewards[:0]
+	for i, reward := range s.rewards {
+		if p.kept(rewardsTable.name, i) {
+			rewards = append(rewards, reward)
+		}
+	}
+	s.rewards = rewards
+}
+
+//previewImport returns the wallet as applyImport would leave it, for the integrity checker to read before
+//the batch is applied. The records are shared with the service and the batch rather than copied, so the preview
+//only costs a pointer per record. Favorites without position aren't given one, the checker doesn't look at the order
+func (s *Service) previewImport(batch *importBatch, p *importPlacement) *Service {
+	preview := &Service{
+		nextAccountID:    s.nextAccountID,
+		revenueAccountID: s.revenueAccountID,
+		balanceLog:       s.balanceLog,
+		balanceLogSince:  s.balanceLogSince,
+	}
+	if len(batch.accounts) != 0 { //as applyImport does
+		preview.balanceLogSince = s.stamp()
+	}
+
+	accounts := append([]*types.Account(nil), s.accounts...)
+	for i, account := range batch.accounts {
+		if j := p.accounts[i]; j < len(accounts) {
+			accounts[j] = account
+		} else {
+			accounts = append(accounts, account)
+		}
+	}
+	for i, account := range accounts {
+		if p.kept(accountsTable.name, i) {
+			preview.accounts = append(preview.accounts, account)
+		}
+	}
+
+	payments := append([]*types.Payment(nil), s.payments...)
+	for i, payment := range batch.payments {
+		if j := p.payments[i]; j < len(payments) {
+			payments[j] = payment
+		} else {
+			payments = append(payments, payment)
+		}
+	}
+	for i, payment := range payments {
+		if p.kept(paymentsTable.name, i) {
+			preview.payments = append(preview.payments, payment)
+		}
+	}
+
+	favorites := append([]*types.Favorite(nil), s.favorites...)
+	for i, favorite := range batch.favorites {
+		if j := p.favorites[i]; j < len(favorites) {
+			favorites[j] = favorite
+		} else {
+			favorites = append(favorites, favorite)
+		}
+	}
+	for i, favorite := range favorites {
+		if p.kept(favoritesTable.name, i) {
+			preview.favorites = append(preview.favorites, favorite)
+		}
+	}
+
+	vouchers := append([]*types.Voucher(nil), s.vouchers...)
+	for i, voucher := range batch.vouchers {
+		if j := p.vouchers[i]; j < len(vouchers) {
+			vouchers[j] = voucher
+		} else {
+			vouchers = append(vouchers, voucher)
+		}
+	}
+	for i, voucher := range vouchers {
+		if p.kept(vouchersTable.name, i) {
+			preview.vouchers = append(preview.vouchers, voucher)
+		}
+	}
+
+	rewards := append([]*types.Reward(nil), s.rewards...)
+	for i, reward := range batch.rewards {
+		if j := p.rewards[i]; j < len(rewards) {
+			rewards[j] = reward
+		} else {
+			rewards = append(rewards, reward)
+		}
+	}
+	for i, reward := range rewards {
+		if p.kept(rewardsTable.name, i) {
+			preview.rewards = append(preview.rewards, reward)
+		}
+	}
+	return preview
+}
+
+//commitImport merges the checked batch by the strategy and applies it unless it's a dry run or has conflicts.
+//The integrity of the result is checked on a preview of the wallet, so a failing import leaves the wallet as it was.
+//The dumps are streamed, but the staged records are held besides the wallet until they are applied: the new ones
+//become records of the wallet, while the ones overwriting saved records take memory for both until the import ends
+func (s *Service) commitImport(batch *importBatch, options ImportOptions, report *ImportReport) (*ImportReport, error) {
+	index := s.indexRecords()
+	s.mergeImport(batch, index, options.Merge, report)
+	s.planImport(batch, index, report)
+	duplicates := batch.duplicates()
+	placement := s.placeImport(batch, index)
+	preview := s.previewImport(batch, placement)
+	report.Integrity = append(duplicates, preview.CheckIntegrity()...)
+	if options.DryRun {
+		return report, nil
+	}
+
+	if len(report.Conflicts) != 0 {
+		return nil, ImportConflicts(report.Conflicts)
+	}
+
+	if options.Integrity == IntegrityFail && len(report.Integrity) != 0 {
+		return nil, IntegrityIssues(report.Integrity)
+	}
+
+	s.applyImport(batch, placement)
+	if options.Integrity == IntegrityRepair {
+		report.Integrity = append(duplicates, s.RepairIntegrity()...)
+	}
+	return report, nil
+}
+
+//ImportFromFile reads the accounts from a file written by ExportToFile of any version
+func (s *Service) ImportFromFile(path string) error {
+	_, err := s.ImportFromFileWithOptions(path, ImportOptions{})
+	return err
+}
+
+//ImportFromFileWithOptions reads the accounts from a file written by ExportToFile of any version
+func (s *Service) ImportFromFileWithOptions(path string, options ImportOptions) (*ImportReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := s.openFile(file, path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+	batch := &importBatch{}
+	errs, err := batch.stageAccounts(reader, path, nil)
+	if err == nil {
+		err = options.check(report, errs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(batch, options, report)
+}
+
+//Import method imports the data from specified directory, dumps of every version are migrated to the current one.
+//Either all the dumps are imported or, on any error, nothing is changed
+func (s *Service) Import(dir string) error {
+	_, err := s.ImportWithOptions(dir, ImportOptions{})
+	return err
+}
+
+//ImportWithOptions imports the data from specified directory, malformed records are treated according to {options.Mode}.
+//All dumps are read and checked against the manifest, if there is one, before the first record is applied
+func (s *Service) ImportWithOptions(dir string, options ImportOptions) (*ImportReport, error) {
+	_, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	return s.ImportFrom(s.dumpFS(dir), options)
+}
+
+//importAccount adds the account placed past the wallet or overwrites the one at the position {i}
+func (s *Service) importAccount(account *types.Account, i int) {
+	if i >= len(s.accounts) {
+		s.accounts = append(s.accounts, account)
+	} else {
+		saved := s.accounts[i]
+		saved.Phone = account.Phone
+		saved.Balance = account.Balance
+		saved.UpdatedAt = account.UpdatedAt
+	}
+	s.track(accountKey(account.ID))
+
+	if account.ID > s.nextAccountID {
+		s.nextAccountID = account.ID
+	}
+}
+
+//importPayment adds the payment placed past the wallet or overwrites the one at the position {i}
+func (s *Service) importPayment(payment *types.Payment, i int) {
+	s.track(paymentKey(payment.ID))
+	if i >= len(s.payments) {
+		s.payments = append(s.payments, payment)
+		return
+	}
+	*s.payments[i] = *payment
+}
+
+//importFavorite adds the favorite placed past the wallet or overwrites the one at the position {i},
+//favorites without position keep the order they are imported in. {positions} holds the number of
+//favorites of every account
+func (s *Service) importFavorite(favorite *types.Favorite, i int, positions map[int64]int) {
+	s.track(favoriteKey(favorite.ID))
+	if i >= len(s.favorites) {
+		if favorite.Position < 0 {
+			favorite.Position = positions[favorite.AccountID]
+		}
+		positions[favorite.AccountID]++
+		s.favorites = append(s.favorites, favorite)
+		return
+	}
+
+	saved := s.favorites[i]
+	if favorite.Position < 0 {
+		favorite.Position = saved.Position
+	}
+	positions[saved.AccountID]--
+	positions[favorite.AccountID]++
+	*saved = *favorite
+}
+
+//importVoucher adds the voucher placed past the wallet or overwrites the one at the position {i}
+func (s *Service) importVoucher(voucher *types.Voucher, i int) {
+	s.track(voucherKey(voucher.Code))
+	if i >= len(s.vouchers) {
+		s.vouchers = append(s.vouchers, voucher)
+		return
+	}
+	*s.vouchers[i] = *voucher
+}
+
+//importReward adds the reward placed past the wallet or overwrites the one at the position {i}
+func (s *Service) importReward(reward *types.Reward, i int) {
+	s.track(rewardKey(reward.ID))
+	if i >= len(s.rewards) {
+		s.rewards = append(s.rewards, reward)
+		return
+	}
+	*s.rewards[i] = *reward
+}
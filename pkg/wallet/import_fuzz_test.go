@@ -0,0 +1,36 @@
+//go:build go1.18
+// +build go1.18
+
+package wallet
+
+import "testing"
+
+func FuzzDecodeDump(f *testing.F) {
+	for _, content := range malformedDumps {
+		f.Add([]byte(content))
+	}
+	f.Add([]byte("1;+992000000001;100|2;+992000000002;200|"))
+	f.Add([]byte("#wallet-dump v3 vouchers\ncode;amount;expires_at;max_uses;redeemed_by\nCODE;100;0;1;1,2\n"))
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		for _, table := range []dumpTable{accountsTable, paymentsTable, favoritesTable, vouchersTable} {
+			rows, _, err := decodeDump(table, table.file(), content)
+			if err != nil {
+				continue
+			}
+
+			for _, row := range rows {
+				switch table.name {
+				case accountsTable.name:
+					_, _ = accountFromRow(row)
+				case paymentsTable.name:
+					_, _ = paymentFromRow(row)
+				case favoritesTable.name:
+					_, _ = favoriteFromRow(row)
+				case vouchersTable.name:
+					_, _ = voucherFromRow(row)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+var malformedDumps = map[string]string{
+	"accounts.dump":  "1;+992000000001;100\n2;+992000000002;two hundred\n3;+992000000003\n",
+	"payments.dump":  "#wallet-dump v3 payments\nid;account_id;amount;category;status;linked_id\np1;1;10;mobile;INPROGRESS;\np2;1;-5;mobile;INPROGRESS;\np3;1;5;mobile;DONE;\\x\n",
+	"favorites.dump": "f1;1;first;10;mobile;0\n",
+}
+
+func TestService_ImportWithOptions_strict(t *testing.T) {
+	dir := writeDumps(t, malformedDumps)
+
+	s := newTestService()
+	_, err := s.ImportWithOptions(dir, ImportOptions{Mode: ImportStrict})
+	if !errors.Is(err, ErrInvalidDump) {
+		t.Errorf("ImportWithOptions(): must return ErrInvalidDump, returned = %v", err)
+		return
+	}
+
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != 4 {
+		t.Errorf("ImportWithOptions(): must list every malformed record, returned = %v", err)
+		return
+	}
+
+	expected := DumpError{File: filepath.Join(dir, "accounts.dump"), Line: 2, Field: "balance", Reason: `"two hundred" is not an integer`}
+	if filepath.Clean(errs[0].File) != expected.File || errs[0].Line != expected.Line || errs[0].Field != expected.Field || errs[0].Reason != expected.Reason {
+		t.Errorf("ImportWithOptions(): expected: %v, got: %v", &expected, errs[0])
+	}
+
+	if errs[1].Line != 3 || errs[1].Field != "" {
+		t.Errorf("ImportWithOptions(): wrong error for short record = %v", errs[1])
+	}
+}
+
+func TestService_Import_atomic(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := writeDumps(t, map[string]string{
+		"accounts.dump": "1;+992000000001;500\n2;+992000000002;200\n",
+		"payments.dump": "p1;1;10;mobile;INPROGRESS\np2;1;broken;mobile;INPROGRESS\n",
+	})
+
+	err = s.Import(dir)
+	if !errors.Is(err, ErrInvalidDump) {
+		t.Errorf("Import(): must return ErrInvalidDump, returned = %v", err)
+		return
+	}
+
+	if account.Balance != 100 || len(s.accounts) != 1 || len(s.payments) != 0 {
+		t.Errorf("Import(): failed import changed the wallet, account = %v, accounts = %v, payments = %v",
+			account, len(s.accounts), len(s.payments))
+	}
+}
+
+func TestService_ImportWithOptions_dryRun(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.addAccountWithBalance("+992000000002", 200)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := writeDumps(t, map[string]string{
+		"accounts.dump": "1;+992000000001;500\n2;+992000000002;200\n3;+992000000003;300\n4;+992000000001;400\n",
+		"payments.dump": "p1;1;10;mobile;INPROGRESS\n",
+	})
+
+	report, err := s.ImportWithOptions(dir, ImportOptions{DryRun: true})
+	if err != nil {
+		t.Errorf("ImportWithOptions(): error = %v", err)
+		return
+	}
+
+	expected := ImportCounts{Added: 2, Updated: 1, Unchanged: 1}
+	if report.Accounts != expected || report.Payments.Added != 1 {
+		t.Errorf("ImportWithOptions(): wrong counts, accounts = %v, payments = %v", report.Accounts, report.Payments)
+	}
+
+	if len(report.Conflicts) != 1 || report.Conflicts[0].ID != "4" {
+		t.Errorf("ImportWithOptions(): wrong conflicts = %v", report.Conflicts)
+	}
+
+	if account.Balance != 100 || len(s.accounts) != 2 || len(s.payments) != 0 {
+		t.Errorf("ImportWithOptions(): dry run changed the wallet, account = %v, accounts = %v, payments = %v",
+			account, len(s.accounts), len(s.payments))
+	}
+
+	err = s.Import(dir)
+	if !errors.Is(err, ErrImportConflict) {
+		t.Errorf("Import(): must return ErrImportConflict, returned = %v", err)
+	}
+
+	if account.Balance != 100 || len(s.accounts) != 2 {
+		t.Errorf("Import(): conflicting import changed the wallet, account = %v, accounts = %v", account, len(s.accounts))
+	}
+}
+
+func TestService_commitImport_placement(t *testing.T) {
+	s := newTestService()
+	s.accounts = append(s.accounts, &types.Account{ID: 1, Phone: "+992000000001", Balance: 100})
+	for _, id := range []string{"a", "b", "a", "c"} {
+		s.payments = append(s.payments, &types.Payment{ID: id, AccountID: 1, Amount: 1, Category: types.CategoryMobile})
+	}
+	saved := s.payments[0]
+
+	batch := &importBatch{
+		payments: []*types.Payment{
+			{ID: "a", AccountID: 1, Amount: 2, Category: types.CategoryMobile},
+			{ID: "d", AccountID: 1, Amount: 3, Category: types.CategoryMobile},
+			{ID: "d", AccountID: 1, Amount: 4, Category: types.CategoryMobile},
+		},
+		removed: []changeKey{paymentKey("a"), paymentKey("c"), paymentKey("c"), paymentKey("x")},
+	}
+	report, err := s.commitImport(batch, ImportOptions{}, &ImportReport{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := []string{"a:2", "b:1", "d:4"}
+	got := make([]string, len(s.payments))
+	for i, payment := range s.payments {
+		got[i] = fmt.Sprintf("%s:%d", payment.ID, payment.Amount)
+	}
+	if !reflect.DeepEqual(got, expected) || s.payments[0] != saved {
+		t.Errorf("commitImport(): payments = %v, expected %v", got, expected)
+	}
+
+	if report.Removed != 2 || report.Payments != (ImportCounts{Added: 1, Updated: 2}) {
+		t.Errorf("commitImport(): removed = %v, payments = %v", report.Removed, report.Payments)
+	}
+}
+
+func TestService_ImportWithOptions_lenient(t *testing.T) {
+	dir := writeDumps(t, malformedDumps)
+
+	s := newTestService()
+	report, err := s.ImportWithOptions(dir, ImportOptions{Mode: ImportLenient})
+	if err != nil {
+		t.Errorf("ImportWithOptions(): error = %v", err)
+		return
+	}
+
+	if len(report.Skipped) != 4 {
+		t.Errorf("ImportWithOptions(): must skip 4 records, skipped = %v", report.Skipped)
+		return
+	}
+
+	fields := []string{"balance", "", "amount", ""}
+	lines := []int{2, 3, 4, 5}
+	for i, skipped := range report.Skipped {
+		if skipped.Field != fields[i] || skipped.Line != lines[i] {
+			t.Errorf("ImportWithOptions(): wrong skipped record = %v", skipped)
+		}
+	}
+
+	if len(s.accounts) != 1 || len(s.payments) != 1 || len(s.favorites) != 1 {
+		t.Errorf("ImportWithOptions(): valid records weren't imported, accounts = %v, payments = %v, favorites = %v",
+			len(s.accounts), len(s.payments), len(s.favorites))
+	}
+}
+
+func TestService_ImportFromFileWithOptions_lenient(t *testing.T) {
+	dir := writeDumps(t, map[string]string{"export.txt": "1;+992000000001;100|x;+992000000002;200|"})
+
+	s := newTestService()
+	report, err := s.ImportFromFileWithOptions(filepath.Join(dir, "export.txt"), ImportOptions{Mode: ImportLenient})
+	if err != nil {
+		t.Errorf("ImportFromFileWithOptions(): error = %v", err)
+		return
+	}
+
+	if len(report.Skipped) != 1 || report.Skipped[0].Line != 2 || report.Skipped[0].Field != "id" || len(s.accounts) != 1 {
+		t.Errorf("ImportFromFileWithOptions(): wrong result, skipped = %v, accounts = %v", report.Skipped, len(s.accounts))
+	}
+}
+
+func TestService_ImportWithOptions_hostileInput(t *testing.T) {
+	inputs := []string{
+		"",
+		"\n",
+		";;;;;;;;;;",
+		"#wallet-dump",
+		"#wallet-dump v3 accounts",
+		"#wallet-dump v3 accounts\n",
+		"#wallet-dump v3 accounts\n\\",
+		"#wallet-dump v3 accounts\nid;phone;balance\n\\",
+		"#wallet-dump v-1 accounts\nid;phone;balance\n",
+		"#wallet-dump v99999999999999999999 accounts\n",
+		"|||",
+		"1;2;3;4;5;6;7;8;9\n",
+		"9999999999999999999999;+992;1\n",
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		buffer := make([]byte, random.Intn(64))
+		random.Read(buffer)
+		inputs = append(inputs, string(buffer))
+	}
+
+	for _, input := range inputs {
+		files := make(map[string]string)
+		for _, table := range []dumpTable{accountsTable, paymentsTable, favoritesTable, vouchersTable} {
+			files[table.file()] = input
+		}
+		dir := writeDumps(t, files)
+
+		for _, mode := range []ImportMode{ImportStrict, ImportLenient} {
+			_, _ = newTestService().ImportWithOptions(dir, ImportOptions{Mode: mode})
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrIntegrity error for wallet data that breaks the relations between accounts, payments and favorites
+var ErrIntegrity = errors.New("integrity violated")
+
+//IntegrityIssueKind is the kind of problem found by the integrity checker
+type IntegrityIssueKind string
+
+//Kinds of integrity issues
+const (
+	IssueDuplicateID     IntegrityIssueKind = "DUPLICATE_ID"
+	IssueOrphanPayment   IntegrityIssueKind = "ORPHAN_PAYMENT"
+	IssueOrphanFavorite  IntegrityIssueKind = "ORPHAN_FAVORITE"
+	IssueOrphanReward    IntegrityIssueKind = "ORPHAN_REWARD"
+	IssueDuplicatePhone  IntegrityIssueKind = "DUPLICATE_PHONE"
+	IssueBalanceMismatch IntegrityIssueKind = "BALANCE_MISMATCH"
+	IssueNegativeBalance IntegrityIssueKind = "NEGATIVE_BALANCE"
+)
+
+//IntegrityMode selects what Import does with the integrity issues of the data it would produce
+type IntegrityMode int
+
+//Integrity modes
+const (
+	//IntegrityReport imports the data and lists the issues in the report
+	IntegrityReport IntegrityMode = iota
+	//IntegrityFail fails the import that would leave any issue
+	IntegrityFail
+	//IntegrityRepair imports the data and repairs the issues that can be repaired
+	IntegrityRepair
+)
+
+//IntegrityIssue describes a record that breaks the integrity of the wallet
+type IntegrityIssue struct {
+	Kind     IntegrityIssueKind
+	Table    string
+	ID       string
+	Reason   string
+	Repaired bool
+}
+
+func (i IntegrityIssue) String() string {
+	text := fmt.Sprintf("%s %s %s: %s", i.Kind, i.Table, i.ID, i.Reason)
+	if i.Repaired {
+		text += " (repaired)"
+	}
+	return text
+}
+
+//IntegrityIssues fails the import that would break the integrity of the wallet
+type IntegrityIssues []IntegrityIssue
+
+func (e IntegrityIssues) Error() string {
+	lines := make([]string, len(e))
+	for i, issue := range e {
+		lines[i] = issue.String()
+	}
+	return fmt.Sprintf("%d integrity issues:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+//Is makes IntegrityIssues match ErrIntegrity
+func (e IntegrityIssues) Is(target error) bool {
+	return target == ErrIntegrity
+}
+
+//CheckIntegrity lists the integrity issues of the wallet without changing it
+func (s *Service) CheckIntegrity() []IntegrityIssue {
+	return s.integrity(false)
+}
+
+//RepairIntegrity lists the integrity issues of the wallet and repairs the ones that can be repaired
+//without guessing: records repeating an ID and records of inexistent accounts are removed, fees of
+//rejected payments are refunded. Duplicate phones and balances that don't match the history are only reported
+func (s *Service) RepairIntegrity() []IntegrityIssue {
+	return s.integrity(true)
+}
+
+//CheckDumpIntegrity lists the integrity issues of the data in the dumps of the directory
+func CheckDumpIntegrity(dir string) ([]IntegrityIssue, error) {
+	report, err := (&Service{}).ImportWithOptions(dir, ImportOptions{DryRun: true})
+	if err != nil {
+		return nil, err
+	}
+	return report.Integrity, nil
+}
+
+//integrity runs the checks, the order matters as repairs of the earlier checks change what the later ones see
+func (s *Service) integrity(repair bool) []IntegrityIssue {
+	issues := make([]IntegrityIssue, 0)
+	issues = append(issues, s.checkDuplicateIDs(repair)...)
+	issues = append(issues, s.checkOrphans(repair)...)
+	issues = append(issues, s.checkPhones()...)
+	issues = append(issues, s.checkBalances(repair)...)
+	return issues
+}
+
+//duplicateKeys returns which of the {keys} are seen for the first time, and an issue for every other one
+func duplicateKeys(table string, keys []string, reason string, repair bool) ([]bool, []IntegrityIssue) {
+	first := make([]bool, len(keys))
+	seen := make(map[string]bool, len(keys))
+	issues := make([]IntegrityIssue, 0)
+	for i, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			first[i] = true
+			continue
+		}
+
+		issues = append(issues, IntegrityIssue{
+			Kind:     IssueDuplicateID,
+			Table:    table,
+			ID:       key,
+			Reason:   reason,
+			Repaired: repair,
+		})
+	}
+	return first, issues
+}
+
+//checkDuplicateIDs finds records repeating the ID of an earlier one, the earlier record is the one the service finds
+func (s *Service) checkDuplicateIDs(repair bool) []IntegrityIssue {
+	const reason = "the ID is used by an earlier record"
+	keys := make([]string, len(s.accounts))
+	for i, account := range s.accounts {
+		keys[i] = strconv.FormatInt(account.ID, 10)
+	}
+	keepAccounts, issues := duplicateKeys(accountsTable.name, keys, reason, repair)
+
+	keys = make([]string, len(s.payments))
+	for i, payment := range s.payments {
+		keys[i] = payment.ID
+	}
+	keepPayments, found := duplicateKeys(paymentsTable.name, keys, reason, repair)
+	issues = append(issues, found...)
+
+	keys = make([]string, len(s.favorites))
+	for i, favorite := range s.favorites {
+		keys[i] = favorite.ID
+	}
+	keepFavorites, found := duplicateKeys(favoritesTable.name, keys, reason, repair)
+	issues = append(issues, found...)
+
+	keys = make([]string, len(s.vouchers))
+	for i, voucher := range s.vouchers {
+		keys[i] = voucher.Code
+	}
+	keepVouchers, found := duplicateKeys(vouchersTable.name, keys, reason, repair)
+	issues = append(issues, found...)
+
+	keys = make([]string, len(s.rewards))
+	for i, reward := range s.rewards {
+		keys[i] = reward.ID
+	}
+	keepRewards, found := duplicateKeys(rewardsTable.name, keys, reason, repair)
+	issues = append(issues, found...)
+
+	if !repair || len(issues) == 0 {
+		return issues
+	}
+
+	for _, issue := range issues { //the kept record replaces the removed ones in the next delta
+		s.track(changeKey{table: issue.Table, id: issue.ID})
+	}
+
+	accounts := s.accounts[:0]
+	for i, account := range s.accounts {
+		if keepAccounts[i] {
+			accounts = append(accounts, account)
+		}
+	}
+	s.accounts = accounts
+
+	payments := s.payments[:0]
+	for i, payment := range s.payments {
+		if keepPayments[i] {
+			payments = append(payments, payment)
+		}
+	}
+	s.payments = payments
+
+	favorites := s.favorites[:0]
+	for i, favorite := range s.favorites {
+		if keepFavorites[i] {
+			favorites = append(favorites, favorite)
+		}
+	}
+	s.favorites = favorites
+
+	vouchers := s.vouchers[:0]
+	for i, voucher := range s.vouchers {
+		if keepVouchers[i] {
+			vouchers = append(vouchers, voucher)
+		}
+	}
+	s.vouchers = vouchers
+
+	rewards := s.rewards[:0]
+	for i, reward := range s.rewards {
+		if keepRewards[i] {
+			rewards = append(rewards, reward)
+		}
+	}
+	s.rewards = rewards
+	return issues
+}
+
+//checkOrphans finds payments, favorites and rewards of inexistent accounts, and fees, reward transactions
+//and rewards of inexistent payments
+func (s *Service) checkOrphans(repair bool) []IntegrityIssue {
+	accounts := make(map[int64]bool, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts[account.ID] = true
+	}
+	payments := make(map[string]bool, len(s.payments))
+	for _, payment := range s.payments {
+		payments[payment.ID] = true
+	}
+
+	issues := make([]IntegrityIssue, 0)
+	kept := make([]*types.Payment, 0, len(s.payments))
+	for _, payment := range s.payments {
+		if !accounts[payment.AccountID] {
+			issues = append(issues, IntegrityIssue{
+				Kind:     IssueOrphanPayment,
+				Table:    paymentsTable.name,
+				ID:       payment.ID,
+				Reason:   fmt.Sprintf("account %d not found", payment.AccountID),
+				Repaired: repair,
+			})
+			if repair {
+				s.trackRemoval(paymentKey(payment.ID))
+				continue
+			}
+		} else if payment.LinkedID != "" && !payments[payment.LinkedID] {
+			issues = append(issues, IntegrityIssue{ //the fee was charged, removing it would hide the money
+				Kind:   IssueOrphanPayment,
+				Table:  paymentsTable.name,
+				ID:     payment.ID,
+				Reason: fmt.Sprintf("linked payment %s not found", payment.LinkedID),
+			})
+		}
+		kept = append(kept, payment)
+	}
+
+	favorites := make([]*types.Favorite, 0, len(s.favorites))
+	for _, favorite := range s.favorites {
+		if !accounts[favorite.AccountID] {
+			issues = append(issues, IntegrityIssue{
+				Kind:     IssueOrphanFavorite,
+				Table:    favoritesTable.name,
+				ID:       favorite.ID,
+				Reason:   fmt.Sprintf("account %d not found", favorite.AccountID),
+				Repaired: repair,
+			})
+			if repair {
+				s.trackRemoval(favoriteKey(favorite.ID))
+				continue
+			}
+		}
+		favorites = append(favorites, favorite)
+	}
+
+	rewards := make([]*types.Reward, 0, len(s.rewards))
+	for _, reward := range s.rewards {
+		if !accounts[reward.AccountID] {
+			issues = append(issues, IntegrityIssue{
+				Kind:     IssueOrphanReward,
+				Table:    rewardsTable.name,
+				ID:       reward.ID,
+				Reason:   fmt.Sprintf("account %d not found", reward.AccountID),
+				Repaired: repair,
+			})
+			if repair {
+				s.trackRemoval(rewardKey(reward.ID))
+				continue
+			}
+		} else if !payments[reward.PaymentID] {
+			issues = append(issues, IntegrityIssue{ //the reward may be credited already, like the fees
+				Kind:   IssueOrphanReward,
+				Table:  rewardsTable.name,
+				ID:     reward.ID,
+				Reason: fmt.Sprintf("payment %s not found", reward.PaymentID),
+			})
+		}
+		rewards = append(rewards, reward)
+	}
+
+	if repair {
+		s.payments = kept
+		s.favorites = favorites
+		s.rewards = rewards
+	}
+	return issues
+}
+
+//checkPhones finds accounts registered with the phone of an earlier account
+func (s *Service) checkPhones() []IntegrityIssue {
+	owners := make(map[types.Phone]int64, len(s.accounts))
+	issues := make([]IntegrityIssue, 0)
+	for _, account := range s.accounts {
+		owner, ok := owners[account.Phone]
+		if !ok {
+			owners[account.Phone] = account.ID
+			continue
+		}
+
+		issues = append(issues, IntegrityIssue{
+			Kind:   IssueDuplicatePhone,
+			Table:  accountsTable.name,
+			ID:     strconv.FormatInt(account.ID, 10),
+			Reason: fmt.Sprintf("phone %s belongs to account %d", account.Phone, owner),
+		})
+	}
+	return issues
+}
+
+//checkBalances compares the balances with the history and finds fees of rejected payments that weren't refunded.
+//While the balance log holds every change since the service started, a balance must be the sum of the logged
+//deposits, vouchers and fees and the reward transactions minus the payments made, see Statement. Once balances are imported the
+//changes made before are unknown, so only the revenue account is compared: it can't hold less than the fees it
+//received minus the payments it made. Negative balances are reported too
+func (s *Service) checkBalances(repair bool) []IntegrityIssue {
+	issues := make([]IntegrityIssue, 0)
+	payments := make(map[string]*types.Payment, len(s.payments)) //the first payment with the ID, the one the service finds
+	for i := len(s.payments) - 1; i >= 0; i-- {
+		payments[s.payments[i].ID] = s.payments[i]
+	}
+	for _, fee := range s.payments {
+		if fee.LinkedID == "" || fee.Category != types.CategoryFee || fee.Status == types.PaymentStatusFail {
+			continue
+		}
+
+		payment, ok := payments[fee.LinkedID]
+		if !ok || payment.Status != types.PaymentStatusFail {
+			continue
+		}
+
+		issue := IntegrityIssue{
+			Kind:   IssueBalanceMismatch,
+			Table:  paymentsTable.name,
+			ID:     fee.ID,
+			Reason: fmt.Sprintf("fee of rejected payment %s wasn't refunded", payment.ID),
+		}
+
+		account, aerr := s.FindAccountByID(fee.AccountID)
+		revenue, rerr := s.revenueAccount()
+		if repair && aerr == nil && rerr == nil && revenue.Balance >= fee.Amount { //like refundFees
+			revenue.Balance -= fee.Amount
+			account.Balance += fee.Amount
+			fee.Status = types.PaymentStatusFail
+			revenue.UpdatedAt = s.stamp()
+			account.UpdatedAt = revenue.UpdatedAt
+			fee.UpdatedAt = revenue.UpdatedAt
+			s.track(accountKey(revenue.ID))
+			s.track(accountKey(account.ID))
+			s.track(paymentKey(fee.ID))
+			issue.Repaired = true
+		}
+		issues = append(issues, issue)
+	}
+
+	complete := s.balanceLogSince.IsZero()
+	refunded := make(map[string]bool)
+	flows := make(map[int64]types.Money, len(s.accounts)) //logged changes and rewards, or fees received, minus payments made
+	for _, payment := range s.payments {
+		if payment.Status == types.PaymentStatusFail {
+			refunded[payment.ID] = true
+			continue
+		}
+
+		flows[payment.AccountID] += balanceChange(payment)
+		if !complete && payment.Category == types.CategoryFee && payment.LinkedID != "" && s.revenueAccountID != 0 {
+			flows[s.revenueAccountID] += payment.Amount
+		}
+	}
+	if complete {
+		for _, entry := range s.balanceLog {
+			if entry.kind != StatementFee || !refunded[entry.paymentID] {
+				flows[entry.accountID] += entry.amount
+			}
+		}
+	}
+
+	compared := make(map[int64]bool, len(s.accounts))
+	for _, account := range s.accounts {
+		id := strconv.FormatInt(account.ID, 10)
+		first := !compared[account.ID] //the history is the one of the account the service finds
+		compared[account.ID] = true
+		if complete && first && account.Balance != flows[account.ID] {
+			issues = append(issues, IntegrityIssue{
+				Kind:   IssueBalanceMismatch,
+				Table:  accountsTable.name,
+				ID:     id,
+				Reason: fmt.Sprintf("balance %d doesn't match the history %d", account.Balance, flows[account.ID]),
+			})
+		} else if !complete && first && account.ID == s.revenueAccountID && account.Balance < flows[account.ID] {
+			issues = append(issues, IntegrityIssue{
+				Kind:   IssueBalanceMismatch,
+				Table:  accountsTable.name,
+				ID:     id,
+				Reason: fmt.Sprintf("balance %d is less than fees received minus payments made %d", account.Balance, flows[account.ID]),
+			})
+		}
+
+		if account.Balance < 0 {
+			issues = append(issues, IntegrityIssue{
+				Kind:   IssueNegativeBalance,
+				Table:  accountsTable.name,
+				ID:     id,
+				Reason: fmt.Sprintf("balance is %d", account.Balance),
+			})
+		}
+	}
+	return issues
+}
+
+//duplicates finds records of the dumps repeating the ID of an earlier one, the last of them is imported
+func (b *importBatch) duplicates() []IntegrityIssue {
+	const reason = "the ID is repeated in the dump, the last record is imported"
+	keys := make([]string, len(b.accounts))
+	for i, account := range b.accounts {
+		keys[i] = strconv.FormatInt(account.ID, 10)
+	}
+	_, issues := duplicateKeys(accountsTable.name, keys, reason, false)
+
+	keys = make([]string, len(b.payments))
+	for i, payment := range b.payments {
+		keys[i] = payment.ID
+	}
+	_, found := duplicateKeys(paymentsTable.name, keys, reason, false)
+	issues = append(issues, found...)
+
+	keys = make([]string, len(b.favorites))
+	for i, favorite := range b.favorites {
+		keys[i] = favorite.ID
+	}
+	_, found = duplicateKeys(favoritesTable.name, keys, reason, false)
+	issues = append(issues, found...)
+
+	keys = make([]string, len(b.vouchers))
+	for i, voucher := range b.vouchers {
+		keys[i] = voucher.Code
+	}
+	_, found = duplicateKeys(vouchersTable.name, keys, reason, false)
+	issues = append(issues, found...)
+
+	keys = make([]string, len(b.rewards))
+	for i, reward := range b.rewards {
+		keys[i] = reward.ID
+	}
+	_, found = duplicateKeys(rewardsTable.name, keys, reason, false)
+	return append(issues, found...)
+}
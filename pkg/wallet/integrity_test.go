@@ -0,0 +1,198 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func issueKinds(issues []IntegrityIssue) map[IntegrityIssueKind]int {
+	kinds := make(map[IntegrityIssueKind]int)
+	for _, issue := range issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
+
+func brokenService(t *testing.T) *testService {
+	s := newTestService()
+	fillData(s)
+	revenue, err := s.addRevenueAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := s.Pay(1, 100, types.CategoryFood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reject(rejected.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.payments = append(s.payments, &types.Payment{ID: "fee", AccountID: 1, Amount: 5, Category: types.CategoryFee,
+		Status: types.PaymentStatusInProgress, LinkedID: rejected.ID}) //fee left unrefunded
+	s.accounts[0].Balance -= 5
+	revenue.Balance += 5
+	s.logBalance(balanceEntry{kind: StatementFee, accountID: revenue.ID, amount: 5, paymentID: "fee"})
+
+	s.accounts = append(s.accounts,
+		&types.Account{ID: 2, Phone: "+992000000009", Balance: 1},
+		&types.Account{ID: 10, Phone: "+992000000001", Balance: -5},
+	)
+	s.payments = append(s.payments, &types.Payment{ID: "orphan", AccountID: 99, Amount: 1, Category: "food", Status: types.PaymentStatusOk})
+	s.favorites = append(s.favorites, &types.Favorite{ID: "orphan", AccountID: 99, Name: "lost", Amount: 1, Category: "food"})
+	return s
+}
+
+func TestService_CheckIntegrity(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	issues := s.CheckIntegrity()
+	if len(issues) != 0 {
+		t.Errorf("CheckIntegrity(): consistent wallet has issues = %v", issues)
+		return
+	}
+
+	s = brokenService(t)
+	accounts, payments := len(s.accounts), len(s.payments)
+	issues = s.CheckIntegrity()
+	expected := map[IntegrityIssueKind]int{
+		IssueDuplicateID:     1,
+		IssueOrphanPayment:   1,
+		IssueOrphanFavorite:  1,
+		IssueDuplicatePhone:  1,
+		IssueBalanceMismatch: 2,
+		IssueNegativeBalance: 1,
+	}
+	kinds := issueKinds(issues)
+	for kind, count := range expected {
+		if kinds[kind] != count {
+			t.Errorf("CheckIntegrity(): %v issues = %v, expected %v, issues = %v", kind, kinds[kind], count, issues)
+		}
+	}
+
+	if len(s.accounts) != accounts || len(s.payments) != payments {
+		t.Error("CheckIntegrity(): changed the wallet")
+	}
+}
+
+func TestService_RepairIntegrity(t *testing.T) {
+	s := brokenService(t)
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	balance := account.Balance
+
+	issues := s.RepairIntegrity()
+	for _, issue := range issues {
+		mismatch := issue.Kind == IssueBalanceMismatch && issue.Table == accountsTable.name
+		repairable := issue.Kind != IssueDuplicatePhone && issue.Kind != IssueNegativeBalance && !mismatch
+		if issue.Repaired != repairable {
+			t.Errorf("RepairIntegrity(): wrong repair of %v", issue)
+		}
+	}
+
+	if account.Balance != balance+5 {
+		t.Errorf("RepairIntegrity(): fee wasn't refunded, balance = %v, expected = %v", account.Balance, balance+5)
+	}
+
+	remaining := issueKinds(s.CheckIntegrity())
+	if len(remaining) != 3 || remaining[IssueDuplicatePhone] != 1 || remaining[IssueNegativeBalance] != 1 || remaining[IssueBalanceMismatch] != 1 {
+		t.Errorf("RepairIntegrity(): remaining issues = %v", remaining)
+	}
+
+	_, err = s.FindPaymentByID("orphan")
+	if err != ErrPaymentNotFound {
+		t.Errorf("RepairIntegrity(): orphan payment wasn't removed, error = %v", err)
+	}
+}
+
+func TestService_CheckIntegrity_balances(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	account, err := s.FindAccountByID(3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account.Balance++
+	issues := s.CheckIntegrity()
+	if len(issues) != 1 || issues[0].Kind != IssueBalanceMismatch || issues[0].ID != "3" {
+		t.Errorf("CheckIntegrity(): balance that doesn't match the history isn't reported, issues = %v", issues)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	issues = imported.CheckIntegrity()
+	if len(issues) != 0 {
+		t.Errorf("CheckIntegrity(): imported balances can't be compared with the history, issues = %v", issues)
+	}
+}
+
+func TestService_RepairIntegrity_orphanRewards(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	s.rewards = append(s.rewards,
+		&types.Reward{ID: "lost", AccountID: 42, PaymentID: s.payments[0].ID, Amount: 1, Status: types.RewardStatusPending},
+		&types.Reward{ID: "unpaid", AccountID: 1, PaymentID: "missing", Amount: 1, Status: types.RewardStatusCredited},
+	)
+
+	issues := s.RepairIntegrity()
+	kinds := issueKinds(issues)
+	if kinds[IssueOrphanReward] != 2 || !issues[0].Repaired || issues[1].Repaired {
+		t.Errorf("RepairIntegrity(): wrong issues = %v", issues)
+	}
+	if len(s.rewards) != 1 || s.rewards[0].ID != "unpaid" {
+		t.Errorf("RepairIntegrity(): only the reward of the inexistent account must be removed, rewards = %v", s.rewards)
+	}
+}
+
+func TestService_ImportWithOptions_integrity(t *testing.T) {
+	files := map[string]string{
+		"accounts.dump":  "1;+992000000001;100\n2;+992000000002;-20\n",
+		"payments.dump":  "p1;1;10;mobile;OK\np2;7;10;mobile;OK\np1;1;15;mobile;OK\n",
+		"favorites.dump": "f1;7;lost;10;mobile\n",
+	}
+
+	issues, err := CheckDumpIntegrity(writeDumps(t, files))
+	kinds := issueKinds(issues)
+	if err != nil || kinds[IssueDuplicateID] != 1 || kinds[IssueOrphanPayment] != 1 || kinds[IssueOrphanFavorite] != 1 || kinds[IssueNegativeBalance] != 1 {
+		t.Errorf("CheckDumpIntegrity(): issues = %v, error = %v", issues, err)
+		return
+	}
+
+	s := newTestService()
+	_, err = s.ImportWithOptions(writeDumps(t, files), ImportOptions{Integrity: IntegrityFail})
+	if !errors.Is(err, ErrIntegrity) || len(s.accounts) != 0 {
+		t.Errorf("ImportWithOptions(): must fail with ErrIntegrity, accounts = %v, error = %v", len(s.accounts), err)
+		return
+	}
+
+	report, err := s.ImportWithOptions(writeDumps(t, files), ImportOptions{Integrity: IntegrityRepair})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(report.Integrity) != 4 || len(s.payments) != 1 || len(s.favorites) != 0 || s.payments[0].Amount != 15 {
+		t.Errorf("ImportWithOptions(): wrong repair, issues = %v, payments = %v", report.Integrity, len(s.payments))
+	}
+}
@@ -0,0 +1,322 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//jsonFile and jsonLinesFile name the JSON documents in the errors of ImportJSON and ImportPaymentsJSONLines
+const (
+	jsonFile      = "wallet.json"
+	jsonLinesFile = "payments.jsonl"
+)
+
+//ExportJSON streams the accounts, payments and favorites into {w} as a single JSON document with
+//the "accounts", "payments" and "favorites" arrays, fields of the records are named by the tags of the types
+func (s *Service) ExportJSON(w io.Writer) error {
+	writer := bufio.NewWriterSize(w, dumpBufferSize)
+	arrays := []struct {
+		name  string
+		count int
+		value func(i int) interface{}
+	}{
+		{name: accountsTable.name, count: len(s.accounts), value: func(i int) interface{} { return s.accounts[i] }},
+		{name: paymentsTable.name, count: len(s.payments), value: func(i int) interface{} { return s.payments[i] }},
+		{name: favoritesTable.name, count: len(s.favorites), value: func(i int) interface{} { return s.favorites[i] }},
+	}
+
+	_, err := writer.WriteString("{")
+	for i, array := range arrays {
+		if i > 0 {
+			_, err = writer.WriteString(",")
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(writer, "\n  %q: [", array.name)
+		}
+
+		for j := 0; err == nil && j < array.count; j++ {
+			if j > 0 {
+				_, err = writer.WriteString(",")
+			}
+			if err == nil {
+				err = writeJSON(writer, array.value(j), "\n    ")
+			}
+		}
+
+		if err == nil && array.count > 0 {
+			_, err = writer.WriteString("\n  ")
+		}
+		if err == nil {
+			_, err = writer.WriteString("]")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = writer.WriteString("\n}\n")
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+//ExportPaymentsJSONLines streams the payments into {w} as JSON Lines, one payment object per line
+func (s *Service) ExportPaymentsJSONLines(w io.Writer) error {
+	writer := bufio.NewWriterSize(w, dumpBufferSize)
+	for _, payment := range s.payments {
+		err := writeJSON(writer, payment, "")
+		if err == nil {
+			err = writer.WriteByte('\n')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+//writeJSON writes the value after the {prefix}
+func writeJSON(w *bufio.Writer, value interface{}, prefix string) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.WriteString(prefix)
+	if err == nil {
+		_, err = w.Write(content)
+	}
+	return err
+}
+
+//ImportJSON imports the document written by ExportJSON like ImportWithOptions: records are checked
+//the same way as the ones of dumps, malformed ones are treated by {options.Mode} and reported as DumpError
+//with the number of the record in its array, and the records are merged by {options.Merge}
+func (s *Service) ImportJSON(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{}
+	batch := &importBatch{}
+	decoder := json.NewDecoder(r)
+
+	err := expectJSONDelim(decoder, '{')
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]*DumpError, 0)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, jsonSyntaxError(err)
+		}
+
+		var stage func(raw json.RawMessage) *recordError
+		switch token {
+		case accountsTable.name:
+			stage = batch.stageJSONAccount
+		case paymentsTable.name:
+			stage = batch.stageJSONPayment
+		case favoritesTable.name:
+			stage = batch.stageJSONFavorite
+		default:
+			var skipped json.RawMessage
+			err = decoder.Decode(&skipped)
+			if err != nil {
+				return nil, jsonSyntaxError(err)
+			}
+			continue
+		}
+
+		arrayErrs, err := decodeJSONArray(decoder, jsonFile+":"+token.(string), stage)
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, arrayErrs...)
+	}
+
+	err = expectJSONDelim(decoder, '}')
+	if err != nil {
+		return nil, err
+	}
+
+	err = options.check(report, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(batch, options, report)
+}
+
+//ImportPaymentsJSONLines imports the payments written by ExportPaymentsJSONLines like ImportJSON,
+//a line that isn't valid JSON is a malformed record, empty lines are skipped
+func (s *Service) ImportPaymentsJSONLines(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{}
+	batch := &importBatch{}
+	reader := bufio.NewReaderSize(r, dumpBufferSize)
+
+	errs := make([]*DumpError, 0)
+	for line := 1; ; line++ {
+		content, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		content = bytes.TrimSpace(content)
+		if len(content) != 0 {
+			invalid := batch.stageJSONPayment(content)
+			if invalid != nil {
+				errs = append(errs, &DumpError{File: jsonLinesFile, Line: line, Field: invalid.field, Reason: invalid.reason})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	err := options.check(report, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(batch, options, report)
+}
+
+//expectJSONDelim reads the delimiter of the document
+func expectJSONDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return jsonSyntaxError(err)
+	}
+
+	if token != delim {
+		return &DumpError{File: jsonFile, Reason: fmt.Sprintf("%v expected, got %v", delim, token)}
+	}
+	return nil
+}
+
+//decodeJSONArray stages the elements of the array named {file} one at a time, a null array has no elements.
+//Elements that can't be staged are returned as errors, while broken JSON fails the whole document
+func decodeJSONArray(decoder *json.Decoder, file string, stage func(raw json.RawMessage) *recordError) ([]*DumpError, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, jsonSyntaxError(err)
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if token != json.Delim('[') {
+		return nil, &DumpError{File: file, Reason: fmt.Sprintf("array expected, got %v", token)}
+	}
+
+	errs := make([]*DumpError, 0)
+	for i := 1; decoder.More(); i++ {
+		var raw json.RawMessage
+		err = decoder.Decode(&raw)
+		if err != nil {
+			return nil, jsonSyntaxError(err)
+		}
+
+		invalid := stage(raw)
+		if invalid != nil {
+			errs = append(errs, &DumpError{File: file, Line: i, Field: invalid.field, Reason: invalid.reason})
+		}
+	}
+
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, jsonSyntaxError(err)
+	}
+	return errs, nil
+}
+
+//jsonSyntaxError describes the broken JSON document as a malformed dump
+func jsonSyntaxError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &DumpError{File: jsonFile, Reason: "unexpected end of JSON"}
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return &DumpError{File: jsonFile, Reason: fmt.Sprintf("offset %d: %v", syntaxErr.Offset, syntaxErr)}
+	}
+	return err
+}
+
+//unmarshalRecord decodes the JSON object of a record, naming the field of a mismatched type
+func unmarshalRecord(raw json.RawMessage, record interface{}) *recordError {
+	err := json.Unmarshal(raw, record)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &recordError{field: typeErr.Field, reason: fmt.Sprintf("%s expected", typeErr.Type)}
+	}
+	return &recordError{reason: err.Error()}
+}
+
+//stageJSONAccount adds the account of the JSON object to the batch
+func (b *importBatch) stageJSONAccount(raw json.RawMessage) *recordError {
+	account := &types.Account{}
+	invalid := unmarshalRecord(raw, account)
+	if invalid == nil {
+		invalid = validateAccount(account)
+	}
+	if invalid != nil {
+		return invalid
+	}
+
+	b.accounts = append(b.accounts, account)
+	return nil
+}
+
+//stageJSONPayment adds the payment of the JSON object to the batch
+func (b *importBatch) stageJSONPayment(raw json.RawMessage) *recordError {
+	payment := &types.Payment{}
+	invalid := unmarshalRecord(raw, payment)
+	if invalid == nil {
+		invalid = validatePayment(payment)
+	}
+	if invalid != nil {
+		return invalid
+	}
+
+	b.payments = append(b.payments, payment)
+	return nil
+}
+
+//stageJSONFavorite adds the favorite of the JSON object to the batch,
+//like in dumps the position is -1 for objects without it
+func (b *importBatch) stageJSONFavorite(raw json.RawMessage) *recordError {
+	var record struct {
+		types.Favorite
+		Position *int `json:"position"`
+	}
+	invalid := unmarshalRecord(raw, &record)
+	if invalid == nil {
+		invalid = validateFavorite(&record.Favorite)
+	}
+	if invalid != nil {
+		return invalid
+	}
+
+	favorite := record.Favorite
+	favorite.Position = -1
+	if record.Position != nil {
+		if *record.Position < 0 {
+			return &recordError{field: "position", reason: "must not be negative"}
+		}
+		favorite.Position = *record.Position
+	}
+
+	b.favorites = append(b.favorites, &favorite)
+	return nil
+}
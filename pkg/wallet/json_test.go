@@ -0,0 +1,107 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportJSON(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	_, err := s.FavoritePayment(s.payments[0].ID, "lunch; daily")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = s.ExportJSON(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var document map[string][]map[string]interface{}
+	err = json.Unmarshal(buffer.Bytes(), &document)
+	if err != nil || len(document["accounts"]) != len(s.accounts) || document["payments"][0]["account_id"] != float64(1) {
+		t.Errorf("ExportJSON(): wrong document = %s, error = %v", buffer.String(), err)
+		return
+	}
+
+	imported := newTestService()
+	report, err := imported.ImportJSON(&buffer, ImportOptions{})
+	if err != nil || report.Accounts.Added != len(s.accounts) || report.Payments.Added != len(s.payments) || report.Favorites.Added != 1 {
+		t.Errorf("ImportJSON(): report = %v, error = %v", report, err)
+		return
+	}
+
+	for i, payment := range imported.payments {
+		if !samePayment(payment, s.payments[i]) || !payment.UpdatedAt.Equal(s.payments[i].UpdatedAt) {
+			t.Errorf("ImportJSON(): wrong payment = %v, expected %v", payment, s.payments[i])
+		}
+	}
+	if !sameFavorite(imported.favorites[0], s.favorites[0]) {
+		t.Errorf("ImportJSON(): wrong favorite = %v, expected %v", imported.favorites[0], s.favorites[0])
+	}
+}
+
+func TestService_ImportJSON_invalid(t *testing.T) {
+	document := `{
+  "accounts": [{"id": 1, "phone": "+992000000001", "balance": 100}, {"id": 0}],
+  "payments": [{"id": "p1", "account_id": 1, "amount": "ten", "status": "OK"}],
+  "favorites": [{"id": "f1", "account_id": 1, "amount": 10}],
+  "comment": "ignored"
+}`
+
+	_, err := newTestService().ImportJSON(strings.NewReader(document), ImportOptions{})
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != 2 || errs[0].Error() != "wallet.json:accounts:2: id: must be positive" || errs[1].Field != "amount" {
+		t.Errorf("ImportJSON(): must return ImportErrors, returned = %v", err)
+	}
+
+	s := newTestService()
+	report, err := s.ImportJSON(strings.NewReader(document), ImportOptions{Mode: ImportLenient})
+	if err != nil || len(report.Skipped) != 2 || len(s.accounts) != 1 || s.favorites[0].Position != 0 {
+		t.Errorf("ImportJSON(): report = %v, error = %v", report, err)
+	}
+
+	for _, broken := range []string{`{"accounts": [{"id": 1}`, `{"accounts": {"id": 1}}`, `[]`} {
+		_, err = newTestService().ImportJSON(strings.NewReader(broken), ImportOptions{Mode: ImportLenient})
+		if !errors.Is(err, ErrInvalidDump) {
+			t.Errorf("ImportJSON(%s): must return ErrInvalidDump, returned = %v", broken, err)
+		}
+	}
+}
+
+func TestService_ExportPaymentsJSONLines(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	var buffer bytes.Buffer
+	err := s.ExportPaymentsJSONLines(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != len(s.payments) {
+		t.Errorf("ExportPaymentsJSONLines(): wrong lines = %v", len(lines))
+		return
+	}
+
+	imported := newTestService()
+	imported.accounts = s.accounts
+	report, err := imported.ImportPaymentsJSONLines(&buffer, ImportOptions{})
+	if err != nil || report.Payments.Added != len(s.payments) {
+		t.Errorf("ImportPaymentsJSONLines(): report = %v, error = %v", report, err)
+	}
+
+	report, err = imported.ImportPaymentsJSONLines(strings.NewReader(lines[0]+"\n\n{broken\n"), ImportOptions{Mode: ImportLenient})
+	if err != nil || report.Payments.Unchanged != 1 || len(report.Skipped) != 1 || report.Skipped[0].Line != 3 {
+		t.Errorf("ImportPaymentsJSONLines(): report = %v, error = %v", report, err)
+	}
+}
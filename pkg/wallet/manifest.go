@@ -0,0 +1,149 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//ErrManifestMismatch error for dump whose checksum or number of records differs from the manifest
+var ErrManifestMismatch = errors.New("dump doesn't match manifest")
+
+//dumpFileMode is the permission of written dumps, they hold phones and balances so only the owner can read them
+const dumpFileMode = 0600
+
+//dumpDirMode is the permission of directories created for dumps
+const dumpDirMode = 0700
+
+//manifestFile is written by Export after all the dumps
+const manifestFile = "manifest.dump"
+
+var manifestTable = dumpTable{
+	name:     "manifest",
+	columns:  []string{"file", "records", "sha256"},
+	required: 3,
+}
+
+//manifestEntry describes a dump written by Export
+type manifestEntry struct {
+	file     string
+	records  int
+	checksum string
+}
+
+//verify checks that the dump that was read is the one described by the entry
+func (e manifestEntry) verify(read manifestEntry) error {
+	if read.checksum != e.checksum {
+		return fmt.Errorf("%w: %s: checksum differs", ErrManifestMismatch, e.file)
+	}
+
+	if read.records != e.records {
+		return fmt.Errorf("%w: %s: %d records, expected %d", ErrManifestMismatch, e.file, read.records, e.records)
+	}
+	return nil
+}
+
+//writeFileAtomic replaces the file with {content} so that after a crash it holds either the old or the new content
+func writeFileAtomic(path string, content []byte) error {
+	return createFileAtomic(path, writeBytes(content))
+}
+
+//createFileAtomic replaces the file with the content streamed by {write}, see writeFileAtomic
+func createFileAtomic(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), dumpFileMode)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+//syncDir flushes the directory entries, so renames inside it survive a crash
+func syncDir(dir string) error {
+	folder, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer folder.Close()
+
+	err = folder.Sync()
+	if err != nil && !errors.Is(err, os.ErrInvalid) { //some platforms can't sync directories
+		return err
+	}
+	return nil
+}
+
+//makeDumpDir creates the directory for dumps if it doesn't exist
+func makeDumpDir(dir string) error {
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dir, dumpDirMode)
+	}
+	return err
+}
+
+//writeManifest writes the manifest of the dumps in {fs}
+func writeManifest(fs DumpFS, entries []manifestEntry) error {
+	records := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, []string{entry.file, strconv.Itoa(entry.records), entry.checksum})
+	}
+	return fs.WriteFile(manifestFile, writeBytes(encodeDump(manifestTable, records)))
+}
+
+//readManifest returns the manifest entries by file name, or nil if {fs} has no manifest
+func readManifest(fs DumpFS) (map[string]manifestEntry, error) {
+	reader, err := fs.Open(manifestFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	entries := make(map[string]manifestEntry)
+	errs, err := streamDump(reader, dumpPath(fs, manifestFile), manifestTable, nil, func(row dumpRow) error {
+		records, err := row.int("records")
+		if err != nil {
+			return err
+		}
+		entries[row.text("file")] = manifestEntry{file: row.text("file"), records: int(records), checksum: row.text("sha256")}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, ImportErrors(errs)
+	}
+	return entries, nil
+}
@@ -0,0 +1,134 @@
+package wallet
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func exportFilled(t *testing.T) (*testService, string) {
+	s := newTestService()
+	fillData(s)
+
+	dir := filepath.Join(t.TempDir(), "dump")
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestService_Export_manifest(t *testing.T) {
+	exported, dir := exportFilled(t)
+
+	manifest, err := readManifest(DirFS(dir))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(manifest) != len(dumpTables) || manifest[paymentsTable.file()].records != len(exported.payments) || manifest[vouchersTable.file()].records != 0 {
+		t.Errorf("Export(): wrong manifest = %v", manifest)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			t.Errorf("Export(): temporary file left = %v", file.Name())
+		}
+
+		if file.Mode().Perm() != dumpFileMode {
+			t.Errorf("Export(): %v has permissions %v", file.Name(), file.Mode().Perm())
+		}
+	}
+}
+
+func TestService_Import_manifestMismatch(t *testing.T) {
+	tests := []func(dir string) error{
+		func(dir string) error { //truncated by a crash
+			file := filepath.Join(dir, paymentsTable.file())
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(file, content[:len(content)/2], dumpFileMode)
+		},
+		func(dir string) error { //edited by hand
+			file := filepath.Join(dir, accountsTable.file())
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(file, []byte(strings.Replace(string(content), "+992000000001", "+992000000009", 1)), dumpFileMode)
+		},
+		func(dir string) error {
+			return os.Remove(filepath.Join(dir, favoritesTable.file()))
+		},
+	}
+
+	for i, tamper := range tests {
+		_, dir := exportFilled(t)
+		err := tamper(dir)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		s := newTestService()
+		err = s.Import(dir)
+		if err == nil || (!errors.Is(err, ErrManifestMismatch) && !os.IsNotExist(err)) {
+			t.Errorf("Import(): test %v must fail verification, returned = %v", i, err)
+		}
+
+		if len(s.accounts) != 0 {
+			t.Errorf("Import(): test %v imported accounts from a damaged dump", i)
+		}
+	}
+}
+
+func TestService_Import_manifestIgnoresStaleDumps(t *testing.T) {
+	exported, dir := exportFilled(t)
+	err := ioutil.WriteFile(filepath.Join(dir, "vouchers.dump"), []byte("broken"), dumpFileMode)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	manifest, err := readManifest(DirFS(dir))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	entries := make([]manifestEntry, 0)
+	for file, entry := range manifest {
+		if file != vouchersTable.file() {
+			entries = append(entries, entry)
+		}
+	}
+
+	err = writeManifest(DirFS(dir), entries)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): dump missing in manifest wasn't ignored, error = %v", err)
+		return
+	}
+
+	if len(s.accounts) != len(exported.accounts) || len(s.payments) != len(exported.payments) {
+		t.Errorf("Import(): accounts = %v, payments = %v", len(s.accounts), len(s.payments))
+	}
+}
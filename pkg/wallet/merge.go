@@ -0,0 +1,247 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//MergeStrategy selects which record is kept when the dump and the wallet have different records with the same ID
+type MergeStrategy int
+
+//Merge strategies
+const (
+	//MergeOverwrite replaces the saved records with the ones of the dump
+	MergeOverwrite MergeStrategy = iota
+	//MergeKeepExisting keeps the saved records and imports only the new ones
+	MergeKeepExisting
+	//MergeFailOnConflict fails the import if any record of the dump differs from the saved one
+	MergeFailOnConflict
+	//MergeLastWriterWins keeps the record with the later UpdatedAt. Ties are broken by comparing the records,
+	//so merging two wallets in either order gives the same result. Vouchers have no UpdatedAt,
+	//the one redeemed more times wins as redemptions are never undone. Neither have rewards,
+	//the one further along wins: pending, then credited, then clawed back
+	MergeLastWriterWins
+)
+
+//MergeConflict describes a record of the dump that differs from the saved record with the same ID
+type MergeConflict struct {
+	Table      string
+	ID         string
+	SavedAt    time.Time
+	ImportedAt time.Time
+	Imported   bool //the record of the dump replaced the saved one
+}
+
+func (c MergeConflict) String() string {
+	kept := "saved"
+	if c.Imported {
+		kept = "imported"
+	}
+	return fmt.Sprintf("%s %s: kept %s record, saved at %s, imported at %s", c.Table, c.ID, kept,
+		c.SavedAt.Format(time.RFC3339Nano), c.ImportedAt.Format(time.RFC3339Nano))
+}
+
+//sameAccount reports whether the accounts differ only in UpdatedAt
+func sameAccount(saved *types.Account, imported *types.Account) bool {
+	return saved.ID == imported.ID && saved.Phone == imported.Phone && saved.Balance == imported.Balance
+}
+
+//samePayment reports whether the payments differ only in UpdatedAt
+func samePayment(saved *types.Payment, imported *types.Payment) bool {
+	a, b := *saved, *imported
+	a.UpdatedAt, b.UpdatedAt = time.Time{}, time.Time{}
+	a.CreatedAt, b.CreatedAt = time.Time{}, time.Time{}
+	return a == b && saved.CreatedAt.Equal(imported.CreatedAt)
+}
+
+//sameFavorite reports whether the favorites differ only in UpdatedAt, favorites without position keep the saved one
+func sameFavorite(saved *types.Favorite, imported *types.Favorite) bool {
+	return saved.AccountID == imported.AccountID && saved.Name == imported.Name &&
+		saved.Amount == imported.Amount && saved.Category == imported.Category &&
+		(imported.Position < 0 || saved.Position == imported.Position)
+}
+
+//sameVoucher reports whether the vouchers are the same, the expiry is compared as an instant
+//and a voucher redeemed by nobody may have a nil or an empty list
+func sameVoucher(saved *types.Voucher, imported *types.Voucher) bool {
+	if saved.Code != imported.Code || saved.Amount != imported.Amount || saved.MaxUses != imported.MaxUses ||
+		!saved.ExpiresAt.Equal(imported.ExpiresAt) || len(saved.RedeemedBy) != len(imported.RedeemedBy) {
+		return false
+	}
+	for i, accountID := range saved.RedeemedBy {
+		if imported.RedeemedBy[i] != accountID {
+			return false
+		}
+	}
+	return true
+}
+
+//sameReward reports whether the rewards are the same, the times are compared as instants
+func sameReward(saved *types.Reward, imported *types.Reward) bool {
+	a, b := *saved, *imported
+	a.CreatedAt, b.CreatedAt = time.Time{}, time.Time{}
+	a.AvailableAt, b.AvailableAt = time.Time{}, time.Time{}
+	return a == b && saved.CreatedAt.Equal(imported.CreatedAt) && saved.AvailableAt.Equal(imported.AvailableAt)
+}
+
+//rewardStages orders the statuses of a reward, a reward never goes back to an earlier one
+var rewardStages = map[types.RewardStatus]int{
+	types.RewardStatusPending:    0,
+	types.RewardStatusCredited:   1,
+	types.RewardStatusClawedBack: 2,
+}
+
+//newer reports whether the imported record wins over the saved one by last-writer-wins,
+//records updated at the same time are compared as written to the dump by {saved} and {imported}
+func newer(savedAt time.Time, importedAt time.Time, saved func(d *dumpWriter) error, imported func(d *dumpWriter) error) bool {
+	if !importedAt.Equal(savedAt) {
+		return importedAt.After(savedAt)
+	}
+	return bytes.Compare(dumpLine(imported), dumpLine(saved)) > 0
+}
+
+//dumpLine returns the record written by {write}
+func dumpLine(write func(d *dumpWriter) error) []byte {
+	var buffer bytes.Buffer
+	d := newRecordWriter(&buffer)
+	_ = write(d) //writing into bytes.Buffer doesn't fail
+	_ = d.flush()
+	return buffer.Bytes()
+}
+
+//resolve decides whether the record of the dump is imported, lists the conflict
+//and counts the records of the dump that aren't imported
+func (r *ImportReport) resolve(counts *ImportCounts, strategy MergeStrategy, conflict MergeConflict, equal bool, wins bool) bool {
+	imported := strategy != MergeKeepExisting && (strategy != MergeLastWriterWins || wins)
+	if equal {
+		if !imported {
+			counts.Unchanged++
+		}
+		return imported
+	}
+
+	conflict.Imported = imported
+	r.MergeConflicts = append(r.MergeConflicts, conflict)
+	if strategy == MergeFailOnConflict {
+		r.Conflicts = append(r.Conflicts, ImportConflict{
+			Table:  conflict.Table,
+			ID:     conflict.ID,
+			Reason: "differs from the saved record",
+		})
+	}
+
+	if !imported {
+		counts.Kept++
+	}
+	return imported
+}
+
+//mergeImport removes from the batch the records that lose to the saved ones by the {strategy}
+func (s *Service) mergeImport(batch *importBatch, index recordIndex, strategy MergeStrategy, report *ImportReport) {
+	accounts := batch.accounts[:0]
+	for _, account := range batch.accounts {
+		saved, ok := index.account(s, account.ID)
+		if ok {
+			wins := newer(saved.UpdatedAt, account.UpdatedAt,
+				func(d *dumpWriter) error { return d.account(saved) },
+				func(d *dumpWriter) error { return d.account(account) })
+			conflict := MergeConflict{
+				Table:      accountsTable.name,
+				ID:         strconv.FormatInt(account.ID, 10),
+				SavedAt:    saved.UpdatedAt,
+				ImportedAt: account.UpdatedAt,
+			}
+			if !report.resolve(&report.Accounts, strategy, conflict, sameAccount(saved, account), wins) {
+				continue
+			}
+		}
+		accounts = append(accounts, account)
+	}
+	batch.accounts = accounts
+
+	payments := batch.payments[:0]
+	for _, payment := range batch.payments {
+		saved, ok := index.payment(s, payment.ID)
+		if ok {
+			wins := newer(saved.UpdatedAt, payment.UpdatedAt,
+				func(d *dumpWriter) error { return d.payment(saved) },
+				func(d *dumpWriter) error { return d.payment(payment) })
+			conflict := MergeConflict{
+				Table:      paymentsTable.name,
+				ID:         payment.ID,
+				SavedAt:    saved.UpdatedAt,
+				ImportedAt: payment.UpdatedAt,
+			}
+			if !report.resolve(&report.Payments, strategy, conflict, samePayment(saved, payment), wins) {
+				continue
+			}
+		}
+		payments = append(payments, payment)
+	}
+	batch.payments = payments
+
+	favorites := batch.favorites[:0]
+	for _, favorite := range batch.favorites {
+		saved, ok := index.favorite(s, favorite.ID)
+		if ok {
+			wins := newer(saved.UpdatedAt, favorite.UpdatedAt,
+				func(d *dumpWriter) error { return d.favorite(saved) },
+				func(d *dumpWriter) error { return d.favorite(favorite) })
+			conflict := MergeConflict{
+				Table:      favoritesTable.name,
+				ID:         favorite.ID,
+				SavedAt:    saved.UpdatedAt,
+				ImportedAt: favorite.UpdatedAt,
+			}
+			if !report.resolve(&report.Favorites, strategy, conflict, sameFavorite(saved, favorite), wins) {
+				continue
+			}
+		}
+		favorites = append(favorites, favorite)
+	}
+	batch.favorites = favorites
+
+	vouchers := batch.vouchers[:0]
+	for _, voucher := range batch.vouchers {
+		saved, ok := index.voucher(s, voucher.Code)
+		if ok {
+			wins := len(voucher.RedeemedBy) > len(saved.RedeemedBy)
+			if len(voucher.RedeemedBy) == len(saved.RedeemedBy) {
+				wins = newer(time.Time{}, time.Time{},
+					func(d *dumpWriter) error { return d.voucher(saved) },
+					func(d *dumpWriter) error { return d.voucher(voucher) })
+			}
+
+			conflict := MergeConflict{Table: vouchersTable.name, ID: voucher.Code}
+			if !report.resolve(&report.Vouchers, strategy, conflict, sameVoucher(saved, voucher), wins) {
+				continue
+			}
+		}
+		vouchers = append(vouchers, voucher)
+	}
+	batch.vouchers = vouchers
+
+	rewards := batch.rewards[:0]
+	for _, reward := range batch.rewards {
+		saved, ok := index.reward(s, reward.ID)
+		if ok {
+			wins := rewardStages[reward.Status] > rewardStages[saved.Status]
+			if reward.Status == saved.Status {
+				wins = newer(time.Time{}, time.Time{},
+					func(d *dumpWriter) error { return d.reward(saved) },
+					func(d *dumpWriter) error { return d.reward(reward) })
+			}
+
+			conflict := MergeConflict{Table: rewardsTable.name, ID: reward.ID}
+			if !report.resolve(&report.Rewards, strategy, conflict, sameReward(saved, reward), wins) {
+				continue
+			}
+		}
+		rewards = append(rewards, reward)
+	}
+	batch.rewards = rewards
+}
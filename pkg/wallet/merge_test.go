@@ -0,0 +1,188 @@
+package wallet
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//regionalWallets returns two wallets imported from the same dump and changed independently:
+//both deposit into account 1, the first one later deposits into account 2
+func regionalWallets(t *testing.T) (*testService, *testService) {
+	base := newTestService()
+	base.setTime(time.Date(2020, time.March, 10, 8, 0, 0, 0, time.UTC))
+	for _, phone := range []types.Phone{"+992000000001", "+992000000002"} {
+		_, err := base.addAccountWithBalance(phone, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "base")
+	err := base.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := newTestService(), newTestService()
+	for _, s := range []*testService{first, second} {
+		err = s.Import(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deposits := []struct {
+		s       *testService
+		hour    int
+		account int64
+		amount  types.Money
+	}{
+		{s: first, hour: 10, account: 1, amount: 100},
+		{s: second, hour: 11, account: 1, amount: 50},
+		{s: first, hour: 12, account: 2, amount: 10},
+	}
+	for _, deposit := range deposits {
+		deposit.s.setTime(time.Date(2020, time.March, 10, deposit.hour, 0, 0, 0, time.UTC))
+		err = deposit.s.Deposit(deposit.account, deposit.amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return first, second
+}
+
+func balances(s *testService) []types.Money {
+	result := make([]types.Money, 0)
+	for _, account := range s.accounts {
+		result = append(result, account.Balance)
+	}
+	return result
+}
+
+func TestService_ImportWithOptions_merge(t *testing.T) {
+	tests := []struct {
+		strategy  MergeStrategy
+		balances  []types.Money
+		imported  int
+		kept      int
+		conflicts int
+	}{
+		{strategy: MergeOverwrite, balances: []types.Money{1050, 1000}, imported: 2},
+		{strategy: MergeKeepExisting, balances: []types.Money{1100, 1010}, kept: 2},
+		{strategy: MergeFailOnConflict, balances: []types.Money{1100, 1010}, conflicts: 2},
+		{strategy: MergeLastWriterWins, balances: []types.Money{1050, 1010}, imported: 1, kept: 1},
+	}
+
+	for _, test := range tests {
+		first, second := regionalWallets(t)
+		dir := filepath.Join(t.TempDir(), "second")
+		err := second.Export(dir)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		report, err := first.ImportWithOptions(dir, ImportOptions{Merge: test.strategy})
+		if test.conflicts != 0 {
+			var conflicts ImportConflicts
+			if !errors.As(err, &conflicts) || len(conflicts) != test.conflicts {
+				t.Errorf("ImportWithOptions(%v): must fail with conflicts, error = %v", test.strategy, err)
+			}
+		} else if err != nil {
+			t.Errorf("ImportWithOptions(%v): error = %v", test.strategy, err)
+			continue
+		} else {
+			imported := 0
+			for _, conflict := range report.MergeConflicts {
+				if conflict.Imported {
+					imported++
+				}
+			}
+
+			if len(report.MergeConflicts) != 2 || imported != test.imported || report.Accounts.Kept != test.kept {
+				t.Errorf("ImportWithOptions(%v): wrong report, conflicts = %v, kept = %v", test.strategy, report.MergeConflicts, report.Accounts.Kept)
+			}
+		}
+
+		got := balances(first)
+		if len(got) != len(test.balances) || got[0] != test.balances[0] || got[1] != test.balances[1] {
+			t.Errorf("ImportWithOptions(%v): balances = %v, expected = %v", test.strategy, got, test.balances)
+		}
+	}
+}
+
+func TestService_ImportWithOptions_lastWriterWinsConverges(t *testing.T) {
+	first, second := regionalWallets(t)
+	firstDir, secondDir := filepath.Join(t.TempDir(), "first"), filepath.Join(t.TempDir(), "second")
+	for dir, s := range map[string]*testService{firstDir: first, secondDir: second} {
+		err := s.Export(dir)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	_, err := first.ImportWithOptions(secondDir, ImportOptions{Merge: MergeLastWriterWins})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = second.ImportWithOptions(firstDir, ImportOptions{Merge: MergeLastWriterWins})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := range first.accounts {
+		if !sameAccount(first.accounts[i], second.accounts[i]) || !first.accounts[i].UpdatedAt.Equal(second.accounts[i].UpdatedAt) {
+			t.Errorf("ImportWithOptions(): wallets differ after merge, %v and %v", first.accounts[i], second.accounts[i])
+		}
+	}
+}
+
+func TestService_ImportWithOptions_ownExport(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	_, err := s.FavoritePayment(s.payments[0].ID, "lunch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	vouchers, err := s.GenerateVouchers(2, 10_00, time.Now().Add(time.Hour), 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Redeem(1, vouchers[0].Code)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, strategy := range []MergeStrategy{MergeOverwrite, MergeFailOnConflict} {
+		report, err := s.ImportWithOptions(dir, ImportOptions{Merge: strategy})
+		if err != nil {
+			t.Errorf("ImportWithOptions(%v): error = %v", strategy, err)
+			continue
+		}
+
+		updated := report.Accounts.Updated + report.Payments.Updated + report.Favorites.Updated + report.Vouchers.Updated
+		if updated != 0 || len(report.MergeConflicts) != 0 || report.Vouchers.Unchanged != 2 {
+			t.Errorf("ImportWithOptions(%v): own export changed the wallet, report = %v", strategy, report)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//DumpFS stores the dump files written by ExportTo and HistoryTo and read by ImportFrom
+type DumpFS interface {
+	//WriteFile stores the file with the content streamed by {write}, the file must stay as it was if {write} fails
+	WriteFile(name string, write func(w io.Writer) error) error
+	//Open returns the content of the file, or an error matching os.ErrNotExist if there is no such file
+	Open(name string) (io.ReadCloser, error)
+}
+
+//dirFS stores the dumps in a directory, replacing the files atomically
+type dirFS string
+
+//DirFS returns the storage of dumps in the directory, Export and Import use it
+func DirFS(dir string) DumpFS {
+	return dirFS(dir)
+}
+
+func (d dirFS) WriteFile(name string, write func(w io.Writer) error) error {
+	return createFileAtomic(d.path(name), write)
+}
+
+func (d dirFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+//path returns the path of the file, errors of Import name the files by their paths
+func (d dirFS) path(name string) string {
+	return string(d) + "/" + name
+}
+
+//MemoryFS stores the dumps in memory by their names
+type MemoryFS map[string][]byte
+
+//WriteFile stores the file once {write} succeeds
+func (m MemoryFS) WriteFile(name string, write func(w io.Writer) error) error {
+	var buffer bytes.Buffer
+	err := write(&buffer)
+	if err != nil {
+		return err
+	}
+	m[name] = buffer.Bytes()
+	return nil
+}
+
+//Open returns the content of the stored file
+func (m MemoryFS) Open(name string) (io.ReadCloser, error) {
+	content, ok := m[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+//dumpPath returns the name of the file in errors of Import
+func dumpPath(fs DumpFS, name string) string {
+	switch fs := fs.(type) {
+	case dirFS:
+		return fs.path(name)
+	case *encryptedFS:
+		return dumpPath(fs.fs, name)
+	}
+	return name
+}
+
+//WriteAccounts streams the accounts dump written by ExportToFile into {w}
+func (s *Service) WriteAccounts(w io.Writer) error {
+	_, err := s.exportTable(w, accountsTable)
+	return err
+}
+
+//ReadAccounts imports the accounts dump of any version read from {r}, like ImportFromFileWithOptions
+func (s *Service) ReadAccounts(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{}
+	batch := &importBatch{}
+	errs, err := batch.stageAccounts(r, accountsTable.file(), nil)
+	if err == nil {
+		err = options.check(report, errs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(batch, options, report)
+}
+
+//ExportTo writes the dumps of all the data and then their manifest into {fs}, like Export
+func (s *Service) ExportTo(fs DumpFS) error {
+	manifest := make([]manifestEntry, 0, len(dumpTables))
+	for _, table := range dumpTables {
+		var entry manifestEntry
+		err := fs.WriteFile(table.file(), func(w io.Writer) error {
+			var err error
+			entry, err = s.exportTable(w, table)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, entry)
+	}
+	return writeManifest(fs, manifest)
+}
+
+//ImportFrom imports the dumps of {fs}, like ImportWithOptions. All dumps are read and checked
+//against the manifest, if there is one, before the first record is applied
+func (s *Service) ImportFrom(fs DumpFS, options ImportOptions) (*ImportReport, error) {
+	manifest, err := readManifest(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &importBatch{}
+	errs, err := batch.stage(fs, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+	err = options.check(report, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commitImport(batch, options, report)
+}
+
+//stage reads the dumps of {fs} into the batch, checking them against the {manifest} unless it's nil
+func (b *importBatch) stage(fs DumpFS, manifest map[string]manifestEntry) ([]*DumpError, error) {
+	stages := []struct {
+		table dumpTable
+		stage func(r io.Reader, file string, expected *manifestEntry) ([]*DumpError, error)
+	}{
+		{table: accountsTable, stage: b.stageAccounts},
+		{table: paymentsTable, stage: b.stagePayments},
+		{table: favoritesTable, stage: b.stageFavorites},
+		{table: vouchersTable, stage: b.stageVouchers},
+		{table: rewardsTable, stage: b.stageRewards},
+	}
+
+	errs := make([]*DumpError, 0)
+	for _, stage := range stages {
+		var expected *manifestEntry
+		if manifest != nil {
+			entry, ok := manifest[stage.table.file()]
+			if !ok {
+				continue //dumps left by older exports aren't part of the snapshot
+			}
+			expected = &entry
+		}
+
+		reader, err := fs.Open(stage.table.file())
+		if errors.Is(err, os.ErrNotExist) && expected == nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stageErrs, err := stage.stage(reader, dumpPath(fs, stage.table.file()), expected)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, stageErrs...)
+	}
+	return errs, nil
+}
+
+//HistoryTo writes the payments into {fs} like HistoryToFiles
+func (s *Service) HistoryTo(fs DumpFS, payments []types.Payment, records int) error {
+	_, err := s.WriteHistory(fs, payments, HistoryOptions{PageSize: records})
+	return err
+}
+
+//writeBytes returns the function that writes the {content} for DumpFS.WriteFile
+func writeBytes(content []byte) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	}
+}
@@ -0,0 +1,101 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportTo_memory(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	fs := MemoryFS{}
+	err := s.ExportTo(fs)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{"accounts.dump", "payments.dump", "favorites.dump", "vouchers.dump", manifestFile} {
+		if _, ok := fs[name]; !ok {
+			t.Errorf("ExportTo(): %v wasn't written", name)
+		}
+	}
+
+	imported := newTestService()
+	report, err := imported.ImportFrom(fs, ImportOptions{})
+	if err != nil || report.Accounts.Added != len(s.accounts) || report.Payments.Added != len(s.payments) {
+		t.Errorf("ImportFrom(): report = %v, error = %v", report, err)
+		return
+	}
+
+	fs["payments.dump"] = bytes.Replace(fs["payments.dump"], []byte(";INPROGRESS"), []byte(";FAIL"), 1)
+	_, err = newTestService().ImportFrom(fs, ImportOptions{})
+	if !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("ImportFrom(): must return ErrManifestMismatch, returned = %v", err)
+	}
+}
+
+func TestMemoryFS_WriteFile_failed(t *testing.T) {
+	fs := MemoryFS{"accounts.dump": []byte("old")}
+	failure := errors.New("failure")
+	err := fs.WriteFile("accounts.dump", func(w io.Writer) error {
+		_, _ = w.Write([]byte("partial"))
+		return failure
+	})
+	if err != failure || string(fs["accounts.dump"]) != "old" {
+		t.Errorf("WriteFile(): file = %q, error = %v", fs["accounts.dump"], err)
+	}
+}
+
+func TestService_WriteAccounts(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	var buffer bytes.Buffer
+	err := s.WriteAccounts(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasPrefix(buffer.String(), "#wallet-dump v4 accounts\n") {
+		t.Errorf("WriteAccounts(): wrong dump = %q", buffer.String())
+	}
+
+	imported := newTestService()
+	_, err = imported.ReadAccounts(&buffer, ImportOptions{})
+	if err != nil || len(imported.accounts) != len(s.accounts) {
+		t.Errorf("ReadAccounts(): accounts = %v, error = %v", len(imported.accounts), err)
+	}
+
+	_, err = imported.ReadAccounts(strings.NewReader("1;+992000000001;100|2;+992000000002;200|"), ImportOptions{})
+	if err != nil {
+		t.Errorf("ReadAccounts(): legacy dump wasn't read, error = %v", err)
+	}
+}
+
+func TestService_HistoryTo(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	payments, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fs := MemoryFS{}
+	err = s.HistoryTo(fs, payments, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(fs) != 4 || fs["payments3.dump"] == nil || fs["payments-index.dump"] == nil {
+		t.Errorf("HistoryTo(): wrong files = %v", len(fs))
+	}
+}
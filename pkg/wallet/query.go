@@ -0,0 +1,360 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidTopCount error for top query of less than one payment
+var ErrInvalidTopCount = errors.New("top count must be greater than zero")
+
+//queryTaskSize is the number of payments a worker of a query takes at a time
+const queryTaskSize = 4096
+
+//PaymentQuery is a query over the payments of the service run by a pool of workers. Filters and maps
+//are applied in the order they are added, then a terminal method like Collect or Sum runs the query.
+//The payments are split into tasks of consecutive payments, and the results of the tasks are merged
+//in the order of the payments, so they don't depend on which worker finishes first. The fee and reward
+//transactions linked to payments are left out unless the query includes them, see Linked.
+//The payments must not change while the query runs
+type PaymentQuery struct {
+	service *Service
+	ctx     context.Context
+	workers int
+	linked  bool
+	steps   []queryStep
+}
+
+//queryStep is a filter or a map of a query
+type queryStep struct {
+	filter func(payment types.Payment) bool
+	mapper func(payment types.Payment) types.Payment
+}
+
+//queryTask receives the payments of a task from the worker running it, {done} is called after the last one
+//unless the query is cancelled, so the terminal methods keep their partial results in local variables
+//and publish them once per task
+type queryTask struct {
+	visit func(payment *types.Payment)
+	done  func()
+}
+
+//PaymentGroup holds the payments of a query with the same key, see GroupBy
+type PaymentGroup struct {
+	Key   string
+	Count int
+	Total types.Money
+}
+
+//Query returns the query of all the payments run by as many workers as there are CPUs
+func (s *Service) Query() *PaymentQuery {
+	return &PaymentQuery{service: s, ctx: context.Background(), workers: runtime.NumCPU()}
+}
+
+//Context makes the query stop when the context is done, its terminal method returns ctx.Err() then
+func (q *PaymentQuery) Context(ctx context.Context) *PaymentQuery {
+	q.ctx = ctx
+	return q
+}
+
+//Workers sets the number of goroutines running the query, at least one
+func (q *PaymentQuery) Workers(workers int) *PaymentQuery {
+	q.workers = workerCount(workers)
+	return q
+}
+
+//Linked makes the query include the fee and reward transactions linked to payments, before the filters and maps
+func (q *PaymentQuery) Linked() *PaymentQuery {
+	q.linked = true
+	return q
+}
+
+//Filter keeps the payments {filter} returns true for
+func (q *PaymentQuery) Filter(filter func(payment types.Payment) bool) *PaymentQuery {
+	q.steps = append(q.steps, queryStep{filter: filter})
+	return q
+}
+
+//Map replaces the payments with the ones {mapper} returns, the payments of the service stay as they are
+func (q *PaymentQuery) Map(mapper func(payment types.Payment) types.Payment) *PaymentQuery {
+	q.steps = append(q.steps, queryStep{mapper: mapper})
+	return q
+}
+
+//tasks returns the number of tasks the payments are split into
+func (q *PaymentQuery) tasks() int {
+	return (len(q.service.payments) + queryTaskSize - 1) / queryTaskSize
+}
+
+//taskSize returns the number of payments of the task, the last task may have less than queryTaskSize
+func (q *PaymentQuery) taskSize(task int) int {
+	return minInt(queryTaskSize, len(q.service.payments)-task*queryTaskSize)
+}
+
+//minInt returns the smaller of the numbers
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//run starts every task with {start} and passes it the payments of the task that pass the filters, after the maps,
+//in order. The task must not keep the pointer, which is either the payment of the service or reused for the next
+//mapped payment. It waits for the workers and returns ctx.Err() if the context is done before every task is run
+func (q *PaymentQuery) run(start func(task int) queryTask) error {
+	err := q.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	payments := q.service.payments
+	tasks := q.tasks()
+	workers := q.workers
+	if workers > tasks {
+		workers = tasks
+	}
+
+	next := int64(-1)
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var mapped types.Payment
+			for {
+				task := int(atomic.AddInt64(&next, 1))
+				if task >= tasks || q.ctx.Err() != nil {
+					return
+				}
+
+				run := start(task)
+				for i, payment := range payments[task*queryTaskSize : task*queryTaskSize+q.taskSize(task)] {
+					if i%cancelCheckInterval == 0 && q.ctx.Err() != nil {
+						return
+					}
+					if current, ok := q.apply(payment, &mapped); ok {
+						run.visit(current)
+					}
+				}
+				run.done()
+			}
+		}()
+	}
+	wg.Wait()
+	return q.ctx.Err()
+}
+
+//apply runs the filters and maps of the query on the payment, reporting whether it passed every filter,
+//linked transactions don't pass unless the query includes them.
+//The payment is copied into {mapped} by the first map, until then the payment of the service is used
+func (q *PaymentQuery) apply(payment *types.Payment, mapped *types.Payment) (*types.Payment, bool) {
+	if payment.LinkedID != "" && !q.linked {
+		return nil, false
+	}
+	for _, step := range q.steps {
+		if step.filter != nil && !step.filter(*payment) {
+			return nil, false
+		}
+		if step.mapper != nil {
+			*mapped = step.mapper(*payment)
+			payment = mapped
+		}
+	}
+	return payment, true
+}
+
+//Collect returns the payments of the query in the order of the service
+func (q *PaymentQuery) Collect() ([]types.Payment, error) {
+	results := make([][]types.Payment, q.tasks())
+	err := q.run(func(task int) queryTask {
+		payments := make([]types.Payment, 0)
+		return queryTask{
+			visit: func(payment *types.Payment) { payments = append(payments, *payment) },
+			done:  func() { results[task] = payments },
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	for _, result := range results {
+		count += len(result)
+	}
+	payments := make([]types.Payment, 0, count)
+	for _, result := range results {
+		payments = append(payments, result...)
+	}
+	return payments, nil
+}
+
+//Count returns the number of payments of the query
+func (q *PaymentQuery) Count() (int, error) {
+	counts := make([]int, q.tasks())
+	err := q.run(func(task int) queryTask {
+		count := 0
+		return queryTask{
+			visit: func(payment *types.Payment) { count++ },
+			done:  func() { counts[task] = count },
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, partial := range counts {
+		count += partial
+	}
+	return count, nil
+}
+
+//Sum returns the sum of the amounts of the payments of the query
+func (q *PaymentQuery) Sum() (types.Money, error) {
+	sums := make([]types.Money, q.tasks())
+	err := q.run(func(task int) queryTask {
+		sum := types.Money(0)
+		return queryTask{
+			visit: func(payment *types.Payment) { sum += payment.Amount },
+			done:  func() { sums[task] = sum },
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sum := types.Money(0)
+	for _, partial := range sums {
+		sum += partial
+	}
+	return sum, nil
+}
+
+//Reduce folds the payments of every task into a value starting from {initial} with {reduce}, and then folds the values
+//of the tasks in the order of the payments with {combine}, starting from {initial} too. {initial} is shared, so it must
+//not be changed in place, and {combine} must be associative for the result not to depend on the size of the tasks
+func (q *PaymentQuery) Reduce(initial interface{}, reduce func(result interface{}, payment types.Payment) interface{}, combine func(a interface{}, b interface{}) interface{}) (interface{}, error) {
+	results := make([]interface{}, q.tasks())
+	for i := range results {
+		results[i] = initial
+	}
+
+	err := q.run(func(task int) queryTask {
+		result := initial
+		return queryTask{
+			visit: func(payment *types.Payment) { result = reduce(result, *payment) },
+			done:  func() { results[task] = result },
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := initial
+	for _, partial := range results {
+		result = combine(result, partial)
+	}
+	return result, nil
+}
+
+//GroupBy returns the number and the sum of the payments of the query by the key {key} returns, sorted by key
+func (q *PaymentQuery) GroupBy(key func(payment types.Payment) string) ([]PaymentGroup, error) {
+	results := make([]map[string]*PaymentGroup, q.tasks())
+	err := q.run(func(task int) queryTask {
+		groups := make(map[string]*PaymentGroup)
+		return queryTask{
+			visit: func(payment *types.Payment) {
+				name := key(*payment)
+				group, ok := groups[name]
+				if !ok {
+					group = &PaymentGroup{Key: name}
+					groups[name] = group
+				}
+				group.Count++
+				group.Total += payment.Amount
+			},
+			done: func() { results[task] = groups },
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]*PaymentGroup)
+	for _, result := range results {
+		for name, group := range result {
+			saved, ok := merged[name]
+			if !ok {
+				merged[name] = group
+				continue
+			}
+			saved.Count += group.Count
+			saved.Total += group.Total
+		}
+	}
+
+	groups := make([]PaymentGroup, 0, len(merged))
+	for _, group := range merged {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Key < groups[j].Key
+	})
+	return groups, nil
+}
+
+//Top returns the first {count} payments of the query ordered by {less}, payments {less} doesn't order keep the order of the service
+func (q *PaymentQuery) Top(count int, less func(a types.Payment, b types.Payment) bool) ([]types.Payment, error) {
+	if count < 1 {
+		return nil, ErrInvalidTopCount
+	}
+
+	results := make([][]types.Payment, q.tasks())
+	err := q.run(func(task int) queryTask {
+		top := make([]types.Payment, 0, minInt(count, q.taskSize(task)))
+		return queryTask{
+			visit: func(payment *types.Payment) { top = insertTop(top, *payment, count, less) },
+			done:  func() { results[task] = top },
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := 0
+	for _, result := range results {
+		found += len(result)
+	}
+	top := make([]types.Payment, 0, minInt(count, found))
+	for _, result := range results { //the tasks in the order of the payments keep the ties in order
+		for _, payment := range result {
+			top = insertTop(top, payment, count, less)
+		}
+	}
+	return top, nil
+}
+
+//insertTop inserts the payment into the {top} payments ordered by {less} after the ones it isn't less than,
+//keeping at most {count} of them
+func insertTop(top []types.Payment, payment types.Payment, count int, less func(a types.Payment, b types.Payment) bool) []types.Payment {
+	if len(top) == count && !less(payment, top[count-1]) {
+		return top
+	}
+
+	position := sort.Search(len(top), func(i int) bool {
+		return less(payment, top[i])
+	})
+	if len(top) < count {
+		top = append(top, types.Payment{})
+	}
+	copy(top[position+1:], top[position:])
+	top[position] = payment
+	return top
+}
@@ -0,0 +1,217 @@
+package wallet
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func TestPaymentQuery(t *testing.T) {
+	s := amountService(50_000)
+	categories := []types.PaymentCategory{"food", "mobile", "auto"}
+	for i, payment := range s.payments {
+		payment.Category = categories[i%len(categories)]
+	}
+
+	var expected []types.Payment
+	for _, workers := range []int{1, 3, 16} {
+		query := func() *PaymentQuery {
+			return s.Query().Workers(workers).Filter(func(payment types.Payment) bool {
+				return payment.Category == "mobile"
+			})
+		}
+
+		payments, err := query().Map(func(payment types.Payment) types.Payment {
+			payment.Amount *= 2
+			return payment
+		}).Collect()
+		if err != nil || len(payments) != 16_667 || payments[0].Amount != 2 || s.payments[1].Amount != 1 {
+			t.Errorf("Collect(%d): %d payments, error = %v", workers, len(payments), err)
+			return
+		}
+		if expected == nil {
+			expected = payments
+		}
+		if !reflect.DeepEqual(payments, expected) {
+			t.Errorf("Collect(%d): results depend on the workers", workers)
+		}
+		for i := 1; i < len(payments); i++ {
+			if payments[i].Amount <= payments[i-1].Amount {
+				t.Errorf("Collect(%d): payment %d out of order", workers, i)
+				break
+			}
+		}
+
+		count, err := query().Count()
+		if err != nil || count != 16_667 {
+			t.Errorf("Count(%d) = %v, error = %v", workers, count, err)
+		}
+
+		sum, err := s.Query().Workers(workers).Sum()
+		if err != nil || sum != 1_249_975_000 {
+			t.Errorf("Sum(%d) = %v, error = %v", workers, sum, err)
+		}
+
+		largest, err := query().Reduce(types.Money(0), func(result interface{}, payment types.Payment) interface{} {
+			if payment.Amount > result.(types.Money) {
+				return payment.Amount
+			}
+			return result
+		}, func(a interface{}, b interface{}) interface{} {
+			if b.(types.Money) > a.(types.Money) {
+				return b
+			}
+			return a
+		})
+		if err != nil || largest != types.Money(49_999) {
+			t.Errorf("Reduce(%d) = %v, error = %v", workers, largest, err)
+		}
+
+		groups, err := s.Query().Workers(workers).GroupBy(func(payment types.Payment) string {
+			return string(payment.Category)
+		})
+		if err != nil || len(groups) != 3 || groups[0].Key != "auto" || groups[2].Key != "mobile" || groups[2].Count != 16_667 {
+			t.Errorf("GroupBy(%d) = %v, error = %v", workers, groups, err)
+		}
+
+		top, err := s.Query().Workers(workers).Top(5, func(a types.Payment, b types.Payment) bool {
+			return a.Amount%1000 > b.Amount%1000
+		})
+		ids := make([]string, len(top))
+		for i, payment := range top {
+			ids[i] = payment.ID
+		}
+		if err != nil || !reflect.DeepEqual(ids, []string{"payment-999", "payment-1999", "payment-2999", "payment-3999", "payment-4999"}) {
+			t.Errorf("Top(%d) = %v, error = %v", workers, ids, err)
+		}
+	}
+
+	_, err := s.Query().Top(0, nil)
+	if err != ErrInvalidTopCount {
+		t.Errorf("Top(): must return ErrInvalidTopCount, returned = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.Query().Context(ctx).GroupBy(func(payment types.Payment) string { return "" })
+	if err != context.Canceled {
+		t.Errorf("GroupBy(): must return context.Canceled, returned = %v", err)
+	}
+
+	empty, err := newTestService().Query().Collect()
+	if err != nil || len(empty) != 0 {
+		t.Errorf("Collect(): payments of an empty wallet = %v, error = %v", empty, err)
+	}
+}
+
+func TestPaymentQuery_Top_countAbovePayments(t *testing.T) {
+	s := amountService(10)
+	top, err := s.Query().Top(math.MaxInt32*64, func(a types.Payment, b types.Payment) bool {
+		return a.Amount > b.Amount
+	})
+	if err != nil || len(top) != 10 || top[0].Amount != 9 || top[9].Amount != 0 {
+		t.Errorf("Top() = %v, error = %v", top, err)
+	}
+
+	if cap(top) != 10 {
+		t.Errorf("Top(): capacity = %v, must not exceed the number of payments", cap(top))
+	}
+}
+
+//chunkedSum and chunkedFilter are the goroutine per chunk and mutex implementations
+//SumPayments and FilterPaymentsByFn had before the query engine, kept to compare with it
+func chunkedSum(s *Service, goroutines int) types.Money {
+	paysPerRoutine := (len(s.payments) / goroutines) + 1
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	sum := types.Money(0)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(iteration int) {
+			defer wg.Done()
+			partialSum := types.Money(0)
+			for j := iteration * paysPerRoutine; j < (iteration+1)*paysPerRoutine && j < len(s.payments); j++ {
+				partialSum += s.payments[j].Amount
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sum += partialSum
+		}(i)
+	}
+	wg.Wait()
+	return sum
+}
+
+func chunkedFilter(s *Service, filter func(payment types.Payment) bool, goroutines int) []types.Payment {
+	paysPerRoutine := (len(s.payments) / goroutines) + 1
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	payments := make([]types.Payment, 0)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(iteration int) {
+			defer wg.Done()
+			partialPayments := make([]types.Payment, 0)
+			for j := iteration * paysPerRoutine; j < (iteration+1)*paysPerRoutine && j < len(s.payments); j++ {
+				if filter(*s.payments[j]) {
+					partialPayments = append(partialPayments, *s.payments[j])
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			payments = append(payments, partialPayments...)
+		}(i)
+	}
+	wg.Wait()
+	return payments
+}
+
+//BenchmarkPaymentQuery compares the query engine with the implementations it replaced and with plain loops
+func BenchmarkPaymentQuery(b *testing.B) {
+	const goroutines = 8
+	for _, count := range []int{10_000, 1_000_000} {
+		s := amountService(count)
+		mobile := func(payment types.Payment) bool { return payment.AccountID%3 == 0 }
+		category := func(payment types.Payment) string { return strconv.FormatInt(payment.AccountID, 10) }
+		size := "/payments=" + strconv.Itoa(count)
+
+		benchmarks := []struct {
+			name string
+			run  func() error
+		}{
+			{name: "sum/chunked", run: func() error { chunkedSum(s.Service, goroutines); return nil }},
+			{name: "sum/query", run: func() error { _, err := s.Query().Workers(goroutines).Sum(); return err }},
+			{name: "sum/loop", run: func() error {
+				sum := types.Money(0)
+				for _, payment := range s.payments {
+					sum += payment.Amount
+				}
+				return nil
+			}},
+			{name: "filter/chunked", run: func() error { chunkedFilter(s.Service, mobile, goroutines); return nil }},
+			{name: "filter/query", run: func() error { _, err := s.Query().Workers(goroutines).Filter(mobile).Collect(); return err }},
+			{name: "group/query", run: func() error { _, err := s.Query().Workers(goroutines).GroupBy(category); return err }},
+			{name: "top/query", run: func() error {
+				_, err := s.Query().Workers(goroutines).Top(10, func(a types.Payment, b types.Payment) bool { return a.Amount > b.Amount })
+				return err
+			}},
+		}
+		for _, benchmark := range benchmarks {
+			benchmark := benchmark
+			b.Run(benchmark.name+size, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					err := benchmark.run()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
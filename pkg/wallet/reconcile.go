@@ -0,0 +1,337 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ReconcileIssueKind is the kind of statement line or payment that can't be reconciled
+type ReconcileIssueKind string
+
+//Kinds of reconciliation issues
+const (
+	ReconcileUnmatched        ReconcileIssueKind = "UNMATCHED"         //no payment of the wallet has the ID of the line
+	ReconcileAmountMismatch   ReconcileIssueKind = "AMOUNT_MISMATCH"   //the payment has another amount
+	ReconcileAccountMismatch  ReconcileIssueKind = "ACCOUNT_MISMATCH"  //the payment belongs to another account
+	ReconcileCategoryMismatch ReconcileIssueKind = "CATEGORY_MISMATCH" //the payment isn't settled by the sender of the statement
+	ReconcileRejected         ReconcileIssueKind = "REJECTED"          //the payment was rejected in the wallet
+	ReconcileDuplicateLine    ReconcileIssueKind = "DUPLICATE_LINE"    //an earlier line has the same ID
+	ReconcileUnsettled        ReconcileIssueKind = "UNSETTLED"         //the payment in progress isn't in the statement
+)
+
+//ReconcileOptions holds the settings of Reconcile
+type ReconcileOptions struct {
+	Category types.PaymentCategory //category of the payments settled by the sender of the statement
+	Mode     ImportMode            //strict reconciliation fails on malformed lines, lenient one skips them
+	DryRun   bool                  //only report what would be settled
+}
+
+//SettlementLine is a line of an external statement: a payment the operator settled.
+//The account ID is 0 and the phone is empty if the statement has no such column
+type SettlementLine struct {
+	Line      int //number of the CSV record, the header is 1 and blank lines aren't counted
+	PaymentID string
+	AccountID int64
+	Phone     types.Phone
+	Amount    types.Money
+}
+
+//ReconcileIssue describes a statement line, or a payment missing from the statement, that can't be reconciled
+type ReconcileIssue struct {
+	Kind      ReconcileIssueKind
+	Line      int //0 for payments missing from the statement
+	PaymentID string
+	Reason    string
+}
+
+func (i ReconcileIssue) String() string {
+	if i.Line == 0 {
+		return fmt.Sprintf("%s payment %s: %s", i.Kind, i.PaymentID, i.Reason)
+	}
+	return fmt.Sprintf("%s line %d payment %s: %s", i.Kind, i.Line, i.PaymentID, i.Reason)
+}
+
+//ReconcileReport describes the result of Reconcile
+type ReconcileReport struct {
+	Lines   int      //valid lines of the statement
+	Matched []string //IDs of the payments matching their line
+	Settled int      //matched payments marked OK by this reconciliation, the others were OK already
+	Issues  []ReconcileIssue
+	Skipped []*DumpError
+}
+
+//reconcileColumns lists the columns of the statement the reconciliation reads, the header names them
+//in any order and case, other columns are ignored. Amounts are in units with up to two decimal places
+var reconcileColumns = []struct {
+	name     string
+	required bool
+}{
+	{name: "payment_id", required: true},
+	{name: "amount", required: true},
+	{name: "account_id"},
+	{name: "phone"},
+}
+
+//Reconcile matches the lines of the CSV statement of an operator named {file} read from {r} with the payments
+//of {options.Category}: by ID, and then by amount and by account or phone when the statement has them. Matching
+//payments in progress are marked OK together with their fees, every other line is listed in the report as an
+//issue, and so are the payments of the category in progress that the statement doesn't list.
+//The whole statement is read and checked before any payment is changed
+func (s *Service) Reconcile(r io.Reader, file string, options ReconcileOptions) (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+	lines, errs, err := readSettlementLines(r, file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ImportOptions{Mode: options.Mode}.check(&ImportReport{}, errs)
+	if err != nil {
+		return nil, err
+	}
+	report.Skipped = errs
+	report.Lines = len(lines)
+
+	index := s.indexRecords()
+	settled := make([]*types.Payment, 0)
+	listed := make(map[string]int, len(lines))
+	for _, line := range lines {
+		issue := ReconcileIssue{Line: line.Line, PaymentID: line.PaymentID}
+		payment, found := index.payment(s, line.PaymentID)
+		account := &types.Account{}
+		if found {
+			account, found = index.account(s, payment.AccountID)
+		}
+
+		switch {
+		case listed[line.PaymentID] != 0:
+			issue.Kind, issue.Reason = ReconcileDuplicateLine, fmt.Sprintf("listed on line %d", listed[line.PaymentID])
+		case !found:
+			issue.Kind, issue.Reason = ReconcileUnmatched, "payment not found"
+		case payment.Category != options.Category:
+			issue.Kind, issue.Reason = ReconcileCategoryMismatch, fmt.Sprintf("category %s, expected %s", payment.Category, options.Category)
+		case line.AccountID != 0 && line.AccountID != payment.AccountID:
+			issue.Kind, issue.Reason = ReconcileAccountMismatch, fmt.Sprintf("account %d, the statement has %d", payment.AccountID, line.AccountID)
+		case line.Phone != "" && line.Phone != account.Phone:
+			issue.Kind, issue.Reason = ReconcileAccountMismatch, fmt.Sprintf("phone %s, the statement has %s", account.Phone, line.Phone)
+		case line.Amount != payment.Amount:
+			issue.Kind, issue.Reason = ReconcileAmountMismatch, fmt.Sprintf("amount %s, the statement has %s", formatMoney(payment.Amount), formatMoney(line.Amount))
+		case payment.Status == types.PaymentStatusFail:
+			issue.Kind, issue.Reason = ReconcileRejected, "the payment was rejected, its money returned to the account"
+		}
+
+		if listed[line.PaymentID] == 0 {
+			listed[line.PaymentID] = line.Line
+		}
+		if issue.Kind != "" {
+			report.Issues = append(report.Issues, issue)
+			continue
+		}
+
+		report.Matched = append(report.Matched, payment.ID)
+		if payment.Status == types.PaymentStatusInProgress {
+			settled = append(settled, payment)
+		}
+	}
+
+	for _, payment := range s.payments {
+		if payment.Category == options.Category && payment.Status == types.PaymentStatusInProgress && listed[payment.ID] == 0 {
+			report.Issues = append(report.Issues, ReconcileIssue{
+				Kind:      ReconcileUnsettled,
+				PaymentID: payment.ID,
+				Reason:    "the payment in progress isn't in the statement",
+			})
+		}
+	}
+
+	report.Settled = len(settled)
+	if options.DryRun {
+		return report, nil
+	}
+
+	fees := make(map[string][]*types.Payment, len(settled))
+	for _, payment := range settled {
+		fees[payment.ID] = nil
+	}
+	for _, fee := range s.payments {
+		if _, ok := fees[fee.LinkedID]; ok && fee.Category == types.CategoryFee {
+			fees[fee.LinkedID] = append(fees[fee.LinkedID], fee)
+		}
+	}
+
+	for _, payment := range settled {
+		s.settle(payment, fees[payment.ID])
+	}
+	return report, nil
+}
+
+//ReconcileFile reconciles the payments with the statement in the file, see Reconcile
+func (s *Service) ReconcileFile(path string, options ReconcileOptions) (*ReconcileReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return s.Reconcile(file, path, options)
+}
+
+//settle marks the payment in progress and its {fees} in progress OK
+func (s *Service) settle(payment *types.Payment, fees []*types.Payment) {
+	now := s.stamp()
+	for _, fee := range fees {
+		if fee.Status == types.PaymentStatusInProgress {
+			fee.Status = types.PaymentStatusOk
+			fee.UpdatedAt = now
+			s.track(paymentKey(fee.ID))
+		}
+	}
+
+	payment.Status = types.PaymentStatusOk
+	payment.UpdatedAt = now
+	s.track(paymentKey(payment.ID))
+}
+
+//readSettlementLines reads the lines of the CSV statement named {file}, the first line is the header
+func readSettlementLines(r io.Reader, file string) ([]SettlementLine, []*DumpError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, &DumpError{File: file, Line: 1, Reason: "missing header"}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidDump, file, err)
+	}
+
+	positions := make(map[string]int, len(reconcileColumns))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, column := range reconcileColumns {
+		if _, ok := positions[column.name]; column.required && !ok {
+			return nil, nil, &DumpError{File: file, Line: 1, Field: column.name, Reason: "missing column"}
+		}
+	}
+
+	lines := make([]SettlementLine, 0)
+	errs := make([]*DumpError, 0)
+	for number := 2; ; number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidDump, file, err)
+		}
+
+		line, invalid := settlementLine(record, positions)
+		if invalid != nil {
+			errs = append(errs, &DumpError{File: file, Line: number, Field: invalid.field, Reason: invalid.reason})
+			continue
+		}
+		line.Line = number
+		lines = append(lines, line)
+	}
+	return lines, errs, nil
+}
+
+//settlementLine parses the statement line from the CSV record with the columns at {positions}
+func settlementLine(record []string, positions map[string]int) (SettlementLine, *recordError) {
+	field := func(column string) string {
+		position, ok := positions[column]
+		if !ok || position >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[position])
+	}
+
+	line := SettlementLine{PaymentID: field("payment_id"), Phone: types.Phone(field("phone"))}
+	if line.PaymentID == "" {
+		return line, &recordError{field: "payment_id", reason: "must not be empty"}
+	}
+
+	amount, err := parseMoney(field("amount"))
+	if err != nil || amount <= 0 {
+		return line, &recordError{field: "amount", reason: "must be a positive amount in units"}
+	}
+	line.Amount = amount
+
+	if text := field("account_id"); text != "" {
+		line.AccountID, err = strconv.ParseInt(text, 10, 64)
+		if err != nil || line.AccountID <= 0 {
+			return line, &recordError{field: "account_id", reason: "must be a positive integer"}
+		}
+	}
+	return line, nil
+}
+
+//parseMoney parses the amount in units with up to two decimal places as written by formatMoney
+func parseMoney(text string) (types.Money, error) {
+	units, cents := text, ""
+	if dot := strings.IndexByte(text, '.'); dot >= 0 {
+		units, cents = text[:dot], text[dot+1:]
+		if cents == "" || len(cents) > 2 || strings.TrimLeft(cents, "0123456789") != "" {
+			return 0, fmt.Errorf("invalid amount %q", text)
+		}
+	}
+
+	negative := strings.HasPrefix(units, "-")
+	value, err := strconv.ParseInt(strings.TrimPrefix(units, "-"), 10, 64)
+	if err != nil || strings.HasPrefix(units, "+") {
+		return 0, fmt.Errorf("invalid amount %q", text)
+	}
+
+	fraction := int64(0)
+	if cents != "" {
+		fraction, _ = strconv.ParseInt((cents + "0")[:2], 10, 64)
+	}
+	if value > (math.MaxInt64-fraction)/100 { //the amount in cents wouldn't fit
+		return 0, fmt.Errorf("amount %q is out of range", text)
+	}
+
+	amount := types.Money(value*100 + fraction)
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+//WriteCSV writes the report as CSV: the number of lines, matched and settled payments, and then the matched
+//payments and the issues, one per row with the kind, the statement line, the payment ID and the reason
+func (r *ReconcileReport) WriteCSV(w io.Writer) error {
+	buffered := bufio.NewWriterSize(w, dumpBufferSize)
+	writer := csv.NewWriter(buffered)
+
+	records := [][]string{
+		{"Lines", "Matched", "Settled", "Issues"},
+		{strconv.Itoa(r.Lines), strconv.Itoa(len(r.Matched)), strconv.Itoa(r.Settled), strconv.Itoa(len(r.Issues))},
+		{},
+		{"Kind", "Line", "Payment", "Reason"},
+	}
+	for _, paymentID := range r.Matched {
+		records = append(records, []string{"MATCHED", "", paymentID, ""})
+	}
+	for _, issue := range r.Issues {
+		line := ""
+		if issue.Line != 0 {
+			line = strconv.Itoa(issue.Line)
+		}
+		records = append(records, []string{string(issue.Kind), line, issue.PaymentID, issue.Reason})
+	}
+
+	err := writer.WriteAll(records)
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
@@ -0,0 +1,149 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func TestService_Reconcile(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	mobile := make([]*types.Payment, 0)
+	for _, payment := range s.payments {
+		if payment.Category == "mobile" {
+			mobile = append(mobile, payment)
+		}
+	}
+	rejected, _ := s.Pay(2, 12, "mobile")
+	_ = s.Reject(rejected.ID)
+
+	statement := strings.Join([]string{
+		"Date, Payment_ID, Phone, Amount",
+		"2020-03-02," + mobile[0].ID + ",+992000000001,0.02",
+		"2020-03-02," + mobile[1].ID + ",+992000000001,0.05",
+		"2020-03-02," + mobile[2].ID + ",+992000000003,0.08",
+		"2020-03-02," + mobile[0].ID + ",+992000000001,0.02",
+		"2020-03-02,unknown,+992000000001,1.00",
+		"2020-03-02," + s.payments[0].ID + ",+992000000001,0.01",
+		"2020-03-02," + rejected.ID + ",+992000000002,0.12",
+		"2020-03-02,,+992000000001,1",
+	}, "\n")
+
+	tests := []struct {
+		mode   ImportMode
+		dryRun bool
+	}{
+		{mode: ImportStrict},
+		{mode: ImportLenient, dryRun: true},
+		{mode: ImportLenient},
+	}
+	for _, test := range tests {
+		report, err := s.Reconcile(strings.NewReader(statement), "operator.csv", ReconcileOptions{Category: "mobile", Mode: test.mode, DryRun: test.dryRun})
+		if test.mode == ImportStrict {
+			if !errors.Is(err, ErrInvalidDump) || mobile[0].Status != types.PaymentStatusInProgress {
+				t.Errorf("Reconcile(): must return ErrInvalidDump, returned = %v", err)
+			}
+			continue
+		}
+
+		if err != nil || report.Lines != 7 || len(report.Skipped) != 1 || report.Settled != 1 || len(report.Matched) != 1 {
+			t.Errorf("Reconcile(): report = %v, error = %v", report, err)
+			continue
+		}
+
+		kinds := make([]string, len(report.Issues))
+		for i, issue := range report.Issues {
+			kinds[i] = string(issue.Kind)
+		}
+		expected := "AMOUNT_MISMATCH ACCOUNT_MISMATCH DUPLICATE_LINE UNMATCHED CATEGORY_MISMATCH REJECTED UNSETTLED"
+		if strings.Join(kinds, " ") != expected {
+			t.Errorf("Reconcile(): wrong issues = %v", report.Issues)
+		}
+
+		status := types.PaymentStatusOk
+		if test.dryRun {
+			status = types.PaymentStatusInProgress
+		}
+		if mobile[0].Status != status || mobile[1].Status != types.PaymentStatusInProgress {
+			t.Errorf("Reconcile(): wrong statuses %v and %v", mobile[0].Status, mobile[1].Status)
+		}
+	}
+
+	report, err := s.Reconcile(strings.NewReader("payment_id,account_id,amount\n"+mobile[0].ID+",1,0.02\n"), "operator.csv", ReconcileOptions{Category: "mobile"})
+	if err != nil || report.Settled != 0 || len(report.Matched) != 1 {
+		t.Errorf("Reconcile(): report = %v, error = %v", report, err)
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = report.WriteCSV(&buffer)
+	if err != nil || !strings.HasPrefix(buffer.String(), "Lines,Matched,Settled,Issues\n1,1,0,3\n\nKind,Line,Payment,Reason\nMATCHED,,"+mobile[0].ID+",\n") {
+		t.Errorf("WriteCSV(): wrong report = %s, error = %v", buffer.String(), err)
+	}
+
+	_, err = s.Reconcile(strings.NewReader("payment_id,account_id\n"), "operator.csv", ReconcileOptions{Category: "mobile"})
+	if !errors.Is(err, ErrInvalidDump) {
+		t.Errorf("Reconcile(): must return ErrInvalidDump for missing column, returned = %v", err)
+	}
+}
+
+func TestService_Reconcile_fees(t *testing.T) {
+	s := newTestService()
+	_, err := s.addRevenueAccount()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.SetFeeRules([]FeeRule{{Category: types.CategoryMobile, Flat: 50}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	settled, _ := s.Pay(account.ID, 10_00, types.CategoryMobile)
+	unsettled, _ := s.Pay(account.ID, 20_00, types.CategoryMobile)
+	statement := "payment_id,amount\n" + settled.ID + ",10.00\n"
+	report, err := s.Reconcile(strings.NewReader(statement), "operator.csv", ReconcileOptions{Category: types.CategoryMobile})
+	if err != nil || report.Settled != 1 {
+		t.Errorf("Reconcile(): report = %v, error = %v", report, err)
+		return
+	}
+
+	for _, payment := range s.payments {
+		expected := types.PaymentStatusInProgress
+		if payment.ID == settled.ID || payment.LinkedID == settled.ID {
+			expected = types.PaymentStatusOk
+		}
+		if payment.Status != expected {
+			t.Errorf("Reconcile(): payment %v, expected status %v, unsettled payment %v", payment, expected, unsettled.ID)
+		}
+	}
+}
+
+func Test_parseMoney(t *testing.T) {
+	tests := map[string]types.Money{"0.02": 2, "12": 12_00, "12.5": 12_50, "-3.10": -3_10, "100.00": 100_00,
+		"92233720368547758.07": math.MaxInt64, "-92233720368547758.07": -math.MaxInt64}
+	for text, expected := range tests {
+		amount, err := parseMoney(text)
+		if err != nil || amount != expected {
+			t.Errorf("parseMoney(%q) = %v, error = %v, expected %v", text, amount, err, expected)
+		}
+	}
+
+	for _, text := range []string{"", "1.", ".5", "1.234", "1,5", "+1", "1.-5", "abc", "92233720368547758.08", "92233720368547759"} {
+		_, err := parseMoney(text)
+		if err == nil {
+			t.Errorf("parseMoney(%q): must fail", text)
+		}
+	}
+}
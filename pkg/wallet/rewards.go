@@ -0,0 +1,251 @@
+package wallet
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidRewardRule error for reward rule without ID, with duplicate ID, negative values or percent over 100%
+var ErrInvalidRewardRule = errors.New("invalid reward rule")
+
+//RewardRule describes the cashback promotion granted for successful payments
+type RewardRule struct {
+	ID         string
+	Category   types.PaymentCategory //empty category matches every payment, subcategories are matched too
+	MinAmount  types.Money
+	Percent    int64 //basis points from 0 to 10 000, 100 is 1%
+	Flat       types.Money
+	MonthlyCap types.Money   //per account and calendar month, zero for no cap
+	Accounts   []int64       //empty list matches every account
+	Delay      time.Duration //time before the reward is credited
+}
+
+//rewardMatches reports whether the rule grants a reward for the payment
+func (s *Service) rewardMatches(rule RewardRule, payment *types.Payment) bool {
+	if payment.Amount < rule.MinAmount {
+		return false
+	}
+
+	if rule.Category != "" && !s.isSubcategory(payment.Category, rule.Category) {
+		return false
+	}
+
+	if len(rule.Accounts) == 0 {
+		return true
+	}
+	for _, accountID := range rule.Accounts {
+		if accountID == payment.AccountID {
+			return true
+		}
+	}
+	return false
+}
+
+//now returns the current time of the service clock
+func (s *Service) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+//stamp returns the time of a change to a record, without the monotonic reading so it survives Export and Import
+func (s *Service) stamp() time.Time {
+	return s.now().Round(0)
+}
+
+//SetRewardRules replaces the rules of the rewards engine
+func (s *Service) SetRewardRules(rules []RewardRule) error {
+	ids := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if rule.ID == "" || ids[rule.ID] || rule.MinAmount < 0 || rule.Percent < 0 || rule.Percent > 10_000 || rule.Flat < 0 || rule.MonthlyCap < 0 || rule.Delay < 0 {
+			return ErrInvalidRewardRule
+		}
+		ids[rule.ID] = true
+
+		if rule.Category != "" {
+			_, err := s.FindCategoryByCode(rule.Category)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	s.rewardRules = append([]RewardRule(nil), rules...)
+	return nil
+}
+
+//RewardRules returns the copy of the rewards engine rules
+func (s *Service) RewardRules() []RewardRule {
+	return append([]RewardRule(nil), s.rewardRules...)
+}
+
+//Rewards returns the copies of all rewards granted to the account
+func (s *Service) Rewards(accountID int64) ([]types.Reward, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	rewards := make([]types.Reward, 0)
+	for _, reward := range s.rewards {
+		if reward.AccountID == accountID {
+			rewards = append(rewards, *reward)
+		}
+	}
+	return rewards, nil
+}
+
+//monthlyRewards sums the rewards of the rule granted to the account in the month of {now}
+func (s *Service) monthlyRewards(ruleID string, accountID int64, now time.Time) types.Money {
+	sum := types.Money(0)
+	for _, reward := range s.rewards {
+		if reward.RuleID != ruleID || reward.AccountID != accountID || reward.Status == types.RewardStatusClawedBack {
+			continue
+		}
+
+		if reward.CreatedAt.Year() == now.Year() && reward.CreatedAt.Month() == now.Month() {
+			sum += reward.Amount
+		}
+	}
+	return sum
+}
+
+//share computes the reward of the rule for {amount}. The amount is split into whole 10 000s and the rest,
+//so multiplying by the percent can't overflow
+func (r RewardRule) share(amount types.Money) types.Money {
+	percent := types.Money(r.Percent)
+	share := amount/10_000*percent + amount%10_000*percent/10_000
+	if share > math.MaxInt64-r.Flat {
+		return math.MaxInt64
+	}
+	return r.Flat + share
+}
+
+//grantRewards computes the rewards of all matching rules for the payment,
+//rewards without delay are credited at once and the rest wait for ReleaseRewards
+func (s *Service) grantRewards(payment *types.Payment, account *types.Account) {
+	now := s.now()
+	for _, rule := range s.rewardRules {
+		if !s.rewardMatches(rule, payment) {
+			continue
+		}
+
+		amount := rule.share(payment.Amount)
+		if rule.MonthlyCap > 0 {
+			left := rule.MonthlyCap - s.monthlyRewards(rule.ID, payment.AccountID, now)
+			if amount > left {
+				amount = left
+			}
+		}
+
+		if amount <= 0 {
+			continue
+		}
+
+		reward := &types.Reward{
+			ID:          uuid.New().String(),
+			RuleID:      rule.ID,
+			AccountID:   payment.AccountID,
+			PaymentID:   payment.ID,
+			Amount:      amount,
+			Status:      types.RewardStatusPending,
+			CreatedAt:   now,
+			AvailableAt: now.Add(rule.Delay),
+		}
+		if rule.Delay == 0 {
+			s.creditReward(reward, account)
+		}
+		s.rewards = append(s.rewards, reward)
+		s.track(rewardKey(reward.ID))
+	}
+}
+
+//creditReward adds the reward to the balance and records it as the reward transaction linked to its payment
+func (s *Service) creditReward(reward *types.Reward, account *types.Account) {
+	account.Balance += reward.Amount
+	account.UpdatedAt = s.stamp()
+	credited := &types.Payment{
+		ID:        reward.ID,
+		AccountID: account.ID,
+		Amount:    reward.Amount,
+		Category:  types.CategoryReward,
+		Status:    types.PaymentStatusOk,
+		LinkedID:  reward.PaymentID,
+		CreatedAt: account.UpdatedAt,
+		UpdatedAt: account.UpdatedAt,
+	}
+	s.payments = append(s.payments, credited)
+	s.track(accountKey(account.ID))
+	s.track(paymentKey(credited.ID))
+	reward.Status = types.RewardStatusCredited
+	s.track(rewardKey(reward.ID))
+}
+
+//ReleaseRewards credits all pending rewards whose delay has passed and returns their count
+func (s *Service) ReleaseRewards() (int, error) {
+	now := s.now()
+	released := 0
+	for _, reward := range s.rewards {
+		if reward.Status != types.RewardStatusPending || reward.AvailableAt.After(now) {
+			continue
+		}
+
+		account, err := s.FindAccountByID(reward.AccountID)
+		if err != nil {
+			return released, err
+		}
+
+		s.creditReward(reward, account)
+		released++
+	}
+	return released, nil
+}
+
+//creditedRewards sums the rewards of the payment added to the balance
+func (s *Service) creditedRewards(payment *types.Payment) types.Money {
+	sum := types.Money(0)
+	for _, reward := range s.rewards {
+		if reward.PaymentID == payment.ID && reward.Status == types.RewardStatusCredited {
+			sum += reward.Amount
+		}
+	}
+	return sum
+}
+
+//clawBackRewards cancels the pending rewards of the payment and takes back the credited ones, failing their
+//reward transactions. The caller checks the balance holds the credited rewards, see creditedRewards
+func (s *Service) clawBackRewards(payment *types.Payment, account *types.Account) {
+	for _, reward := range s.rewards {
+		if reward.PaymentID != payment.ID || reward.Status == types.RewardStatusClawedBack {
+			continue
+		}
+
+		if reward.Status == types.RewardStatusCredited {
+			account.Balance -= reward.Amount
+			account.UpdatedAt = s.stamp()
+			s.track(accountKey(account.ID))
+			credited, err := s.FindPaymentByID(reward.ID)
+			if err == nil && credited.Category == types.CategoryReward {
+				credited.Status = types.PaymentStatusFail
+				credited.UpdatedAt = account.UpdatedAt
+				s.track(paymentKey(credited.ID))
+			}
+		}
+		reward.Status = types.RewardStatusClawedBack
+		s.track(rewardKey(reward.ID))
+	}
+}
+
+//balanceChange returns how the transaction changes the balance of its account:
+//reward transactions add their amount, the rest take it
+func balanceChange(payment *types.Payment) types.Money {
+	if payment.Category == types.CategoryReward && payment.LinkedID != "" {
+		return payment.Amount
+	}
+	return -payment.Amount
+}
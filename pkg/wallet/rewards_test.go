@@ -0,0 +1,380 @@
+package wallet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func (s *testService) setTime(now time.Time) {
+	s.clock = func() time.Time {
+		return now
+	}
+}
+
+func TestService_Pay_rewardMonthlyCap(t *testing.T) {
+	s := newTestService()
+	s.setTime(time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC))
+	account, err := s.addAccountWithBalance("+992000000001", 10_000_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "mobile-5", Category: types.CategoryMobile, Percent: 500, MonthlyCap: 50_00}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 100_00, types.CategoryFood)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = s.Pay(account.ID, 600_00, types.CategoryMobile)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	s.setTime(time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC))
+	_, err = s.Pay(account.ID, 100_00, types.CategoryMobile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rewards, err := s.Rewards(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(rewards) != 3 || rewards[0].Amount != 30_00 || rewards[1].Amount != 20_00 || rewards[2].Amount != 5_00 {
+		t.Errorf("Pay(): wrong rewards granted = %v", rewards)
+		return
+	}
+
+	expected := types.Money(10_000_00 - 100_00 - 2*600_00 - 100_00 + 55_00)
+	if account.Balance != expected {
+		t.Errorf("Pay(): rewards weren't credited, expected: %v, got: %v", expected, account.Balance)
+	}
+}
+
+func TestService_ReleaseRewards(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	s.setTime(now)
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "welcome", Flat: 10_00, Accounts: []int64{account.ID}, Delay: 24 * time.Hour}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 50_00, types.CategoryAuto)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	released, err := s.ReleaseRewards()
+	if err != nil || released != 0 || account.Balance != 50_00 {
+		t.Errorf("ReleaseRewards(): reward released before delay, released = %v, balance = %v, error = %v", released, account.Balance, err)
+		return
+	}
+
+	s.setTime(now.Add(24 * time.Hour))
+	released, err = s.ReleaseRewards()
+	if err != nil || released != 1 || account.Balance != 60_00 {
+		t.Errorf("ReleaseRewards(): reward wasn't released, released = %v, balance = %v, error = %v", released, account.Balance, err)
+	}
+}
+
+func TestService_Reject_clawBackRewards(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 1_000_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetRewardRules([]RewardRule{
+		{ID: "instant", Percent: 1_000},
+		{ID: "delayed", Flat: 5_00, Delay: time.Hour},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 100_00, types.CategoryAuto)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if account.Balance != 1_000_00 {
+		t.Errorf("Reject(): rewards weren't clawed back, balance = %v", account.Balance)
+		return
+	}
+
+	rewards, err := s.Rewards(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, reward := range rewards {
+		if reward.Status != types.RewardStatusClawedBack {
+			t.Errorf("Reject(): reward status didn't change, reward = %v", reward)
+		}
+	}
+
+	credited, err := s.FindPaymentByID(rewards[0].ID)
+	if err != nil || credited.Status != types.PaymentStatusFail {
+		t.Errorf("Reject(): reward transaction wasn't failed, transaction = %v, error = %v", credited, err)
+	}
+	if issues := s.CheckIntegrity(); len(issues) != 0 {
+		t.Errorf("Reject(): integrity issues = %v", issues)
+	}
+}
+
+func TestService_Pay_rewardTransactions(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	s.setTime(now)
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "bonus", Flat: 5_00}, {ID: "delayed", Flat: 2_00, Delay: time.Hour}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 10_00, types.CategoryAuto)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s.setTime(now.Add(time.Hour))
+	_, err = s.ReleaseRewards()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	history, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(history) != 3 || account.Balance != 97_00 {
+		t.Errorf("Pay(): wrong history = %v, balance = %v", history, account.Balance)
+		return
+	}
+	for i, amount := range []types.Money{5_00, 2_00} {
+		credited := history[i+1]
+		if credited.Category != types.CategoryReward || credited.LinkedID != payment.ID || credited.Amount != amount || credited.Status != types.PaymentStatusOk {
+			t.Errorf("Pay(): wrong reward transaction = %v", credited)
+		}
+	}
+	if issues := s.CheckIntegrity(); len(issues) != 0 {
+		t.Errorf("Pay(): integrity issues = %v", issues)
+	}
+}
+
+func TestService_Reject_clawBackSpentRewards(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 1_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "bonus", Category: types.CategoryAuto, Flat: 5_00}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 1_00, types.CategoryAuto)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(account.ID, 5_00, types.CategoryFood) //the cashback is spent
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Reject(): must return ErrNotEnoughBalance, returned = %v", err)
+		return
+	}
+
+	rewards, err := s.Rewards(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if account.Balance != 0 || payment.Status == types.PaymentStatusFail || rewards[0].Status != types.RewardStatusCredited {
+		t.Errorf("Reject(): the payment must be left as it was, balance = %v, payment = %v, rewards = %v", account.Balance, payment, rewards)
+	}
+	if issues := s.CheckIntegrity(); len(issues) != 0 {
+		t.Errorf("Reject(): integrity issues = %v", issues)
+	}
+}
+
+func TestService_SetRewardRules_fail(t *testing.T) {
+	s := newTestService()
+	err := s.SetRewardRules([]RewardRule{{ID: "dup"}, {ID: "dup"}})
+	if err != ErrInvalidRewardRule {
+		t.Errorf("SetRewardRules(): must return ErrInvalidRewardRule, returned = %v", err)
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "all", Percent: 10_001}})
+	if err != ErrInvalidRewardRule {
+		t.Errorf("SetRewardRules(): must refuse percent over 100%%, returned = %v", err)
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "unknown", Category: "unknown"}})
+	if err != ErrCategoryNotFound {
+		t.Errorf("SetRewardRules(): must return ErrCategoryNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Export_rewards(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	s.setTime(now)
+	account, err := s.addAccountWithBalance("+992000000001", 100_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.SetRewardRules([]RewardRule{{ID: "bonus", Flat: 5_00, MonthlyCap: 8_00}, {ID: "delayed", Flat: 2_00, Delay: time.Hour}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 10_00, types.CategoryAuto)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	full := MemoryFS{}
+	err = s.ExportTo(full)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	base := MemoryFS{}
+	checkpoint, err := s.ExportDeltaTo(base, Checkpoint{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var snapshot bytes.Buffer
+	err = s.ExportBinary(&snapshot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imports := map[string]func(imported *testService) error{
+		"text": func(imported *testService) error {
+			_, err := imported.ImportFrom(full, ImportOptions{})
+			return err
+		},
+		"binary": func(imported *testService) error {
+			_, err := imported.ImportBinary(bytes.NewReader(snapshot.Bytes()), ImportOptions{})
+			return err
+		},
+	}
+	for name, restore := range imports {
+		imported := newTestService()
+		imported.setTime(now.Add(time.Hour))
+		_ = imported.SetRewardRules(s.RewardRules())
+		err = restore(imported)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		released, err := imported.ReleaseRewards()
+		restored, _ := imported.FindAccountByID(account.ID)
+		if err != nil || released != 1 || restored.Balance != 97_00 {
+			t.Errorf("%s: the pending reward wasn't restored, released = %v, balance = %v, error = %v", name, released, restored.Balance, err)
+			continue
+		}
+
+		_, err = imported.Pay(account.ID, 10_00, types.CategoryAuto)
+		rewards, _ := imported.Rewards(account.ID)
+		if err != nil || len(rewards) != 4 || rewards[2].Amount != 3_00 {
+			t.Errorf("%s: the monthly cap wasn't restored, rewards = %v, error = %v", name, rewards, err)
+			continue
+		}
+
+		err = imported.Reject(payment.ID)
+		if err != nil || restored.Balance != 93_00 {
+			t.Errorf("%s: the credited rewards weren't clawed back, balance = %v, error = %v", name, restored.Balance, err)
+		}
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	delta := MemoryFS{}
+	_, err = s.ExportDeltaTo(delta, checkpoint)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	_, err = imported.ImportChainFrom([]DumpFS{base, delta}, ImportOptions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rewards, err := imported.Rewards(account.ID)
+	if err != nil || len(rewards) != 2 || rewards[0].Status != types.RewardStatusClawedBack || rewards[1].Status != types.RewardStatusClawedBack {
+		t.Errorf("ImportChainFrom(): the clawed back rewards weren't restored, rewards = %v, error = %v", rewards, err)
+	}
+}
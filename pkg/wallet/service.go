@@ -1,14 +1,11 @@
 package wallet
 
 import (
+	"context"
 	"errors"
-	"io"
-	"io/ioutil"
 	"log"
-	"os"
-	"strconv"
-	"strings"
-	"sync"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sekaiichi/temproray_wallet/pkg/types"
@@ -29,15 +26,41 @@ var ErrNotEnoughBalance = errors.New("not enough balance")
 //ErrPaymentNotFound error for inexistent payment
 var ErrPaymentNotFound = errors.New("payment not found")
 
+//ErrPaymentRejected error for rejecting a payment that is already rejected
+var ErrPaymentRejected = errors.New("payment already rejected")
+
 //ErrFavoriteNotFound error for inexistent payment
 var ErrFavoriteNotFound = errors.New("favorite not found")
 
+//ErrFavoriteAccessDenied error for favorite that belongs to another account
+var ErrFavoriteAccessDenied = errors.New("favorite belongs to another account")
+
+//ErrInvalidFavoriteOrder error for order that doesn't list every favorite of the account exactly once
+var ErrInvalidFavoriteOrder = errors.New("invalid favorites order")
+
 //Service holds the slices of all the payments and all user accounts
 type Service struct {
 	nextAccountID int64
 	accounts      []*types.Account
 	payments      []*types.Payment
 	favorites     []*types.Favorite
+	categories    []*types.Category
+
+	feeRules         []FeeRule
+	revenueAccountID int64
+
+	rewardRules []RewardRule
+	rewards     []*types.Reward
+	clock       func() time.Time
+
+	vouchers []*types.Voucher
+
+	keys KeyProvider
+
+	changes changeLog
+
+	balanceLog      []balanceEntry
+	balanceLogSince time.Time //the balances were imported then, the log misses the changes made before
 }
 
 //RegisterAccount method searches for an existing phone number, and if none found - creates an account
@@ -49,18 +72,26 @@ func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
 	}
 	s.nextAccountID++
 	account := &types.Account{
-		ID:      s.nextAccountID,
-		Phone:   phone,
-		Balance: 0,
+		ID:        s.nextAccountID,
+		Phone:     phone,
+		Balance:   0,
+		UpdatedAt: s.stamp(),
 	}
 
 	s.accounts = append(s.accounts, account)
+	s.track(accountKey(account.ID))
 
 	return account, nil
 }
 
 //Deposit method increases the account balance by amount
 func (s *Service) Deposit(accountID int64, amount types.Money) error {
+	return s.deposit(balanceEntry{kind: StatementDeposit, accountID: accountID, amount: amount})
+}
+
+//deposit increases the balance of {entry.accountID} by {entry.amount} and logs the entry for statements
+func (s *Service) deposit(entry balanceEntry) error {
+	accountID, amount := entry.accountID, entry.amount
 	if amount <= 0 {
 		return ErrAmountMustBePositive
 	}
@@ -78,6 +109,10 @@ func (s *Service) Deposit(accountID int64, amount types.Money) error {
 	}
 
 	account.Balance += amount
+	account.UpdatedAt = s.stamp()
+	s.track(accountKey(account.ID))
+	entry.at = account.UpdatedAt
+	s.logBalance(entry)
 	return nil
 }
 
@@ -87,6 +122,11 @@ func (s *Service) Pay(accountID int64, amount types.Money, category types.Paymen
 		return nil, ErrAmountMustBePositive
 	}
 
+	err := s.checkCategory(category, amount)
+	if err != nil {
+		return nil, err
+	}
+
 	var account *types.Account
 	for _, acc := range s.accounts {
 		if acc.ID == accountID {
@@ -99,11 +139,21 @@ func (s *Service) Pay(accountID int64, amount types.Money, category types.Paymen
 		return nil, ErrAccountNotFound
 	}
 
-	if account.Balance < amount {
+	fee := s.CalculateFee(amount, category)
+	var revenue *types.Account
+	if fee > 0 {
+		revenue, err = s.revenueAccount()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if account.Balance < amount || account.Balance-amount < fee {
 		return nil, ErrNotEnoughBalance
 	}
 
-	account.Balance -= amount
+	account.Balance -= amount + fee
+	account.UpdatedAt = s.stamp()
 	paymentID := uuid.New().String()
 	payment := &types.Payment{
 		ID:        paymentID,
@@ -111,9 +161,17 @@ func (s *Service) Pay(accountID int64, amount types.Money, category types.Paymen
 		Amount:    amount,
 		Category:  category,
 		Status:    types.PaymentStatusInProgress,
+		CreatedAt: account.UpdatedAt,
+		UpdatedAt: account.UpdatedAt,
 	}
 
 	s.payments = append(s.payments, payment)
+	s.track(accountKey(account.ID))
+	s.track(paymentKey(payment.ID))
+	if fee > 0 {
+		s.chargeFee(payment, fee, revenue)
+	}
+	s.grantRewards(payment, account)
 	return payment, nil
 }
 
@@ -133,20 +191,44 @@ func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
 	return account, nil
 }
 
-//Reject rejects the payment
+//Reject rejects the payment, refunds its fee and claws back its rewards. It fails with ErrNotEnoughBalance
+//if the balance, with the payment and its fees refunded, can't pay back the rewards already credited,
+//and with ErrNotEnoughRevenue if the revenue account can't refund the fees
 func (s *Service) Reject(paymentID string) error {
 	payment, err := s.FindPaymentByID(paymentID)
 	if err != nil {
 		return err
 	}
 
+	if payment.LinkedID != "" {
+		return ErrLinkedPayment
+	}
+
+	if payment.Status == types.PaymentStatusFail {
+		return ErrPaymentRejected
+	}
+
 	account, err := s.FindAccountByID(payment.AccountID)
 	if err != nil {
 		return err
 	}
 
+	if account.Balance+payment.Amount+s.paidFees(payment) < s.creditedRewards(payment) {
+		return ErrNotEnoughBalance
+	}
+
+	err = s.refundFees(payment, payment.Amount, account)
+	if err != nil {
+		return err
+	}
+
 	payment.Status = types.PaymentStatusFail
 	account.Balance += payment.Amount
+	payment.UpdatedAt = s.stamp()
+	account.UpdatedAt = payment.UpdatedAt
+	s.track(paymentKey(payment.ID))
+	s.track(accountKey(account.ID))
+	s.clawBackRewards(payment, account)
 	return nil
 }
 
@@ -167,6 +249,10 @@ func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
 		return nil, err
 	}
 
+	if payment.LinkedID != "" {
+		return nil, ErrLinkedPayment
+	}
+
 	account, err := s.FindAccountByID(payment.AccountID)
 	if err != nil {
 		return nil, err
@@ -191,15 +277,22 @@ func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorit
 		return nil, err
 	}
 
+	if payment.LinkedID != "" {
+		return nil, ErrLinkedPayment
+	}
+
 	favorite := &types.Favorite{
 		ID:        uuid.New().String(),
 		AccountID: payment.AccountID,
 		Name:      name,
 		Amount:    payment.Amount,
 		Category:  payment.Category,
+		Position:  len(s.accountFavorites(payment.AccountID)),
+		UpdatedAt: s.stamp(),
 	}
 
 	s.favorites = append(s.favorites, favorite)
+	s.track(favoriteKey(favorite.ID))
 	return favorite, nil
 }
 
@@ -236,348 +329,165 @@ func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
 	return payment, nil
 }
 
-//ExportToFile writes the data into a file
-func (s *Service) ExportToFile(path string) error {
-	records := make([]byte, 0)
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+//accountFavorites returns the favorites of an account sorted by their position
+func (s *Service) accountFavorites(accountID int64) []*types.Favorite {
+	favorites := make([]*types.Favorite, 0)
+	for _, favorite := range s.favorites {
+		if favorite.AccountID == accountID {
+			favorites = append(favorites, favorite)
+		}
 	}
 
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Print(cerr)
-		}
-	}()
+	sort.SliceStable(favorites, func(i, j int) bool {
+		return favorites[i].Position < favorites[j].Position
+	})
+	return favorites
+}
 
-	for _, account := range s.accounts {
-		buffer := make([]byte, 0)
-		buffer = strconv.AppendInt(buffer, account.ID, 10)
-		buffer = append(buffer, ";"...)
-		buffer = append(buffer, string(account.Phone)...)
-		buffer = append(buffer, ";"...)
-		buffer = strconv.AppendInt(buffer, int64(account.Balance), 10)
-		buffer = append(buffer, "|"...)
-		records = append(records, buffer...)
+//findAccountFavorite returns the favorite only if it belongs to the given account
+func (s *Service) findAccountFavorite(accountID int64, favoriteID string) (*types.Favorite, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
 	}
 
-	_, werr := file.Write(records)
+	favorite, err := s.FindFavoriteByID(favoriteID)
 	if err != nil {
-		log.Print(werr)
-		return werr
+		return nil, err
 	}
-	return nil
+
+	if favorite.AccountID != accountID {
+		return nil, ErrFavoriteAccessDenied
+	}
+	return favorite, nil
 }
 
-//ImportFromFile writes the data into a file
-func (s *Service) ImportFromFile(path string) error {
-	file, err := os.Open(path)
+//ListFavorites returns the copies of all favorites of an account in their order
+func (s *Service) ListFavorites(accountID int64) ([]types.Favorite, error) {
+	_, err := s.FindAccountByID(accountID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Print(cerr)
-		}
-	}()
-
-	content := make([]byte, 0)
-	buffer := make([]byte, 4)
-	for {
-		read, err := file.Read(buffer)
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			return err
-		}
-
-		content = append(content, buffer[:read]...)
+	favorites := make([]types.Favorite, 0)
+	for _, favorite := range s.accountFavorites(accountID) {
+		favorites = append(favorites, *favorite)
 	}
+	return favorites, nil
+}
 
-	data := string(content)
-	records := strings.Split(data, "|")
-
-	if records[len(records)-1] == "" {
-		records = records[:len(records)-1] //truncate if the last item after splitting by "|" is empty
+//RenameFavorite changes the name of the account's favorite
+func (s *Service) RenameFavorite(accountID int64, favoriteID string, name string) (*types.Favorite, error) {
+	favorite, err := s.findAccountFavorite(accountID, favoriteID)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, record := range records {
-		fields := strings.Split(record, ";")
-
-		id, _ := strconv.Atoi(fields[0])
-		phone := types.Phone(fields[1])
-		balance, _ := strconv.Atoi(fields[2])
-
-		account := &types.Account{
-			ID:      int64(id),
-			Phone:   phone,
-			Balance: types.Money(balance),
-		}
-		s.accounts = append(s.accounts, account)
-	}
-	return nil
+	favorite.Name = name
+	favorite.UpdatedAt = s.stamp()
+	s.track(favoriteKey(favorite.ID))
+	return favorite, nil
 }
 
-//Export method exports the data into corresponding dump files
-func (s *Service) Export(dir string) error {
-
-	_, werr := os.Stat(dir)
-	if os.IsNotExist(werr) {
-		werr = os.Mkdir(dir, 0777)
-	}
-	if werr != nil {
-		return werr
+//UpdateFavoriteAmount changes the amount paid from the account's favorite
+func (s *Service) UpdateFavoriteAmount(accountID int64, favoriteID string, amount types.Money) (*types.Favorite, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
 	}
 
-	if len(s.accounts) != 0 {
-		buffer := make([]byte, 0)
-		for _, account := range s.accounts {
-			buffer = strconv.AppendInt(buffer, account.ID, 10)
-			buffer = append(buffer, ';')
-			buffer = append(buffer, account.Phone...)
-			buffer = append(buffer, ';')
-			buffer = strconv.AppendInt(buffer, int64(account.Balance), 10)
-			buffer = append(buffer, '\n')
-		}
-
-		werr = ioutil.WriteFile(dir+"/accounts.dump", buffer, 0777)
-		if werr != nil {
-			return werr
-		}
+	favorite, err := s.findAccountFavorite(accountID, favoriteID)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(s.payments) != 0 {
-		buffer := make([]byte, 0)
-		for _, payment := range s.payments {
-			buffer = append(buffer, payment.ID...)
-			buffer = append(buffer, ';')
-			buffer = strconv.AppendInt(buffer, payment.AccountID, 10)
-			buffer = append(buffer, ';')
-			buffer = strconv.AppendInt(buffer, int64(payment.Amount), 10)
-			buffer = append(buffer, ';')
-			buffer = append(buffer, payment.Category...)
-			buffer = append(buffer, ';')
-			buffer = append(buffer, payment.Status...)
-			buffer = append(buffer, '\n')
-		}
+	favorite.Amount = amount
+	favorite.UpdatedAt = s.stamp()
+	s.track(favoriteKey(favorite.ID))
+	return favorite, nil
+}
 
-		werr = ioutil.WriteFile(dir+"/payments.dump", buffer, 0777)
-		if werr != nil {
-			return werr
-		}
+//DeleteFavorite removes the account's favorite and closes the gap in the positions of the rest
+func (s *Service) DeleteFavorite(accountID int64, favoriteID string) error {
+	favorite, err := s.findAccountFavorite(accountID, favoriteID)
+	if err != nil {
+		return err
 	}
 
-	if len(s.favorites) != 0 {
-		buffer := make([]byte, 0)
-		for _, favorite := range s.favorites {
-			buffer = append(buffer, favorite.ID...)
-			buffer = append(buffer, ';')
-			buffer = strconv.AppendInt(buffer, favorite.AccountID, 10)
-			buffer = append(buffer, ';')
-			buffer = append(buffer, favorite.Name...)
-			buffer = append(buffer, ';')
-			buffer = strconv.AppendInt(buffer, int64(favorite.Amount), 10)
-			buffer = append(buffer, ';')
-			buffer = append(buffer, favorite.Category...)
-			buffer = append(buffer, '\n')
+	for i, fav := range s.favorites {
+		if fav == favorite {
+			s.favorites = append(s.favorites[:i], s.favorites[i+1:]...)
+			s.trackRemoval(favoriteKey(favorite.ID))
+			break
 		}
+	}
 
-		werr = ioutil.WriteFile(dir+"/favorites.dump", buffer, 0777)
-		if werr != nil {
-			return werr
+	for i, fav := range s.accountFavorites(accountID) {
+		if fav.Position != i {
+			fav.Position = i
+			fav.UpdatedAt = s.stamp()
+			s.track(favoriteKey(fav.ID))
 		}
 	}
 	return nil
 }
 
-//Import method imports the data from specified directory
-func (s *Service) Import(dir string) error {
-	accountsExist := false
-	paymentsExist := false
-	favoritesExist := false
-
-	_, rerr := os.Stat(dir)
-	if rerr != nil {
-		return rerr
-	}
-
-	folder, rerr := os.Open(dir + "/.")
-	if rerr != nil {
-		return rerr
+//ReorderFavorites sets the order of the account's favorites, {favoriteIDs} must list each of them exactly once
+func (s *Service) ReorderFavorites(accountID int64, favoriteIDs []string) error {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return err
 	}
-	defer folder.Close()
 
-	list, rerr := folder.Readdirnames(0) // 0 to read all files and folders
-	if rerr != nil {
-		return rerr
+	favorites := s.accountFavorites(accountID)
+	if len(favoriteIDs) != len(favorites) {
+		return ErrInvalidFavoriteOrder
 	}
 
-	for _, name := range list {
-		if name == "accounts.dump" {
-			accountsExist = true
-		}
-		if name == "payments.dump" {
-			paymentsExist = true
-		}
-		if name == "favorites.dump" {
-			favoritesExist = true
+	positions := make(map[string]int, len(favoriteIDs))
+	for i, favoriteID := range favoriteIDs {
+		if _, ok := positions[favoriteID]; ok {
+			return ErrInvalidFavoriteOrder
 		}
+		positions[favoriteID] = i
 	}
 
-	if accountsExist {
-		content := make([]byte, 0)
-		content, rerr = ioutil.ReadFile(dir + "/accounts.dump")
-		if rerr != nil {
-			return rerr
+	for _, favorite := range favorites {
+		if _, ok := positions[favorite.ID]; !ok {
+			return ErrInvalidFavoriteOrder
 		}
-
-		data := string(content)
-		records := strings.Split(data, "\n")
-
-		if records[len(records)-1] == "" {
-			records = records[:len(records)-1] //truncate if the last record after splitting by "\n" is empty
-		}
-
-		for _, record := range records {
-			fields := strings.Split(record, ";")
-
-			accountID, _ := strconv.Atoi(fields[0])
-			accountPhone := types.Phone(fields[1])
-			accountBalance, _ := strconv.Atoi(fields[2])
-
-			var account *types.Account
-			for _, acc := range s.accounts {
-				if acc.ID == int64(accountID) {
-					account = acc
-					break
-				}
-			}
-
-			if account == nil {
-				newAccount := &types.Account{
-					ID:      int64(accountID),
-					Phone:   accountPhone,
-					Balance: types.Money(accountBalance),
-				}
-				s.accounts = append(s.accounts, newAccount)
-			} else {
-				account.Phone = accountPhone
-				account.Balance = types.Money(accountBalance)
-			}
-		}
-
-		var max = int64(0)
-		for _, acc := range s.accounts {
-			if acc.ID > max {
-				max = acc.ID
-			}
-		}
-		s.nextAccountID = max
 	}
 
-	if paymentsExist {
-		content := make([]byte, 0)
-		content, rerr = ioutil.ReadFile(dir + "/payments.dump")
-		if rerr != nil {
-			return rerr
-		}
-
-		data := string(content)
-		records := strings.Split(data, "\n")
-
-		if records[len(records)-1] == "" {
-			records = records[:len(records)-1] //truncate if the last record after splitting by "\n" is empty
-		}
-
-		for _, record := range records {
-			fields := strings.Split(record, ";")
-
-			paymentID := fields[0]
-			paymentAccountID, _ := strconv.Atoi(fields[1])
-			paymentAmount, _ := strconv.Atoi(fields[2])
-			paymentCategory := fields[3]
-			paymentStatus := fields[4]
-
-			var payment *types.Payment
-			for _, paymentIterator := range s.payments {
-				if paymentIterator.ID == paymentID {
-					payment = paymentIterator
-					break
-				}
-			}
-
-			if payment == nil {
-				newPayment := &types.Payment{
-					ID:        paymentID,
-					AccountID: int64(paymentAccountID),
-					Amount:    types.Money(paymentAmount),
-					Category:  types.PaymentCategory(paymentCategory),
-					Status:    types.PaymentStatus(paymentStatus),
-				}
-				s.payments = append(s.payments, newPayment)
-			} else {
-				payment.AccountID = int64(paymentAccountID)
-				payment.Amount = types.Money(paymentAmount)
-				payment.Category = types.PaymentCategory(paymentCategory)
-				payment.Status = types.PaymentStatus(paymentStatus)
-			}
+	for _, favorite := range favorites {
+		if favorite.Position != positions[favorite.ID] {
+			favorite.Position = positions[favorite.ID]
+			favorite.UpdatedAt = s.stamp()
+			s.track(favoriteKey(favorite.ID))
 		}
 	}
+	return nil
+}
 
-	if favoritesExist {
-		content := make([]byte, 0)
-		content, rerr = ioutil.ReadFile(dir + "/favorites.dump")
-		if rerr != nil {
-			return rerr
-		}
-
-		data := string(content)
-		records := strings.Split(data, "\n")
-
-		if records[len(records)-1] == "" {
-			records = records[:len(records)-1] //truncate if the last record after splitting by "\n" is empty
-		}
-
-		for _, record := range records {
-			fields := strings.Split(record, ";")
-
-			favoriteID := fields[0]
-			favoriteAccountID, _ := strconv.Atoi(fields[1])
-			favoriteName := fields[2]
-			favoriteAmount, _ := strconv.Atoi(fields[3])
-			favoriteCategory := fields[4]
-
-			var favorite *types.Favorite
-			for _, fav := range s.favorites {
-				if fav.ID == favoriteID {
-					favorite = fav
-					break
-				}
-			}
-
-			if favorite == nil {
-				newFavorite := &types.Favorite{
-					ID:        favoriteID,
-					AccountID: int64(favoriteAccountID),
-					Name:      favoriteName,
-					Amount:    types.Money(favoriteAmount),
-					Category:  types.PaymentCategory(favoriteCategory),
-				}
-				s.favorites = append(s.favorites, newFavorite)
-			} else {
-				favorite.AccountID = int64(favoriteAccountID)
-				favorite.Name = favoriteName
-				favorite.Amount = types.Money(favoriteAmount)
-				favorite.Category = types.PaymentCategory(favoriteCategory)
-			}
-		}
+//ExportToFile writes the accounts into a file, replacing it atomically
+func (s *Service) ExportToFile(path string) error {
+	werr := createFileAtomic(path, s.sealFile(s.WriteAccounts))
+	if werr != nil {
+		log.Print(werr)
+		return werr
 	}
 	return nil
 }
 
+//Export method exports the data into corresponding dump files. Each file is streamed and replaced atomically,
+//the manifest with the number of records and checksum of every dump is written last
+func (s *Service) Export(dir string) error {
+	werr := makeDumpDir(dir)
+	if werr != nil {
+		return werr
+	}
+
+	return s.ExportTo(s.dumpFS(dir))
+}
+
 //ExportAccountHistory method copies all payments of a given accountID into a new slice
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
 	payments := make([]types.Payment, 0)
@@ -596,204 +506,60 @@ func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error)
 	return payments, nil
 }
 
-//HistoryToFiles method exports given payments slice into a {payments[n].dump} files in {dir} directory, each containing {records} items
+//HistoryToFiles method exports given payments slice into a {payments[n].dump} files in {dir} directory, each containing {records} items,
+//and lists the files in payments-index.dump, see WriteHistory
 func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
-
-	_, werr := os.Stat(dir)
-	if os.IsNotExist(werr) {
-		werr = os.Mkdir(dir, 0777)
+	if records <= 0 {
+		return ErrInvalidPageSize
 	}
+
+	werr := makeDumpDir(dir)
 	if werr != nil {
 		return werr
 	}
 
-	buffer := make([]byte, 0)
-
-	for i, payment := range payments {
-
-		buffer = append(buffer, payment.ID...)
-		buffer = append(buffer, ';')
-		buffer = strconv.AppendInt(buffer, payment.AccountID, 10)
-		buffer = append(buffer, ';')
-		buffer = strconv.AppendInt(buffer, int64(payment.Amount), 10)
-		buffer = append(buffer, ';')
-		buffer = append(buffer, payment.Category...)
-		buffer = append(buffer, ';')
-		buffer = append(buffer, payment.Status...)
-		buffer = append(buffer, '\n')
-
-		if len(payments) <= records {
-			file := dir + "/payments.dump"
-			werr := ioutil.WriteFile(file, buffer, 0777)
-			if werr != nil {
-				return werr
-			}
-		} else if (i+1)%records == 0 || i == len(payments)-1 {
-			file := dir + "/payments" + strconv.Itoa((i/records)+1) + ".dump"
-			werr := ioutil.WriteFile(file, buffer, 0777)
-			if werr != nil {
-				return werr
-			}
-			buffer = nil
-		}
-	}
-	return nil
+	return s.HistoryTo(s.dumpFS(dir), payments, records)
 }
 
-//SumPayments method sums up the payments using goroutines and returns
+//SumPayments method sums up the payments using goroutines and returns. The fee and reward transactions linked
+//to payments aren't summed, like in every query of the payments unless it includes them, see PaymentQuery.Linked
 func (s *Service) SumPayments(goroutines int) types.Money {
-
-	if goroutines < 1 {
-		goroutines = 1
-	}
-
-	paysPerRoutine := (len(s.payments) / goroutines) + 1
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	sum := types.Money(0)
-
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-		partialSum := types.Money(0)
-
-		go func(iteration int) {
-			defer wg.Done()
-			lowerEnd := iteration * paysPerRoutine
-			higherEnd := (iteration * paysPerRoutine) + paysPerRoutine
-			for j := lowerEnd; j < higherEnd; j++ {
-				if j > len(s.payments)-1 {
-					break
-				} //break if out of range
-				partialSum += s.payments[j].Amount
-			}
-			mu.Lock()
-			defer mu.Unlock()
-			sum += partialSum
-		}(i)
-	}
-	wg.Wait()
+	sum, _ := s.SumPaymentsContext(context.Background(), goroutines)
 	return sum
 }
 
-//FilterPayments method returns the slice of payments from {accountID}, using {goroutines} number of threads
+//FilterPayments method returns the slice of payments from {accountID}, using {goroutines} number of threads,
+//without the linked transactions, see SumPayments
 func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
-	_, err := s.FindAccountByID(accountID)
-	if err != nil {
-		return nil, err
-	}
-
-	if goroutines < 1 {
-		goroutines = 1
-	}
-
-	paysPerRoutine := (len(s.payments) / goroutines) + 1
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	payments := make([]types.Payment, 0)
-
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-		partialPayments := make([]types.Payment, 0)
-
-		go func(iteration int) {
-			defer wg.Done()
-			lowerEnd := iteration * paysPerRoutine
-			higherEnd := (iteration * paysPerRoutine) + paysPerRoutine
-			for j := lowerEnd; j < higherEnd; j++ {
-				if j > len(s.payments)-1 {
-					break
-				} //break if out of range
-				if s.payments[j].AccountID == accountID {
-					partialPayments = append(partialPayments, *s.payments[j])
-				}
-			}
-			mu.Lock()
-			defer mu.Unlock()
-			payments = append(payments, partialPayments...)
-		}(i)
-	}
-	wg.Wait()
-	return payments, nil
+	return s.FilterPaymentsContext(context.Background(), accountID, goroutines)
 }
 
-//FilterPaymentsByFn method filters payments by passed function using goroutines
+//FilterPaymentsByFn method filters payments by passed function using goroutines, the linked transactions
+//aren't passed to it, see SumPayments
 func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
-
-	if goroutines < 1 {
-		goroutines = 1
-	}
-
-	paysPerRoutine := (len(s.payments) / goroutines) + 1
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	payments := make([]types.Payment, 0)
-
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-		partialPayments := make([]types.Payment, 0)
-
-		go func(iteration int) {
-			defer wg.Done()
-			lowerEnd := iteration * paysPerRoutine
-			higherEnd := (iteration * paysPerRoutine) + paysPerRoutine
-			for j := lowerEnd; j < higherEnd; j++ {
-				if j > len(s.payments)-1 {
-					break
-				} //break if out of range
-				if filter(*s.payments[j]) {
-					partialPayments = append(partialPayments, *s.payments[j])
-				}
-			}
-			mu.Lock()
-			defer mu.Unlock()
-			payments = append(payments, partialPayments...)
-		}(i)
-	}
-	wg.Wait()
-	return payments, nil
+	return s.FilterPaymentsByFnContext(context.Background(), filter, goroutines)
 }
 
 //FilterMobile checks if payment's category is "mobile"
+//
+//Deprecated: use the registry aware Service.CategoryFilter(types.CategoryMobile), which also matches subcategories
 func FilterMobile(payment types.Payment) bool {
-	return payment.Category == "mobile"
+	return payment.Category == types.CategoryMobile
 }
 
 //Progress type holds the information about partial sums of big batches of payments. It's being used only in SumPaymentsByProgress method
 type Progress struct {
-	Part   int
-	Result types.Money
+	Part      int         //index of the batch, -1 in the last progress of a cancelled sum, which has no batch
+	Result    types.Money //sum of the batch
+	Count     int         //payments in the batch
+	Processed int         //payments in the batches sent so far, this one included
+	Total     types.Money //sum of the batches sent so far, this one included
+	Percent   float64     //processed payments of all of them, 100 in the last progress
+	Err       error       //set in the last progress when the context is done before every batch is sent
 }
 
-//SumPaymentsWithProgress method utilizes channels transfering data between functions to calculate the partial sums of big equal chunks of payments
+//SumPaymentsWithProgress method sums up the payments in batches of 100 000 in the background, returning at once
+//the channel of the progress of every batch, see SumPaymentsWithProgressOptions
 func (s *Service) SumPaymentsWithProgress() <-chan Progress {
-	batchSize := 100_000
-	routines := 1 + len(s.payments) / batchSize
-
-	wg := sync.WaitGroup{}
-	progressChannel := make(chan Progress, routines)
-	defer close(progressChannel)
-
-	for i := 0; i < routines; i++ {
-		wg.Add(1)
-		batchStart := i * batchSize
-		batchEnd := (1 + i) * batchSize
-		if batchEnd > len(s.payments) {
-			batchEnd = len(s.payments)
-		}
-		subtotal := make(chan types.Money)
-		go func(sub chan<- types.Money, payments []*types.Payment) {
-			defer wg.Done()
-			sum := types.Money(0)
-			for _, pay := range payments {
-				sum += pay.Amount
-			}
-			sub <- sum
-		}(subtotal, s.payments[batchStart:batchEnd])
-		progressChannel <- Progress{Part: i, Result: <-subtotal}
-	}
-	wg.Wait()
-	return progressChannel
-}
\ No newline at end of file
+	return s.SumPaymentsWithProgressContext(context.Background())
+}
@@ -2,6 +2,10 @@ package wallet
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -10,6 +14,21 @@ import (
 	"github.com/sekaiichi/temproray_wallet/pkg/types"
 )
 
+//testDir holds the files the export tests write for the import tests
+var testDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	testDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 type testService struct {
 	*Service
 }
@@ -205,6 +224,35 @@ func TestService_Reject_success(t *testing.T) {
 	}
 }
 
+func TestService_Reject_twice(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 1000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 500, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Errorf("Reject(): error = %v", err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != ErrPaymentRejected {
+		t.Errorf("Reject(): must return ErrPaymentRejected, returned = %v", err)
+	}
+	if account.Balance != 1000 {
+		t.Errorf("Reject(): refunded twice, balance = %v", account.Balance)
+	}
+}
+
 func TestService_Repeat_success(t *testing.T) {
 	s := newTestService()
 	_, payments, err := s.addAccount(defaultTestAccount)
@@ -313,6 +361,264 @@ func TestService_PayFromFavorite_fail(t *testing.T) {
 	}
 }
 
+func (s *testService) addFavorites(names ...string) (*types.Account, []*types.Favorite, error) {
+	account, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	favorites := make([]*types.Favorite, len(names))
+	for i, name := range names {
+		favorites[i], err = s.FavoritePayment(payments[0].ID, name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't add favorite, error = %v", err)
+		}
+	}
+	return account, favorites, nil
+}
+
+func TestService_ListFavorites_success(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first", "second")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := s.addAccountWithBalance("+992000000002", 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.ListFavorites(account.ID)
+	if err != nil {
+		t.Errorf("ListFavorites(): error = %v", err)
+		return
+	}
+
+	if len(got) != 2 || got[0].ID != favorites[0].ID || got[1].ID != favorites[1].ID {
+		t.Errorf("ListFavorites(): wrong favorites returned = %v", got)
+		return
+	}
+
+	got, err = s.ListFavorites(other.ID)
+	if err != nil || len(got) != 0 {
+		t.Errorf("ListFavorites(): must return no favorites, returned = %v, error = %v", got, err)
+		return
+	}
+}
+
+func TestService_ListFavorites_notFound(t *testing.T) {
+	s := newTestService()
+	_, err := s.ListFavorites(1)
+	if err != ErrAccountNotFound {
+		t.Errorf("ListFavorites(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_RenameFavorite_success(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.RenameFavorite(account.ID, favorites[0].ID, "renamed")
+	if err != nil {
+		t.Errorf("RenameFavorite(): error = %v", err)
+		return
+	}
+
+	if favorites[0].Name != "renamed" {
+		t.Errorf("RenameFavorite(): name didn't change, favorite = %v", favorites[0])
+	}
+}
+
+func TestService_RenameFavorite_accessDenied(t *testing.T) {
+	s := newTestService()
+	_, favorites, err := s.addFavorites("first")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := s.addAccountWithBalance("+992000000002", 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.RenameFavorite(other.ID, favorites[0].ID, "stolen")
+	if err != ErrFavoriteAccessDenied {
+		t.Errorf("RenameFavorite(): must return ErrFavoriteAccessDenied, returned = %v", err)
+		return
+	}
+
+	if favorites[0].Name != "first" {
+		t.Errorf("RenameFavorite(): name of another account's favorite changed, favorite = %v", favorites[0])
+	}
+}
+
+func TestService_UpdateFavoriteAmount(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.UpdateFavoriteAmount(account.ID, favorites[0].ID, 0)
+	if err != ErrAmountMustBePositive {
+		t.Errorf("UpdateFavoriteAmount(): must return ErrAmountMustBePositive, returned = %v", err)
+		return
+	}
+
+	_, err = s.UpdateFavoriteAmount(account.ID, favorites[0].ID, 500_00)
+	if err != nil {
+		t.Errorf("UpdateFavoriteAmount(): error = %v", err)
+		return
+	}
+
+	payment, err := s.PayFromFavorite(favorites[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if payment.Amount != 500_00 {
+		t.Errorf("UpdateFavoriteAmount(): payment made with old amount, payment = %v", payment)
+	}
+}
+
+func TestService_DeleteFavorite(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first", "second", "third")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.DeleteFavorite(account.ID, favorites[0].ID)
+	if err != nil {
+		t.Errorf("DeleteFavorite(): error = %v", err)
+		return
+	}
+
+	_, err = s.FindFavoriteByID(favorites[0].ID)
+	if err != ErrFavoriteNotFound {
+		t.Errorf("DeleteFavorite(): favorite wasn't deleted, error = %v", err)
+		return
+	}
+
+	if favorites[1].Position != 0 || favorites[2].Position != 1 {
+		t.Errorf("DeleteFavorite(): positions weren't compacted, favorites = %v, %v", favorites[1], favorites[2])
+	}
+}
+
+func TestService_ReorderFavorites_success(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first", "second", "third")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.ReorderFavorites(account.ID, []string{favorites[2].ID, favorites[0].ID, favorites[1].ID})
+	if err != nil {
+		t.Errorf("ReorderFavorites(): error = %v", err)
+		return
+	}
+
+	got, err := s.ListFavorites(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if got[0].Name != "third" || got[1].Name != "first" || got[2].Name != "second" {
+		t.Errorf("ReorderFavorites(): wrong order = %v", got)
+	}
+}
+
+func TestService_ReorderFavorites_fail(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first", "second")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	orders := [][]string{
+		{favorites[0].ID},
+		{favorites[0].ID, favorites[0].ID},
+		{favorites[0].ID, uuid.New().String()},
+	}
+	for _, order := range orders {
+		err = s.ReorderFavorites(account.ID, order)
+		if err != ErrInvalidFavoriteOrder {
+			t.Errorf("ReorderFavorites(%v): must return ErrInvalidFavoriteOrder, returned = %v", order, err)
+		}
+	}
+
+	if favorites[0].Position != 0 || favorites[1].Position != 1 {
+		t.Errorf("ReorderFavorites(): positions changed after failure, favorites = %v, %v", favorites[0], favorites[1])
+	}
+}
+
+func TestService_ExportImport_favorites(t *testing.T) {
+	s := newTestService()
+	account, favorites, err := s.addFavorites("first", "second", "third")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.DeleteFavorite(account.ID, favorites[1].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.ReorderFavorites(account.ID, []string{favorites[2].ID, favorites[0].ID})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.RenameFavorite(account.ID, favorites[2].ID, "renamed")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want, _ := s.ListFavorites(account.ID)
+	got, err := imported.ListFavorites(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Import(): favorites don't match, want = %v, got = %v", want, got)
+	}
+}
+
 func TestService_ExportToFile(t *testing.T) {
 	s := newTestService()
 	_, err := s.RegisterAccount("+992000000001")
@@ -333,7 +639,7 @@ func TestService_ExportToFile(t *testing.T) {
 		return
 	}
 
-	err = s.ExportToFile("export.txt")
+	err = s.ExportToFile(filepath.Join(testDir, "export.txt"))
 	if err != nil {
 		t.Error(err)
 		return
@@ -343,7 +649,7 @@ func TestService_ExportToFile(t *testing.T) {
 func TestService_ImportFromFile(t *testing.T) {
 	s := newTestService()
 
-	err := s.ImportFromFile("export.txt")
+	err := s.ImportFromFile(filepath.Join(testDir, "export.txt"))
 	if err != nil {
 		t.Error(err)
 		return
@@ -439,7 +745,7 @@ func TestService_Export(t *testing.T) {
 		return
 	}
 
-	err = s.Export("data")
+	err = s.Export(filepath.Join(testDir, "data"))
 	if err != nil {
 		t.Error(err)
 		return
@@ -448,7 +754,7 @@ func TestService_Export(t *testing.T) {
 
 func TestService_Import(t *testing.T) {
 	s := newTestService()
-	err := s.Import("data")
+	err := s.Import(filepath.Join(testDir, "data"))
 	if err != nil {
 		t.Error(err)
 	}
@@ -495,7 +801,7 @@ func TestService_HistoryToFiles(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = s.HistoryToFiles(payments, "history", 3)
+	err = s.HistoryToFiles(payments, t.TempDir(), 3)
 	if err != nil {
 		t.Error(err)
 	}
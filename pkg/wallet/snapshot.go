@@ -0,0 +1,236 @@
+package wallet
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//ErrInvalidSnapshot error for snapshot archive with files that aren't dumps
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+//ErrInvalidRetention error for negative number of snapshots to keep
+var ErrInvalidRetention = errors.New("number of snapshots to keep must not be negative")
+
+//snapshotPrefix and snapshotSuffix surround the creation time in the names of snapshot archives
+const (
+	snapshotPrefix = "wallet-"
+	snapshotSuffix = ".tar.gz"
+)
+
+//snapshotTimeFormat has fixed width, so the names of snapshots sort by their creation time
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+//Snapshot describes an archive written by CreateSnapshot
+type Snapshot struct {
+	Path      string
+	CreatedAt time.Time
+}
+
+//CreateSnapshot writes all the dumps with their manifest into a single compressed archive in {dir}, named by
+//the time of the service clock, and removes the oldest snapshots leaving the last {keep}, 0 keeps all of them
+func (s *Service) CreateSnapshot(dir string, keep int) (Snapshot, error) {
+	if keep < 0 {
+		return Snapshot{}, ErrInvalidRetention
+	}
+
+	err := makeDumpDir(dir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	staging, err := ioutil.TempDir(dir, ".snapshot")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.RemoveAll(staging)
+
+	err = s.Export(staging)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	createdAt := s.now().UTC()
+	snapshot := Snapshot{
+		Path:      filepath.Join(dir, snapshotPrefix+createdAt.Format(snapshotTimeFormat)+snapshotSuffix),
+		CreatedAt: createdAt,
+	}
+	err = createFileAtomic(snapshot.Path, func(w io.Writer) error {
+		return archiveDumps(w, staging, createdAt)
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return snapshot, rotateSnapshots(dir, keep)
+}
+
+//snapshotFiles lists the files of a snapshot in the order they are archived, the manifest goes first
+func snapshotFiles() []string {
+	files := []string{manifestFile}
+	for _, table := range dumpTables {
+		files = append(files, table.file())
+	}
+	return files
+}
+
+//archiveDumps writes the dumps exported into {dir} as a tar.gz archive
+func archiveDumps(w io.Writer, dir string, modTime time.Time) error {
+	compressor := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressor)
+	for _, name := range snapshotFiles() {
+		err := archiveFile(archive, filepath.Join(dir, name), modTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+//archiveFile adds the file to the archive
+func archiveFile(archive *tar.Writer, path string, modTime time.Time) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.Base(path),
+		Mode:     dumpFileMode,
+		Size:     info.Size(),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+//ListSnapshots returns the snapshots in {dir} from the oldest to the latest
+func ListSnapshots(dir string) ([]Snapshot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+
+		createdAt, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err != nil {
+			continue //not written by CreateSnapshot
+		}
+		snapshots = append(snapshots, Snapshot{Path: filepath.Join(dir, name), CreatedAt: createdAt})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+//rotateSnapshots removes the oldest snapshots in {dir} leaving the last {keep}, 0 keeps all of them
+func rotateSnapshots(dir string, keep int) error {
+	if keep == 0 {
+		return nil
+	}
+
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(snapshots) > keep {
+		err = os.Remove(snapshots[0].Path)
+		if err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+//RestoreSnapshot imports the dumps of the snapshot archive through ImportWithOptions,
+//so they are checked against the manifest and either all imported or, on any error, nothing is changed
+func (s *Service) RestoreSnapshot(path string, options ImportOptions) (*ImportReport, error) {
+	staging, err := ioutil.TempDir(filepath.Dir(path), ".restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	err = extractDumps(path, staging)
+	if err != nil {
+		return nil, err
+	}
+	return s.ImportWithOptions(staging, options)
+}
+
+//extractDumps writes the dumps of the archive into {dir}, refusing any other files
+func extractDumps(path string, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidSnapshot, path, err)
+	}
+	defer decompressor.Close()
+
+	allowed := make(map[string]bool)
+	for _, name := range snapshotFiles() {
+		allowed[name] = true
+	}
+
+	archive := tar.NewReader(decompressor)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidSnapshot, path, err)
+		}
+
+		if header.Typeflag != tar.TypeReg || !allowed[header.Name] {
+			return fmt.Errorf("%w: %s: unexpected file %q", ErrInvalidSnapshot, path, header.Name)
+		}
+
+		err = createFileAtomic(filepath.Join(dir, header.Name), func(w io.Writer) error {
+			_, err := io.Copy(w, archive)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package wallet
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestService_CreateSnapshot(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+
+	now := time.Date(2020, time.March, 10, 8, 0, 0, 0, time.UTC)
+	s.clock = func() time.Time { return now }
+
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	created := make([]Snapshot, 0)
+	for i := 0; i < 3; i++ {
+		snapshot, err := s.CreateSnapshot(dir, 2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		created = append(created, snapshot)
+		now = now.Add(time.Hour)
+	}
+
+	snapshots, err := ListSnapshots(dir)
+	if err != nil || len(snapshots) != 2 || snapshots[0] != created[1] || snapshots[1] != created[2] {
+		t.Errorf("ListSnapshots(): snapshots = %v, error = %v", snapshots, err)
+		return
+	}
+
+	info, err := os.Stat(snapshots[1].Path)
+	if err != nil || info.Mode().Perm() != dumpFileMode {
+		t.Errorf("CreateSnapshot(): wrong file = %v, error = %v", info, err)
+	}
+
+	restored := newTestService()
+	report, err := restored.RestoreSnapshot(snapshots[0].Path, ImportOptions{})
+	if err != nil || report.Accounts.Added != len(s.accounts) || report.Payments.Added != len(s.payments) {
+		t.Errorf("RestoreSnapshot(): report = %v, error = %v", report, err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 2 {
+		t.Errorf("CreateSnapshot(): staging files are left, files = %v, error = %v", files, err)
+	}
+
+	_, err = s.CreateSnapshot(dir, -1)
+	if err != ErrInvalidRetention {
+		t.Errorf("CreateSnapshot(): must return ErrInvalidRetention, returned = %v", err)
+	}
+}
+
+func TestService_RestoreSnapshot_invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	corrupted := filepath.Join(dir, "corrupted.tar.gz")
+	err := writeFileAtomic(corrupted, []byte("not an archive"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = newTestService().RestoreSnapshot(corrupted, ImportOptions{})
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("RestoreSnapshot(): must return ErrInvalidSnapshot, returned = %v", err)
+	}
+
+	unexpected := filepath.Join(dir, "unexpected.tar.gz")
+	file, err := os.Create(unexpected)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compressor := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressor)
+	_ = archive.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../accounts.dump", Mode: dumpFileMode})
+	_ = archive.Close()
+	_ = compressor.Close()
+	_ = file.Close()
+
+	_, err = newTestService().RestoreSnapshot(unexpected, ImportOptions{})
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("RestoreSnapshot(): must return ErrInvalidSnapshot, returned = %v", err)
+	}
+}
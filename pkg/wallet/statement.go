@@ -0,0 +1,286 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidPeriod error for statement period that doesn't end after it starts
+var ErrInvalidPeriod = errors.New("invalid statement period")
+
+//statementTimeFormat is the format of dates in CSV statements
+const statementTimeFormat = "2006-01-02 15:04:05"
+
+//StatementLineKind is the kind of balance change listed in a statement
+type StatementLineKind string
+
+//Kinds of statement lines
+const (
+	StatementPayment StatementLineKind = "payment" //a payment of the account, including the fees it paid
+	StatementDeposit StatementLineKind = "deposit" //money deposited into the account
+	StatementVoucher StatementLineKind = "voucher" //a voucher redeemed into the balance
+	StatementReward  StatementLineKind = "reward"  //a reward transaction, failed once clawed back
+	StatementFee     StatementLineKind = "fee"     //a fee credited to the revenue account
+)
+
+//StatementLine describes a change of the balance listed in the statement
+type StatementLine struct {
+	Date      time.Time
+	Kind      StatementLineKind
+	PaymentID string //the payment or the reward transaction, or the fee payment credited to the revenue account
+	Voucher   string //code of the redeemed voucher
+	Category  types.PaymentCategory
+	Status    types.PaymentStatus
+	Amount    types.Money //negative for the money leaving the account
+	Balance   types.Money //balance after the change
+}
+
+//CategoryTotal holds the sum of the statement payments of a category
+type CategoryTotal struct {
+	Category types.PaymentCategory
+	Total    types.Money
+}
+
+//Statement describes the balance changes of an account made in the period [From, To).
+//Failed payments are listed but don't change the balance, as their money is returned to the account
+type Statement struct {
+	AccountID int64
+	Phone     types.Phone
+	From      time.Time
+	To        time.Time
+	Complete  bool //false if the balances were imported after From, changes other than payments before are unknown
+	Opening   types.Money
+	Closing   types.Money
+	Lines     []StatementLine
+	Totals    []CategoryTotal //payments only, sorted by category
+}
+
+//balanceEntry is a change of an account balance other than a payment of the account, logged for statements
+type balanceEntry struct {
+	kind      StatementLineKind
+	accountID int64
+	amount    types.Money //negative for the money leaving the account
+	paymentID string
+	voucher   string
+	at        time.Time
+}
+
+//logBalance logs the change of the balance for statements
+func (s *Service) logBalance(entry balanceEntry) {
+	s.balanceLog = append(s.balanceLog, entry)
+}
+
+//Statement returns the statement of the account for the period [from, to). The balances are derived from the current
+//balance and the changes made since: the payments and reward transactions, and the deposits, vouchers and fees of
+//the balance log. The log isn't part of the dumps, so if the balances were imported after {from}, the changes made
+//before the import are unknown and the statement isn't Complete. Payments without the time they were made, imported from old dumps,
+//aren't part of any statement, and fees credited to the revenue account are dropped once refunded
+func (s *Service) Statement(accountID int64, from time.Time, to time.Time) (*Statement, error) {
+	if !to.After(from) {
+		return nil, ErrInvalidPeriod
+	}
+
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	payments, err := s.ExportAccountHistory(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	refunded := make(map[string]bool)
+	for _, payment := range s.payments {
+		if payment.Category == types.CategoryFee && payment.Status == types.PaymentStatusFail {
+			refunded[payment.ID] = true
+		}
+	}
+
+	statement := &Statement{
+		AccountID: accountID,
+		Phone:     account.Phone,
+		From:      from,
+		To:        to,
+		Complete:  s.balanceLogSince.IsZero() || !from.Before(s.balanceLogSince),
+		Closing:   account.Balance,
+	}
+
+	lines := make([]StatementLine, 0)
+	for _, payment := range payments {
+		kind, change := StatementPayment, balanceChange(&payment)
+		if change > 0 {
+			kind = StatementReward
+		}
+		if !payment.CreatedAt.IsZero() {
+			lines = append(lines, StatementLine{
+				Date:      payment.CreatedAt,
+				Kind:      kind,
+				PaymentID: payment.ID,
+				Category:  payment.Category,
+				Status:    payment.Status,
+				Amount:    change,
+			})
+		}
+	}
+	for _, entry := range s.balanceLog {
+		if entry.accountID == accountID && (entry.kind != StatementFee || !refunded[entry.paymentID]) {
+			lines = append(lines, StatementLine{
+				Date:      entry.at,
+				Kind:      entry.kind,
+				PaymentID: entry.paymentID,
+				Voucher:   entry.voucher,
+				Amount:    entry.amount,
+			})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Date.Before(lines[j].Date)
+	})
+
+	totals := make(map[types.PaymentCategory]types.Money)
+	for _, line := range lines {
+		if line.Date.Before(from) {
+			continue
+		}
+
+		change := line.Amount
+		if line.Status == types.PaymentStatusFail {
+			change = 0
+		}
+
+		if !line.Date.Before(to) {
+			statement.Closing -= change
+			continue
+		}
+
+		statement.Opening -= change
+		statement.Lines = append(statement.Lines, line)
+		if line.Kind == StatementPayment && change != 0 {
+			totals[line.Category] += change
+		}
+	}
+
+	statement.Opening += statement.Closing
+	balance := statement.Opening
+	for i, line := range statement.Lines {
+		if line.Status != types.PaymentStatusFail {
+			balance += line.Amount
+		}
+		statement.Lines[i].Balance = balance
+	}
+
+	for category, total := range totals {
+		statement.Totals = append(statement.Totals, CategoryTotal{Category: category, Total: total})
+	}
+	sort.Slice(statement.Totals, func(i, j int) bool {
+		return statement.Totals[i].Category < statement.Totals[j].Category
+	})
+	return statement, nil
+}
+
+//WriteCSV writes the statement as CSV for spreadsheets: the account and the period, the opening balance,
+//the balance changes with the running balance under a header row, the totals per category and the closing balance.
+//Amounts are written in units with two decimal places, dates in the location of {From}. A statement that isn't
+//Complete says so right after the opening balance
+func (st *Statement) WriteCSV(w io.Writer) error {
+	buffered := bufio.NewWriterSize(w, dumpBufferSize)
+	writer := csv.NewWriter(buffered)
+	location := st.From.Location()
+
+	records := [][]string{
+		{"Account", "Phone", "From", "To"},
+		{strconv.FormatInt(st.AccountID, 10), string(st.Phone), st.From.Format(statementTimeFormat), st.To.Format(statementTimeFormat)},
+		{},
+		{"Opening balance", formatMoney(st.Opening)},
+	}
+	if !st.Complete {
+		records = append(records, []string{"Incomplete", "the balances were imported during the period, they may be wrong"})
+	}
+	records = append(records, []string{}, []string{"Date", "Type", "Reference", "Category", "Status", "Amount", "Balance"})
+	for _, line := range st.Lines {
+		reference := line.PaymentID
+		if line.Kind == StatementVoucher {
+			reference = line.Voucher
+		}
+		records = append(records, []string{
+			line.Date.In(location).Format(statementTimeFormat),
+			string(line.Kind),
+			reference,
+			string(line.Category),
+			statusName(line.Status),
+			formatMoney(line.Amount),
+			formatMoney(line.Balance),
+		})
+	}
+
+	records = append(records, []string{}, []string{"Category", "Total"})
+	for _, total := range st.Totals {
+		records = append(records, []string{string(total.Category), formatMoney(total.Total)})
+	}
+	records = append(records, []string{}, []string{"Closing balance", formatMoney(st.Closing)})
+
+	err := writer.WriteAll(records)
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+//ExportStatements writes the CSV statement of every account for the period [from, to)
+//into {dir} as statement-{accountID}.csv, see Statement
+func (s *Service) ExportStatements(dir string, from time.Time, to time.Time) error {
+	if !to.After(from) {
+		return ErrInvalidPeriod
+	}
+
+	err := makeDumpDir(dir)
+	if err != nil {
+		return err
+	}
+
+	fs := s.dumpFS(dir)
+	for _, account := range s.accounts {
+		statement, err := s.Statement(account.ID, from, to)
+		if err != nil {
+			return err
+		}
+
+		err = fs.WriteFile(fmt.Sprintf("statement-%d.csv", account.ID), statement.WriteCSV)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//formatMoney formats the amount in cents as units with two decimal places
+func formatMoney(amount types.Money) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+//statusName returns the status of the payment in words
+func statusName(status types.PaymentStatus) string {
+	switch status {
+	case types.PaymentStatusOk:
+		return "completed"
+	case types.PaymentStatusFail:
+		return "failed"
+	case types.PaymentStatusInProgress:
+		return "in progress"
+	}
+	return string(status)
+}
@@ -0,0 +1,189 @@
+package wallet
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+func TestService_Statement(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.February, 28, 12, 0, 0, 0, time.UTC)
+	s.clock = func() time.Time { return now }
+
+	account, _ := s.RegisterAccount("+992000000001")
+	_ = s.Deposit(account.ID, 100_00)
+	_, _ = s.Pay(account.ID, 10_00, "food") //before the period
+
+	now = time.Date(2020, time.March, 2, 9, 30, 0, 0, time.UTC)
+	_, _ = s.Pay(account.ID, 5_50, "mobile")
+	now = now.Add(time.Hour)
+	failed, _ := s.Pay(account.ID, 20_00, "auto")
+	_ = s.Reject(failed.ID)
+	now = now.Add(time.Hour)
+	_, _ = s.Pay(account.ID, 2_25, "food")
+
+	now = time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	_, _ = s.Pay(account.ID, 1_00, "food") //after the period
+
+	from := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	statement, err := s.Statement(account.ID, from, to)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if statement.Opening != 90_00 || statement.Closing != 82_25 || len(statement.Lines) != 3 || statement.Lines[2].Balance != 82_25 {
+		t.Errorf("Statement(): wrong statement = %v", statement)
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = statement.WriteCSV(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lines := strings.Split(buffer.String(), "\n")
+	expected := []string{
+		"Account,Phone,From,To",
+		"1,+992000000001,2020-03-01 00:00:00,2020-04-01 00:00:00",
+		"",
+		"Opening balance,90.00",
+		"",
+		"Date,Type,Reference,Category,Status,Amount,Balance",
+		"2020-03-02 09:30:00,payment," + statement.Lines[0].PaymentID + ",mobile,in progress,-5.50,84.50",
+		"2020-03-02 10:30:00,payment," + failed.ID + ",auto,failed,-20.00,84.50",
+		"2020-03-02 11:30:00,payment," + statement.Lines[2].PaymentID + ",food,in progress,-2.25,82.25",
+		"",
+		"Category,Total",
+		"food,-2.25",
+		"mobile,-5.50",
+		"",
+		"Closing balance,82.25",
+		"",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("WriteCSV(): wrong statement:\n%s", buffer.String())
+	}
+
+	_, err = s.Statement(account.ID, to, from)
+	if err != ErrInvalidPeriod {
+		t.Errorf("Statement(): must return ErrInvalidPeriod, returned = %v", err)
+	}
+}
+
+func TestService_Statement_balanceChanges(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.February, 28, 12, 0, 0, 0, time.UTC)
+	s.clock = func() time.Time { return now }
+
+	account, _ := s.RegisterAccount("+992000000001")
+	revenue, _ := s.RegisterAccount("+992000000002")
+	_ = s.SetRevenueAccount(revenue.ID)
+	_ = s.SetFeeRules([]FeeRule{{Category: types.CategoryAuto, Flat: 1_00}})
+	_ = s.SetRewardRules([]RewardRule{{ID: "cashback", Category: types.CategoryFood, Percent: 1_000}})
+	vouchers, _ := s.GenerateVouchers(1, 20_00, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC), 1)
+	_ = s.Deposit(account.ID, 100_00)
+
+	from := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	opening := account.Balance
+
+	now = time.Date(2020, time.March, 2, 9, 0, 0, 0, time.UTC)
+	_, _ = s.Pay(account.ID, 10_00, types.CategoryFood) //1.00 of cashback
+	now = now.Add(time.Hour)
+	_ = s.Deposit(account.ID, 5_00)
+	now = now.Add(time.Hour)
+	_, _ = s.Redeem(account.ID, vouchers[0].Code)
+	now = now.Add(time.Hour)
+	rejected, _ := s.Pay(account.ID, 30_00, types.CategoryAuto) //and 1.00 of fee
+	now = now.Add(time.Hour)
+	_, _ = s.Pay(account.ID, 4_00, types.CategoryAuto)
+	now = now.Add(time.Hour)
+	_ = s.Reject(rejected.ID)
+	closing := account.Balance
+
+	now = time.Date(2020, time.April, 2, 0, 0, 0, 0, time.UTC)
+	_, _ = s.Pay(account.ID, 50_00, types.CategoryFood) //after the period, with 5.00 of cashback
+	_ = s.Deposit(account.ID, 7_00)
+
+	statement, err := s.Statement(account.ID, from, to)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	last := statement.Lines[len(statement.Lines)-1]
+	if !statement.Complete || statement.Opening != opening || statement.Closing != closing || last.Balance != closing {
+		t.Errorf("Statement(): wrong balances, opening = %v, closing = %v, expected %v and %v, lines = %v",
+			statement.Opening, statement.Closing, opening, closing, statement.Lines)
+	}
+
+	kinds := make([]StatementLineKind, len(statement.Lines))
+	for i, line := range statement.Lines {
+		kinds[i] = line.Kind
+	}
+	expected := []StatementLineKind{StatementPayment, StatementReward, StatementDeposit, StatementVoucher,
+		StatementPayment, StatementPayment, StatementPayment, StatementPayment}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Statement(): wrong lines = %v", statement.Lines)
+	}
+
+	income, err := s.Statement(revenue.ID, from, to)
+	if err != nil || income.Opening != 0 || income.Closing != 1_00 || len(income.Lines) != 1 || income.Lines[0].Kind != StatementFee {
+		t.Errorf("Statement(): wrong revenue statement = %v, error = %v", income, err)
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	imported.clock = s.clock
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	statement, err = imported.Statement(account.ID, from, to)
+	if err != nil || statement.Complete {
+		t.Errorf("Statement(): must be incomplete after import, statement = %v, error = %v", statement, err)
+	}
+
+	statement, err = imported.Statement(account.ID, now, now.Add(time.Hour))
+	if err != nil || !statement.Complete {
+		t.Errorf("Statement(): must be complete after import, statement = %v, error = %v", statement, err)
+	}
+}
+
+func TestService_ExportStatements(t *testing.T) {
+	s := newTestService()
+	fillData(s)
+	s.payments = append(s.payments, &types.Payment{ID: "legacy", AccountID: 1, Amount: 1, Category: "food", Status: types.PaymentStatusOk})
+
+	dir := t.TempDir()
+	from := time.Now().Add(-time.Hour)
+	err := s.ExportStatements(dir, from, from.Add(2*time.Hour))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "statement-1.csv"))
+	if err != nil || strings.Count(string(content), ",completed,")+strings.Count(string(content), ",in progress,") != 7 {
+		t.Errorf("ExportStatements(): wrong statement = %s, error = %v", content, err)
+	}
+}
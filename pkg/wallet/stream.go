@@ -0,0 +1,422 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//dumpBufferSize is the size of the buffers dumps are streamed through, memory used by Export and Import
+//for reading and writing doesn't grow with the number of records
+const dumpBufferSize = 64 * 1024
+
+//dumpMaxLine limits the length of a line of a text dump, so a broken line doesn't make Import read gigabytes
+const dumpMaxLine = 1 << 20
+
+//dumpWriter streams the records of a table in the current dump version, counting them and
+//computing the checksum for the manifest. Records are built in a reused line buffer, so writing doesn't allocate
+type dumpWriter struct {
+	writer  *bufio.Writer
+	hash    hash.Hash
+	line    []byte
+	fields  int
+	records int
+}
+
+//newDumpWriter writes the header of the table dump and returns the writer of its records
+func newDumpWriter(w io.Writer, table dumpTable) (*dumpWriter, error) {
+	d := newRecordWriter(w)
+	d.line = append(d.line, dumpMagic...)
+	d.line = append(d.line, " v"...)
+	d.line = strconv.AppendInt(d.line, dumpVersion, 10)
+	d.line = append(d.line, ' ')
+	d.line = append(d.line, table.name...)
+	d.line = append(d.line, '\n')
+	d.line = appendDumpRecord(d.line, table.columns)
+
+	_, err := d.writer.Write(d.line)
+	d.line = d.line[:0]
+	return d, err
+}
+
+//newRecordWriter returns the writer of records without header
+func newRecordWriter(w io.Writer) *dumpWriter {
+	hash := sha256.New()
+	return &dumpWriter{
+		writer: bufio.NewWriterSize(io.MultiWriter(w, hash), dumpBufferSize),
+		hash:   hash,
+		line:   make([]byte, 0, 256),
+	}
+}
+
+//text adds the escaped field to the record
+func (d *dumpWriter) text(value string) {
+	if d.fields > 0 {
+		d.line = append(d.line, ';')
+	}
+	d.line = appendDumpField(d.line, value)
+	d.fields++
+}
+
+//int adds the integer field to the record
+func (d *dumpWriter) int(value int64) {
+	if d.fields > 0 {
+		d.line = append(d.line, ';')
+	}
+	d.line = strconv.AppendInt(d.line, value, 10)
+	d.fields++
+}
+
+//timestamp adds the time field to the record in nanoseconds since the epoch, the zero time is left empty
+func (d *dumpWriter) timestamp(value time.Time) {
+	if value.IsZero() {
+		d.text("")
+		return
+	}
+	d.int(value.UnixNano())
+}
+
+//end writes the record
+func (d *dumpWriter) end() error {
+	d.line = append(d.line, '\n')
+	_, err := d.writer.Write(d.line)
+	d.line = d.line[:0]
+	d.fields = 0
+	d.records++
+	return err
+}
+
+//record writes the record of {fields}
+func (d *dumpWriter) record(fields []string) error {
+	for _, field := range fields {
+		d.text(field)
+	}
+	return d.end()
+}
+
+//flush writes the buffered records
+func (d *dumpWriter) flush() error {
+	return d.writer.Flush()
+}
+
+//entry describes the flushed dump for the manifest
+func (d *dumpWriter) entry(file string) manifestEntry {
+	return manifestEntry{file: file, records: d.records, checksum: hex.EncodeToString(d.hash.Sum(nil))}
+}
+
+//account writes the record of the account in the order of accountsTable
+func (d *dumpWriter) account(account *types.Account) error {
+	d.int(account.ID)
+	d.text(string(account.Phone))
+	d.int(int64(account.Balance))
+	d.timestamp(account.UpdatedAt)
+	return d.end()
+}
+
+//payment writes the record of the payment in the order of paymentsTable
+func (d *dumpWriter) payment(payment *types.Payment) error {
+	d.text(payment.ID)
+	d.int(payment.AccountID)
+	d.int(int64(payment.Amount))
+	d.text(string(payment.Category))
+	d.text(string(payment.Status))
+	d.text(payment.LinkedID)
+	d.timestamp(payment.UpdatedAt)
+	d.timestamp(payment.CreatedAt)
+	return d.end()
+}
+
+//favorite writes the record of the favorite in the order of favoritesTable
+func (d *dumpWriter) favorite(favorite *types.Favorite) error {
+	d.text(favorite.ID)
+	d.int(favorite.AccountID)
+	d.text(favorite.Name)
+	d.int(int64(favorite.Amount))
+	d.text(string(favorite.Category))
+	d.int(int64(favorite.Position))
+	d.timestamp(favorite.UpdatedAt)
+	return d.end()
+}
+
+//voucher writes the record of the voucher in the order of vouchersTable
+func (d *dumpWriter) voucher(voucher *types.Voucher) error {
+	d.text(voucher.Code)
+	d.int(int64(voucher.Amount))
+	d.timestamp(voucher.ExpiresAt)
+	d.int(int64(voucher.MaxUses))
+	d.text("")
+	for i, accountID := range voucher.RedeemedBy {
+		if i > 0 {
+			d.line = append(d.line, ',')
+		}
+		d.line = strconv.AppendInt(d.line, accountID, 10)
+	}
+	return d.end()
+}
+
+//reward writes the record of the reward in the order of rewardsTable
+func (d *dumpWriter) reward(reward *types.Reward) error {
+	d.text(reward.ID)
+	d.text(reward.RuleID)
+	d.int(reward.AccountID)
+	d.text(reward.PaymentID)
+	d.int(int64(reward.Amount))
+	d.text(string(reward.Status))
+	d.timestamp(reward.CreatedAt)
+	d.timestamp(reward.AvailableAt)
+	return d.end()
+}
+
+//dumpReader streams the records of a table dump of any version, including the "|" separated
+//accounts written by the first version of ExportToFile, counting them and computing the checksum
+type dumpReader struct {
+	file      string
+	reader    *bufio.Reader
+	hash      hash.Hash
+	columns   map[string]int
+	count     int //number of columns
+	required  int
+	version   int //1 for headerless dumps
+	escaped   bool
+	separator byte     //ends the records, "|" for the accounts of the first version of ExportToFile
+	pending   []string //record read with the header detection
+	line      int      //line of the next record
+	records   int
+	exhausted bool
+}
+
+//newDumpReader reads the header of the table dump, a broken header fails the whole dump
+func newDumpReader(r io.Reader, table dumpTable, file string) (*dumpReader, error) {
+	hash := sha256.New()
+	d := &dumpReader{
+		file:      file,
+		reader:    bufio.NewReaderSize(io.TeeReader(r, hash), dumpBufferSize),
+		hash:      hash,
+		required:  table.required,
+		version:   1,
+		separator: '\n',
+		line:      1,
+	}
+	columns := table.columns
+
+	var first string
+	var err error
+	if table.name == accountsTable.name {
+		first, err = d.readFirstAccount()
+	} else {
+		first, err = d.readLine()
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if strings.HasPrefix(first, dumpMagic) {
+		if err == io.EOF {
+			return nil, &DumpError{File: file, Line: 1, Reason: "no column names"}
+		}
+
+		header := strings.Fields(first)
+		if len(header) != 3 || header[0] != dumpMagic || !strings.HasPrefix(header[1], "v") {
+			return nil, &DumpError{File: file, Line: 1, Reason: fmt.Sprintf("malformed header %q", first)}
+		}
+
+		version, err := strconv.Atoi(header[1][1:])
+		if err != nil || version < 2 {
+			return nil, &DumpError{File: file, Line: 1, Reason: fmt.Sprintf("malformed header %q", first)}
+		}
+
+		if version > dumpVersion {
+			return nil, fmt.Errorf("%w: %s: v%d", ErrUnsupportedDumpVersion, file, version)
+		}
+
+		if header[2] != table.name {
+			return nil, &DumpError{File: file, Line: 1, Reason: fmt.Sprintf("%s dump expected, got %s", table.name, header[2])}
+		}
+
+		d.line = 2
+		names, err := d.readLine()
+		if err == io.EOF {
+			return nil, &DumpError{File: file, Line: 2, Reason: "no column names"}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		d.version = version
+		d.escaped = version >= 3
+		columns, err = splitDumpRecord(names, d.escaped)
+		if err != nil {
+			return nil, &DumpError{File: file, Line: 2, Reason: err.Error()}
+		}
+		d.required = len(columns)
+		d.line = 3
+	} else {
+		d.pending = []string{first}
+		d.exhausted = err == io.EOF
+	}
+
+	d.count = len(columns)
+	d.columns = make(map[string]int, len(columns))
+	for i, column := range columns {
+		d.columns[column] = i
+	}
+
+	for _, column := range table.columns[:table.required] {
+		if _, ok := d.columns[column]; !ok {
+			return nil, &DumpError{File: file, Line: 2, Field: column, Reason: "no such column"}
+		}
+	}
+	return d, nil
+}
+
+//readLine returns the next record without the separator, io.EOF is returned with the last record that has no separator.
+//A record longer than dumpMaxLine fails the dump
+func (d *dumpReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := d.reader.ReadSlice(d.separator)
+		if len(line)+len(chunk) > dumpMaxLine+1 {
+			return "", d.tooLong()
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			line = append(line, chunk...)
+		case err == nil && line == nil:
+			return string(chunk[:len(chunk)-1]), nil
+		case err == nil:
+			line = append(line, chunk[:len(chunk)-1]...)
+			return string(line), nil
+		default:
+			return string(append(line, chunk...)), err
+		}
+	}
+}
+
+//readFirstAccount returns the first record of an accounts dump. It ends with "|" in the dumps of the first
+//version of ExportToFile, which have all the accounts on a single line, and the reader reads them one at a time
+func (d *dumpReader) readFirstAccount() (string, error) {
+	line := make([]byte, 0)
+	for {
+		c, err := d.reader.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+
+		switch {
+		case c == '|' && !bytes.HasPrefix(line, []byte(dumpMagic)):
+			d.separator = '|'
+			return string(line), nil
+		case c == '\n':
+			return string(line), nil
+		case len(line) == dumpMaxLine:
+			return "", d.tooLong()
+		}
+		line = append(line, c)
+	}
+}
+
+//tooLong describes the record longer than dumpMaxLine
+func (d *dumpReader) tooLong() *DumpError {
+	return &DumpError{File: d.file, Line: d.line, Reason: fmt.Sprintf("longer than %d bytes", dumpMaxLine)}
+}
+
+//next returns the next record, or the error describing the record that doesn't fit the columns.
+//It returns io.EOF after the last record
+func (d *dumpReader) next() (dumpRow, *DumpError, error) {
+	var record string
+	switch {
+	case len(d.pending) != 0:
+		record = d.pending[0]
+		d.pending = d.pending[1:]
+	case d.exhausted:
+		return dumpRow{}, nil, io.EOF
+	default:
+		var err error
+		record, err = d.readLine()
+		if err == io.EOF {
+			d.exhausted = true
+		} else if err != nil {
+			return dumpRow{}, nil, err
+		}
+	}
+
+	if record == "" && d.exhausted && len(d.pending) == 0 {
+		return dumpRow{}, nil, io.EOF //the last record ends with the line break
+	}
+
+	line := d.line
+	d.line++
+	d.records++
+
+	fields, err := splitDumpRecord(record, d.escaped)
+	if err != nil {
+		return dumpRow{}, &DumpError{File: d.file, Line: line, Reason: err.Error()}, nil
+	}
+
+	if len(fields) < d.required || len(fields) > d.count {
+		return dumpRow{}, &DumpError{File: d.file, Line: line, Reason: fmt.Sprintf("%d fields, expected %d", len(fields), d.count)}, nil
+	}
+	return dumpRow{file: d.file, line: line, version: d.version, columns: d.columns, fields: fields}, nil, nil
+}
+
+//entry describes the dump read to the end for the comparison with the manifest
+func (d *dumpReader) entry() manifestEntry {
+	return manifestEntry{records: d.records, checksum: hex.EncodeToString(d.hash.Sum(nil))}
+}
+
+//exportTable streams the dump of the table into {w} and describes it for the manifest
+func (s *Service) exportTable(w io.Writer, table dumpTable) (manifestEntry, error) {
+	return s.exportTableSince(w, table, 0)
+}
+
+//exportTableSince streams the dump of the records of the table changed after the checkpoint {since}, see exportTable
+func (s *Service) exportTableSince(w io.Writer, table dumpTable, since int64) (manifestEntry, error) {
+	d, err := newDumpWriter(w, table)
+	switch table.name {
+	case accountsTable.name:
+		for i := 0; err == nil && i < len(s.accounts); i++ {
+			if s.changedSince(accountKey(s.accounts[i].ID), since) {
+				err = d.account(s.accounts[i])
+			}
+		}
+	case paymentsTable.name:
+		for i := 0; err == nil && i < len(s.payments); i++ {
+			if s.changedSince(paymentKey(s.payments[i].ID), since) {
+				err = d.payment(s.payments[i])
+			}
+		}
+	case favoritesTable.name:
+		for i := 0; err == nil && i < len(s.favorites); i++ {
+			if s.changedSince(favoriteKey(s.favorites[i].ID), since) {
+				err = d.favorite(s.favorites[i])
+			}
+		}
+	case vouchersTable.name:
+		for i := 0; err == nil && i < len(s.vouchers); i++ {
+			if s.changedSince(voucherKey(s.vouchers[i].Code), since) {
+				err = d.voucher(s.vouchers[i])
+			}
+		}
+	case rewardsTable.name:
+		for i := 0; err == nil && i < len(s.rewards); i++ {
+			if s.changedSince(rewardKey(s.rewards[i].ID), since) {
+				err = d.reward(s.rewards[i])
+			}
+		}
+	}
+
+	if err == nil {
+		err = d.flush()
+	}
+	return d.entry(table.file()), err
+}
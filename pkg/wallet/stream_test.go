@@ -0,0 +1,172 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//generatedService returns the service with an account and {count} payments
+func generatedService(count int) *testService {
+	s := newTestService()
+	s.accounts = append(s.accounts, &types.Account{ID: 1, Phone: "+992000000001", Balance: 1_000_000})
+	s.nextAccountID = 1
+	updatedAt := time.Date(2020, time.March, 10, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		s.payments = append(s.payments, &types.Payment{
+			ID:        uuid.New().String(),
+			AccountID: 1,
+			Amount:    types.Money(i%1000 + 1),
+			Category:  types.CategoryMobile,
+			Status:    types.PaymentStatusOk,
+			UpdatedAt: updatedAt,
+		})
+	}
+	return s
+}
+
+func TestService_exportTable_allocations(t *testing.T) {
+	allocations := make([]float64, 0)
+	for _, count := range []int{10, 10_000} {
+		s := generatedService(count)
+		allocations = append(allocations, testing.AllocsPerRun(5, func() {
+			_, err := s.exportTable(ioutil.Discard, paymentsTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}))
+	}
+
+	if allocations[0] != allocations[1] {
+		t.Errorf("exportTable(): allocations grow with the number of records, %v", allocations)
+	}
+}
+
+func TestStreamDump(t *testing.T) {
+	s := generatedService(1000)
+	var buffer bytes.Buffer
+	written, err := s.exportTable(&buffer, paymentsTable)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	read := 0
+	errs, err := streamDump(&buffer, "payments.dump", paymentsTable, &written, func(row dumpRow) error {
+		payment, err := paymentFromRow(row)
+		if err == nil && (!samePayment(payment, s.payments[read]) || !payment.UpdatedAt.Equal(s.payments[read].UpdatedAt)) {
+			t.Errorf("streamDump(): wrong payment %v, expected %v", payment, s.payments[read])
+		}
+		read++
+		return err
+	})
+	if err != nil || len(errs) != 0 || read != len(s.payments) {
+		t.Errorf("streamDump(): read = %v, errors = %v, error = %v", read, errs, err)
+	}
+}
+
+func TestStreamDump_longLines(t *testing.T) {
+	long := "#wallet-dump v4 payments\nid;account_id;amount;category;status\n" + strings.Repeat("x", dumpMaxLine+1) + "\n"
+	_, err := streamDump(strings.NewReader(long), "payments.dump", paymentsTable, nil, func(row dumpRow) error {
+		return nil
+	})
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) || dumpErr.Line != 3 {
+		t.Errorf("streamDump(): must fail with the line too long, error = %v", err)
+		return
+	}
+
+	var legacy strings.Builder //accounts of the first version of ExportToFile, all on a single line
+	count := 0
+	for legacy.Len() <= dumpMaxLine {
+		count++
+		fmt.Fprintf(&legacy, "%d;+992%09d;100|", count, count)
+	}
+
+	read := 0
+	errs, err := streamDump(strings.NewReader(legacy.String()), "export.txt", accountsTable, nil, func(row dumpRow) error {
+		read++
+		_, err := accountFromRow(row)
+		return err
+	})
+	if err != nil || len(errs) != 0 || read != count {
+		t.Errorf("streamDump(): accounts read = %v, expected %v, errors = %v, error = %v", read, count, errs, err)
+	}
+}
+
+func benchmarkSizes(b *testing.B, run func(b *testing.B, s *testService)) {
+	for _, count := range []int{1_000, 10_000, 100_000} {
+		s := generatedService(count)
+		b.Run("payments="+strconv.Itoa(count), func(b *testing.B) {
+			b.ReportAllocs()
+			run(b, s)
+		})
+	}
+}
+
+//BenchmarkService_Export shows that the memory used by Export doesn't depend on the number of records
+func BenchmarkService_Export(b *testing.B) {
+	benchmarkSizes(b, func(b *testing.B, s *testService) {
+		dir := filepath.Join(b.TempDir(), "dump")
+		for i := 0; i < b.N; i++ {
+			err := s.Export(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+//BenchmarkStreamDump shows that reading a dump uses the same memory per record regardless of the number
+//of records, the records themselves aren't kept
+func BenchmarkStreamDump(b *testing.B) {
+	benchmarkSizes(b, func(b *testing.B, s *testService) {
+		var buffer bytes.Buffer
+		_, err := s.exportTable(&buffer, paymentsTable)
+		if err != nil {
+			b.Fatal(err)
+		}
+		content := buffer.Bytes()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := streamDump(bytes.NewReader(content), "payments.dump", paymentsTable, nil, func(row dumpRow) error {
+				_, err := paymentFromRow(row)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+//BenchmarkService_Import shows the memory Import takes, unlike Export it grows with the number of records:
+//they are kept in the wallet, no copy of them is made to check the integrity of the result. The time grows
+//linearly too, the records are looked up by an index built once per import
+func BenchmarkService_Import(b *testing.B) {
+	benchmarkSizes(b, func(b *testing.B, s *testService) {
+		dir := filepath.Join(b.TempDir(), "dump")
+		err := s.Export(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			err := newTestService().Import(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
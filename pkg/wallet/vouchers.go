@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sekaiichi/temproray_wallet/pkg/types"
+)
+
+//ErrInvalidVoucher error for voucher batch with non positive count, amount or uses, or expiry in the past
+var ErrInvalidVoucher = errors.New("invalid voucher")
+
+//ErrVoucherNotFound error for inexistent voucher code
+var ErrVoucherNotFound = errors.New("voucher not found")
+
+//ErrVoucherExpired error for redeeming a voucher after its expiry
+var ErrVoucherExpired = errors.New("voucher expired")
+
+//ErrVoucherUsedUp error for redeeming a voucher more times than allowed
+var ErrVoucherUsedUp = errors.New("voucher used up")
+
+//ErrVoucherRedeemed error for redeeming the same voucher twice into one account
+var ErrVoucherRedeemed = errors.New("voucher already redeemed by account")
+
+//voucherAlphabet has no characters that are easy to confuse when typed by hand, like 0 and O or 1 and I
+const voucherAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+//voucherCodeLength is the number of characters in generated codes
+const voucherCodeLength = 12
+
+//newVoucherCode returns a random code from voucherAlphabet
+func newVoucherCode() (string, error) {
+	buffer := make([]byte, voucherCodeLength)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+
+	for i, b := range buffer {
+		buffer[i] = voucherAlphabet[int(b)%len(voucherAlphabet)]
+	}
+	return string(buffer), nil
+}
+
+//GenerateVouchers creates {count} vouchers with unique codes, each can be redeemed by {maxUses} different accounts until {expiresAt}
+func (s *Service) GenerateVouchers(count int, amount types.Money, expiresAt time.Time, maxUses int) ([]*types.Voucher, error) {
+	if count <= 0 || amount <= 0 || maxUses <= 0 || !expiresAt.After(s.now()) {
+		return nil, ErrInvalidVoucher
+	}
+
+	codes := make(map[string]bool, len(s.vouchers)+count)
+	for _, voucher := range s.vouchers {
+		codes[voucher.Code] = true
+	}
+
+	vouchers := make([]*types.Voucher, 0, count)
+	for len(vouchers) < count {
+		code, err := newVoucherCode()
+		if err != nil {
+			return nil, err
+		}
+
+		if codes[code] {
+			continue
+		}
+		codes[code] = true
+
+		vouchers = append(vouchers, &types.Voucher{
+			Code:      code,
+			Amount:    amount,
+			ExpiresAt: expiresAt,
+			MaxUses:   maxUses,
+		})
+	}
+
+	s.vouchers = append(s.vouchers, vouchers...)
+	for _, voucher := range vouchers {
+		s.track(voucherKey(voucher.Code))
+	}
+	return vouchers, nil
+}
+
+//FindVoucherByCode returns the pointer to a voucher and an error, the code is case insensitive
+func (s *Service) FindVoucherByCode(code string) (*types.Voucher, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, voucher := range s.vouchers {
+		if voucher.Code == code {
+			return voucher, nil
+		}
+	}
+	return nil, ErrVoucherNotFound
+}
+
+//Redeem deposits the voucher amount into the account, each account can redeem a voucher only once
+func (s *Service) Redeem(accountID int64, code string) (*types.Voucher, error) {
+	voucher, err := s.FindVoucherByCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.now().Before(voucher.ExpiresAt) {
+		return nil, ErrVoucherExpired
+	}
+
+	for _, redeemedBy := range voucher.RedeemedBy {
+		if redeemedBy == accountID {
+			return nil, ErrVoucherRedeemed
+		}
+	}
+
+	if len(voucher.RedeemedBy) >= voucher.MaxUses {
+		return nil, ErrVoucherUsedUp
+	}
+
+	err = s.deposit(balanceEntry{kind: StatementVoucher, accountID: accountID, amount: voucher.Amount, voucher: voucher.Code})
+	if err != nil {
+		return nil, err
+	}
+
+	voucher.RedeemedBy = append(voucher.RedeemedBy, accountID)
+	s.track(voucherKey(voucher.Code))
+	return voucher, nil
+}
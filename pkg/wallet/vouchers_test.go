@@ -0,0 +1,176 @@
+package wallet
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_GenerateVouchers_success(t *testing.T) {
+	s := newTestService()
+	vouchers, err := s.GenerateVouchers(1_000, 10_00, time.Now().Add(time.Hour), 1)
+	if err != nil {
+		t.Errorf("GenerateVouchers(): error = %v", err)
+		return
+	}
+
+	codes := make(map[string]bool)
+	for _, voucher := range vouchers {
+		if codes[voucher.Code] || len(voucher.Code) != voucherCodeLength {
+			t.Errorf("GenerateVouchers(): invalid or duplicate code = %v", voucher.Code)
+			return
+		}
+		codes[voucher.Code] = true
+	}
+}
+
+func TestService_GenerateVouchers_fail(t *testing.T) {
+	s := newTestService()
+	_, err := s.GenerateVouchers(1, 10_00, time.Now().Add(-time.Hour), 1)
+	if err != ErrInvalidVoucher {
+		t.Errorf("GenerateVouchers(): must return ErrInvalidVoucher, returned = %v", err)
+	}
+
+	_, err = s.GenerateVouchers(1, 0, time.Now().Add(time.Hour), 1)
+	if err != ErrInvalidVoucher {
+		t.Errorf("GenerateVouchers(): must return ErrInvalidVoucher, returned = %v", err)
+	}
+}
+
+func TestService_Redeem(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	s.setTime(now)
+	first, err := s.addAccountWithBalance("+992000000001", 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	second, err := s.addAccountWithBalance("+992000000002", 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	third, err := s.addAccountWithBalance("+992000000003", 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	vouchers, err := s.GenerateVouchers(1, 10_00, now.Add(time.Hour), 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	code := vouchers[0].Code
+
+	_, err = s.Redeem(first.ID, strings.ToLower(code))
+	if err != nil {
+		t.Errorf("Redeem(): error = %v", err)
+		return
+	}
+
+	_, err = s.Redeem(first.ID, code)
+	if err != ErrVoucherRedeemed {
+		t.Errorf("Redeem(): must return ErrVoucherRedeemed, returned = %v", err)
+	}
+
+	_, err = s.Redeem(second.ID, code)
+	if err != nil {
+		t.Errorf("Redeem(): error = %v", err)
+		return
+	}
+
+	_, err = s.Redeem(third.ID, code)
+	if err != ErrVoucherUsedUp {
+		t.Errorf("Redeem(): must return ErrVoucherUsedUp, returned = %v", err)
+	}
+
+	_, err = s.Redeem(third.ID, "UNKNOWN")
+	if err != ErrVoucherNotFound {
+		t.Errorf("Redeem(): must return ErrVoucherNotFound, returned = %v", err)
+	}
+
+	if first.Balance != 10_01 || second.Balance != 10_01 || third.Balance != 1 {
+		t.Errorf("Redeem(): wrong balances = %v, %v, %v", first.Balance, second.Balance, third.Balance)
+	}
+}
+
+func TestService_Redeem_expired(t *testing.T) {
+	s := newTestService()
+	now := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	s.setTime(now)
+	account, err := s.addAccountWithBalance("+992000000001", 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	vouchers, err := s.GenerateVouchers(1, 10_00, now.Add(time.Hour), 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s.setTime(now.Add(time.Hour))
+	_, err = s.Redeem(account.ID, vouchers[0].Code)
+	if err != ErrVoucherExpired {
+		t.Errorf("Redeem(): must return ErrVoucherExpired, returned = %v", err)
+	}
+}
+
+func TestService_ExportImport_vouchers(t *testing.T) {
+	s := newTestService()
+	account, err := s.addAccountWithBalance("+992000000001", 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	vouchers, err := s.GenerateVouchers(2, 10_00, time.Now().Add(time.Hour), 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Redeem(account.ID, vouchers[0].Code)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, voucher := range vouchers {
+		got, err := imported.FindVoucherByCode(voucher.Code)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if got.Amount != voucher.Amount || got.MaxUses != voucher.MaxUses || !got.ExpiresAt.Equal(voucher.ExpiresAt) ||
+			!reflect.DeepEqual(got.RedeemedBy, voucher.RedeemedBy) {
+			t.Errorf("Import(): voucher doesn't match, want = %v, got = %v", voucher, got)
+		}
+	}
+
+	_, err = imported.Redeem(account.ID, vouchers[0].Code)
+	if err != ErrVoucherRedeemed {
+		t.Errorf("Redeem(): must return ErrVoucherRedeemed after import, returned = %v", err)
+	}
+}